@@ -1,31 +1,1266 @@
 #!/usr/bin/env python3
+import os
+import re
 import sys
+import hmac
+import json
+import math
 import time
+import zlib
 import bisect
-from typing import Dict, List, Tuple, Optional, Any
+import fnmatch
+import queue
+import random
+import signal
+import struct
+import base64
+import binascii
+import hashlib
+import argparse
+import functools
+import contextlib
+import collections
+import threading
+import http.server
+import socketserver
+import urllib.parse
+from datetime import timedelta
+from typing import Callable, Dict, Iterable, Iterator, List, NamedTuple, Tuple, Optional, Any
+
+SWEEP_INTERVAL = 0.1  # Seconds between active expiry sweeps
+SHUTDOWN_TIMEOUT = 5.0  # Seconds shutdown waits for in-flight commands and the final fsync
+CANCEL_CHECK_INTERVAL = 1024  # Keys a long scan visits between checks for cancellation
+RANGE_ITER_CHUNK = 1000  # Keys iter_range reads per acquisition of the read lock
+
+# When the log is fsynced, trading durability for write throughput:
+#   always   - after every write; an acknowledged write survives power loss, but
+#              each write waits for the disk
+#   everysec - once per second from a background thread; a power loss can drop
+#              about the last second of writes
+#   no       - never explicitly; the OS flushes on its own schedule (often ~30s)
+# In every mode writes reach the OS immediately, so a crash of the kvs process
+# alone loses nothing.
+FSYNC_POLICIES = ("always", "everysec", "no")
+# What a write that would exceed maxkeys does: fail, or evict random keys to make room
+MAXKEYS_POLICIES = ("noeviction", "random")
+SNAPSHOT_MAGIC = b"KVSSNAP5"
+# Snapshot value type tags
+SNAPSHOT_STRING = 0
+SNAPSHOT_LIST = 1
+SNAPSHOT_HASH = 2
+SNAPSHOT_SET = 3
+SNAPSHOT_ZSET = 4
+SNAPSHOT_COMPRESSED = 5  # A string kept compressed (CompressedString)
+DUMP_VERSION = 1
+
+INT64_MIN, INT64_MAX = -2**63, 2**63 - 1
+
+
+class ErrorReply(str):
+    """A reply that reports an error. Errors are told apart by this type, never by
+    their text, since a stored value may well start with "ERR" too."""
+
+
+WRONGTYPE_ERROR = ErrorReply("ERR WRONGTYPE Operation against a key holding the wrong kind of value")
+READONLY_ERROR = ErrorReply("ERR READONLY You can't write against a read only replica")
+MAX_LOG_RECORD = 1 << 30  # Bytes past which a record's length header can't be genuine
+TAIL_INTERVAL = 0.1  # Seconds between a replica's polls of the log
+MAX_STRING_SIZE = 512 * 1024 * 1024  # Bytes SETRANGE may grow a string to, as in Redis
+# Keyspace notification event for each logged command that has a different name
+# from it, or None for entries that don't change a key
+KEYSPACE_EVENTS = {"SETEX": "set", "PEXPIREAT": "expire",
+                   "SELECT": None, "SWAPDB": None, "SNAPSHOT": None, "SEQ": None, "ROTATED": None}
+# Log entries that don't take a sequence number: they steer replay rather than change data
+UNSEQUENCED_ENTRIES = frozenset({"SEQ", "SELECT", "SNAPSHOT", "ROTATED"})
+
+
+class LogCorruptionError(Exception):
+    """Raised in strict mode when log entries fail verification during replay"""
+
+    def __init__(self, errors: List[Tuple[int, str]]):
+        self.errors = errors  # (line number, reason) for every bad entry
+        line_no, reason = errors[0]
+        super().__init__(f"{len(errors)} corrupt log entries, first on line {line_no}: {reason}")
+
+
+class ImportFormatError(ValueError):
+    """Raised by import_from when lines of its input can't be parsed; nothing is imported"""
+
+    def __init__(self, errors: List[Tuple[int, str]]):
+        self.errors = errors  # (line number, reason) for every bad line
+        line_no, reason = errors[0]
+        super().__init__(f"{len(errors)} bad lines, first line {line_no}: {reason}")
+
+
+class DatabaseCountError(Exception):
+    """Raised when the log uses a database beyond the configured number of databases"""
+
+
+class OperationCancelled(Exception):
+    """Raised when a long scan is cancelled (or the store closed) partway through"""
+
+
+class CommandError(Exception):
+    """Raised by TypedStore when the command it runs replies with an error"""
+
+
+# Values are binary-safe: bytes that aren't valid UTF-8 are carried in str as lone
+# surrogates (PEP 383) and turned back into the same bytes on the way out
+TEXT_ERRORS = "surrogateescape"
+QUOTE_ESCAPES = {"\\": "\\\\", '"': '\\"', "\n": "\\n", "\r": "\\r", "\t": "\\t"}
+UNQUOTE_ESCAPES = {"n": b"\n", "r": b"\r", "t": b"\t", "b": b"\b", "a": b"\a"}
+
+
+def _needs_escape(text: str) -> bool:
+    """Whether text holds control characters or raw bytes that can't appear in a line as is"""
+    return any(ord(c) < 32 or ord(c) == 127 or "\udc80" <= c <= "\udcff" for c in text)
+
+
+def _quote_arg(arg: str) -> str:
+    """arg as a single protocol token, double-quoted with escapes when it has to be"""
+    if arg and not _needs_escape(arg) and not any(c.isspace() for c in arg) and arg[0] not in "\"'":
+        return arg
+    out = []
+    for c in arg:
+        if c in QUOTE_ESCAPES:
+            out.append(QUOTE_ESCAPES[c])
+        elif "\udc80" <= c <= "\udcff":
+            out.append(f"\\x{ord(c) - 0xdc00:02x}")
+        elif ord(c) < 32 or ord(c) == 127:
+            out.append(f"\\x{ord(c):02x}")
+        else:
+            out.append(c)
+    return '"' + "".join(out) + '"'
+
+
+def _command_line(*tokens: str) -> str:
+    """A command line that split_args turns back into exactly these tokens"""
+    return " ".join(_quote_arg(token) for token in tokens)
+
+
+def split_args(line: str) -> List[str]:
+    """Split a command line into arguments, raising ValueError on unbalanced quotes.
+
+    Tokens are separated by whitespace. A token starting with a double quote
+    runs to the closing quote and understands \\n, \\r, \\t, \\b, \\a, \\xHH
+    and backslash-escaped characters; one starting with a single quote only
+    understands \\'. Quotes inside an unquoted token are literal.
+    """
+    args = []
+    pos, end = 0, len(line)
+    while True:
+        while pos < end and line[pos].isspace():
+            pos += 1
+        if pos == end:
+            return args
+
+        quote = line[pos]
+        if quote not in "\"'":
+            start = pos
+            while pos < end and not line[pos].isspace():
+                pos += 1
+            args.append(line[start:pos])
+            continue
+
+        # Collect bytes so \xHH escapes combine into UTF-8 characters
+        data = bytearray()
+        pos += 1
+        while True:
+            if pos == end:
+                raise ValueError("unbalanced quotes")
+            c = line[pos]
+            if c == quote:
+                pos += 1
+                break
+            if c == "\\" and pos + 1 < end:
+                escaped = line[pos + 1]
+                if quote == "'":
+                    if escaped == "'":
+                        data += b"'"
+                        pos += 2
+                        continue
+                elif escaped == "x" and re.fullmatch(r"[0-9a-fA-F]{2}", line[pos + 2:pos + 4]):
+                    data.append(int(line[pos + 2:pos + 4], 16))
+                    pos += 4
+                    continue
+                elif escaped in UNQUOTE_ESCAPES:
+                    data += UNQUOTE_ESCAPES[escaped]
+                    pos += 2
+                    continue
+                else:
+                    data += escaped.encode("utf-8", TEXT_ERRORS)
+                    pos += 2
+                    continue
+            data += c.encode("utf-8", TEXT_ERRORS)
+            pos += 1
+        if pos < end and not line[pos].isspace():
+            raise ValueError("closing quote must be followed by a space")
+        args.append(data.decode("utf-8", TEXT_ERRORS))
+
+
+def _fsync_directory(path: str):
+    """Fsync a directory, so entries created or renamed in it survive a crash"""
+    fd = os.open(path, os.O_RDONLY)
+    try:
+        os.fsync(fd)
+    finally:
+        os.close(fd)
+
+
+def _log_checksum(entry: str) -> str:
+    return format(zlib.crc32(entry.encode("utf-8")), "08x")
+
+
+def _format_log_entry(entry: str) -> str:
+    """Prefix a log entry with its CRC32 so replay can detect corruption"""
+    return f"{_log_checksum(entry)} {entry}"
+
+
+class LogChecksumError(ValueError):
+    """Raised when a log record's checksum doesn't match its contents"""
+
+
+LogEntry = Tuple[str, ...]  # A logged command and its arguments
+
+
+class TextLogCodec:
+    """Log records as lines: the entry's CRC32 in hex, a space and its command line.
+
+    Arguments are quoted as split_args expects. Lines without a checksum,
+    written before entries carried one, are accepted as they are. Text logs
+    predate codecs, so they have no header.
+
+    Unlike binary records, text records carry no length header: the newline
+    frames them. Quoting escapes any newline in a value, so one only ever ends
+    a record, and a last line without it is exactly what a crash mid-append
+    leaves. The checksum catches a complete line whose bytes are wrong. A
+    length prefix would make logs written before codecs unreadable; use
+    log_format="binary" for length-framed records.
+    """
+
+    name = "text"
+    header = b""
+
+    def encode(self, entry: LogEntry) -> bytes:
+        return (_format_log_entry(_command_line(*entry)) + "\n").encode("utf-8")
+
+    def read_record(self, f) -> bytes:
+        """The next raw record from a binary file, b"" at EOF (possibly incomplete at the end)"""
+        return f.readline()
+
+    def complete(self, raw: bytes) -> bool:
+        return raw.endswith(b"\n")
+
+    def looks_torn(self, raw: bytes) -> bool:
+        """Whether an incomplete record can be what a crash mid-append leaves.
+
+        A text record is incomplete only when no newline follows it, so no
+        complete record can come after one.
+        """
+        return True
+
+    def next_record(self, raw: bytes) -> Optional[int]:
+        return None
+
+    def decode(self, raw: bytes) -> List[str]:
+        """The entry in a raw record, raising ValueError if it's corrupt"""
+        line = raw.decode("utf-8", errors="replace").rstrip("\r\n")
+        checksum, sep, entry = line.partition(" ")
+        if sep and len(checksum) == 8 and all(c in "0123456789abcdef" for c in checksum):
+            if _log_checksum(entry) != checksum:
+                raise LogChecksumError("checksum mismatch")
+            line = entry
+        return split_args(line)
+
+
+class BinaryLogCodec:
+    """Log records as a >II header (payload length, payload CRC32) and a payload.
+
+    The payload is the entry's token count (>I) followed by each token as a
+    length-prefixed string, so values need no quoting and parse without scanning.
+    """
+
+    name = "binary"
+    header = b"\x00KVSLOG1"  # A text log can't start with a NUL byte
+
+    def encode(self, entry: LogEntry) -> bytes:
+        payload = struct.pack(">I", len(entry)) + b"".join(_pack_string(token) for token in entry)
+        return struct.pack(">II", len(payload), zlib.crc32(payload)) + payload
+
+    def read_record(self, f) -> bytes:
+        """The next raw record from a binary file, b"" at EOF (possibly incomplete at the end)"""
+        head = f.read(8)
+        if len(head) < 8:
+            return head
+        (length, _) = struct.unpack(">II", head)
+        return head + f.read(length)
+
+    def complete(self, raw: bytes) -> bool:
+        return len(raw) >= 8 and len(raw) == 8 + struct.unpack_from(">I", raw)[0]
+
+    def looks_torn(self, raw: bytes) -> bool:
+        """Whether an incomplete record can be what a crash mid-append leaves.
+
+        raw runs to the end of the log. A corrupt length makes the record seem to
+        run past the end too, but then its length is implausible or complete,
+        checksummed records still follow its header.
+        """
+        if len(raw) < 8:
+            return True
+        return struct.unpack_from(">I", raw)[0] <= MAX_LOG_RECORD and self.next_record(raw) is None
+
+    def next_record(self, raw: bytes) -> Optional[int]:
+        """Where in raw, past its header, the first complete record with a valid checksum starts"""
+        for pos in range(8, len(raw) - 8):
+            length, checksum = struct.unpack_from(">II", raw, pos)
+            end = pos + 8 + length
+            if length >= 4 and end <= len(raw) and zlib.crc32(raw[pos + 8:end]) == checksum:
+                return pos
+        return None
+
+    def decode(self, raw: bytes) -> List[str]:
+        """The entry in a raw record, raising ValueError if it's corrupt"""
+        if not self.complete(raw):
+            raise ValueError("truncated record")
+        (checksum,) = struct.unpack_from(">I", raw, 4)
+        payload = raw[8:]
+        if zlib.crc32(payload) != checksum:
+            raise LogChecksumError("checksum mismatch")
+        try:
+            (count,) = struct.unpack_from(">I", payload)
+            tokens, pos = [], 4
+            for _ in range(count):
+                token, pos = _unpack_string(payload, pos)
+                tokens.append(token)
+        except struct.error as e:
+            raise ValueError(f"malformed record: {e}") from e
+        return tokens
+
+
+LOG_CODECS = {codec.name: codec for codec in (TextLogCodec(), BinaryLogCodec())}
+
+
+def _detect_log_codec(f, default: TextLogCodec) -> TextLogCodec:
+    """The codec of the log open in f, by its header; default if the log is empty"""
+    start = f.read(len(BinaryLogCodec.header))
+    f.seek(0)
+    if not start:
+        return default
+    if start[:1] != b"\x00":
+        return LOG_CODECS["text"]
+    if start != BinaryLogCodec.header:
+        raise ValueError("unknown log format")
+    return LOG_CODECS["binary"]
+
+
+def _rotated_from(f, codec: TextLogCodec) -> Optional[int]:
+    """The number of the segment the log open in f was rotated from, by its leading
+    ROTATED entry; None if it doesn't start with one"""
+    f.seek(len(codec.header))
+    raw = codec.read_record(f)
+    if not codec.complete(raw):
+        return None
+    try:
+        parts = codec.decode(raw)
+    except ValueError:
+        return None
+    if len(parts) != 3 or parts[0] != "ROTATED" or not parts[1].isdigit():
+        return None
+    return int(parts[1])
+
+
+def _pack_string(value: str) -> bytes:
+    data = value.encode("utf-8", TEXT_ERRORS)
+    return struct.pack(">I", len(data)) + data
+
+
+def _unpack_string(payload: bytes, pos: int) -> Tuple[str, int]:
+    (length,) = struct.unpack_from(">I", payload, pos)
+    pos += 4
+    return payload[pos:pos + length].decode("utf-8", TEXT_ERRORS), pos + length
+
+
+def _encode_value(value: Any) -> bytes:
+    """Serialize a value as a type tag followed by its payload.
+
+    Strings are a single length-prefixed string; lists are an element count
+    followed by that many strings (sets likewise, members sorted), hashes a
+    field count followed by alternating field and value strings, and sorted
+    sets a member count followed by (member, float64 score) pairs. Compressed
+    strings are their compressed bytes, length-prefixed.
+    """
+    if isinstance(value, list):
+        return struct.pack(">BI", SNAPSHOT_LIST, len(value)) + b"".join(_pack_string(item) for item in value)
+    if isinstance(value, frozenset):
+        return struct.pack(">BI", SNAPSHOT_SET, len(value)) + b"".join(_pack_string(m) for m in sorted(value))
+    if isinstance(value, SortedSet):
+        return struct.pack(">BI", SNAPSHOT_ZSET, len(value)) + b"".join(
+            _pack_string(member) + struct.pack(">d", score) for score, member in value.ordered)
+    if isinstance(value, dict):
+        return struct.pack(">BI", SNAPSHOT_HASH, len(value)) + b"".join(
+            _pack_string(field) + _pack_string(field_value) for field, field_value in value.items())
+    if isinstance(value, CompressedString):
+        return struct.pack(">BI", SNAPSHOT_COMPRESSED, len(value.packed)) + value.packed
+    return struct.pack(">B", SNAPSHOT_STRING) + _pack_string(value)
+
+
+def _decode_value(payload: bytes, pos: int) -> Tuple[Any, int]:
+    """Inverse of _encode_value, returning the value and the position after it"""
+    (tag,) = struct.unpack_from(">B", payload, pos)
+    pos += 1
+    if tag == SNAPSHOT_STRING:
+        return _unpack_string(payload, pos)
+
+    (length,) = struct.unpack_from(">I", payload, pos)
+    pos += 4
+    if tag == SNAPSHOT_COMPRESSED:
+        return CompressedString(payload[pos:pos + length]), pos + length
+    if tag in (SNAPSHOT_LIST, SNAPSHOT_SET):
+        items = []
+        for _ in range(length):
+            item, pos = _unpack_string(payload, pos)
+            items.append(item)
+        return (frozenset(items) if tag == SNAPSHOT_SET else items), pos
+    if tag == SNAPSHOT_HASH:
+        fields = {}
+        for _ in range(length):
+            field, pos = _unpack_string(payload, pos)
+            fields[field], pos = _unpack_string(payload, pos)
+        return fields, pos
+    if tag == SNAPSHOT_ZSET:
+        scores = {}
+        for _ in range(length):
+            member, pos = _unpack_string(payload, pos)
+            (scores[member],) = struct.unpack_from(">d", payload, pos)
+            pos += 8
+        return SortedSet(scores), pos
+    raise ValueError(f"unknown value type {tag}")
+
+
+def _encode_snapshot(snapshot_id: int, offset: int, seq: int,
+                     databases: List[List[Tuple[str, Any, Optional[float]]]]) -> bytes:
+    """Serialize databases as: magic, id, log offset, sequence number, database count,
+    then for each database an entry count and its (key, value, ttl) records, and
+    finally a CRC32 of everything before it"""
+    parts = [SNAPSHOT_MAGIC, struct.pack(">QQQI", snapshot_id, offset, seq, len(databases))]
+    for entries in databases:
+        parts.append(struct.pack(">I", len(entries)))
+        for key, value, ttl in entries:
+            parts.append(_pack_string(key))
+            parts.append(_encode_value(value))
+            parts.append(struct.pack(">q", -1 if ttl is None else int(ttl)))
+    body = b"".join(parts)
+    return body + struct.pack(">I", zlib.crc32(body))
+
+
+def _decode_snapshot(payload: bytes) -> Tuple[int, int, int, List[List[Tuple[str, Any, Optional[float]]]]]:
+    """Inverse of _encode_snapshot; raises ValueError or struct.error on malformed input"""
+    if not payload.startswith(SNAPSHOT_MAGIC):
+        raise ValueError("not a snapshot file")
+    payload, (checksum,) = payload[:-4], struct.unpack(">I", payload[-4:])
+    if zlib.crc32(payload) != checksum:
+        raise LogChecksumError("snapshot checksum mismatch")
+    pos = len(SNAPSHOT_MAGIC)
+    snapshot_id, offset, seq, db_count = struct.unpack_from(">QQQI", payload, pos)
+    pos += struct.calcsize(">QQQI")
+
+    databases = []
+    for _ in range(db_count):
+        (count,) = struct.unpack_from(">I", payload, pos)
+        pos += 4
+        entries = []
+        for _ in range(count):
+            key, pos = _unpack_string(payload, pos)
+            value, pos = _decode_value(payload, pos)
+            (ttl,) = struct.unpack_from(">q", payload, pos)
+            pos += 8
+            entries.append((key, value, None if ttl < 0 else ttl))
+        databases.append(entries)
+    return snapshot_id, offset, seq, databases
+
+
+def _encode_dump(value: Any, ttl: Optional[float]) -> str:
+    """DUMP payload: base64 of version, value, absolute expiry in ms (-1 for none) and a CRC32"""
+    body = (struct.pack(">B", DUMP_VERSION) + _encode_value(value)
+            + struct.pack(">q", -1 if ttl is None else int(ttl)))
+    return base64.b64encode(body + struct.pack(">I", zlib.crc32(body))).decode("ascii")
+
+
+def _decode_dump(blob: str) -> Tuple[Any, Optional[float]]:
+    """Inverse of _encode_dump; raises ValueError if the payload is malformed or corrupt"""
+    try:
+        payload = base64.b64decode(blob, validate=True)
+        body, (checksum,) = payload[:-4], struct.unpack(">I", payload[-4:])
+        if zlib.crc32(body) != checksum or body[0] != DUMP_VERSION:
+            raise ValueError("bad checksum or version")
+        value, pos = _decode_value(body, 1)
+        (ttl,) = struct.unpack_from(">q", body, pos)
+    except (binascii.Error, struct.error, IndexError, UnicodeDecodeError) as e:
+        raise ValueError(str(e)) from e
+    return value, None if ttl < 0 else ttl
+
+
+# Escapes in the fields of an import/export line, which are separated by tabs
+FIELD_ESCAPES = {"\\": "\\\\", "\t": "\\t", "\n": "\\n", "\r": "\\r"}
+FIELD_UNESCAPES = {"\\": "\\", "t": "\t", "n": "\n", "r": "\r"}
+
+
+def _escape_field(text: str) -> str:
+    return "".join(FIELD_ESCAPES.get(c, c) for c in text)
+
+
+def _unescape_field(text: str) -> str:
+    """Inverse of _escape_field; a backslash before any other character is kept as is"""
+    if "\\" not in text:
+        return text
+    out, pos = [], 0
+    while pos < len(text):
+        c = text[pos]
+        if c == "\\" and pos + 1 < len(text) and text[pos + 1] in FIELD_UNESCAPES:
+            out.append(FIELD_UNESCAPES[text[pos + 1]])
+            pos += 2
+        else:
+            out.append(c)
+            pos += 1
+    return "".join(out)
+
+
+def _format_export_line(key: str, value: Any, expires_at: Optional[float]) -> str:
+    """An import line (see _parse_import_line) recreating key, without the newline"""
+    expiry = "" if expires_at is None else str(int(expires_at))
+    if not isinstance(value, str):
+        return f"{_escape_field(key)}\t{_encode_dump(value, None)}\t{expiry}\tdump"
+    line = f"{_escape_field(key)}\t{_escape_field(value)}"
+    return f"{line}\t{expiry}" if expiry else line
+
+
+def _json_value(value: Any) -> Any:
+    """A stored value as JSON: a string, a list (a list's items, or a set's members
+    sorted), or an object (a hash's fields, or a sorted set's members to scores)"""
+    if isinstance(value, frozenset):
+        return sorted(value)
+    if isinstance(value, SortedSet):
+        return {member: score for score, member in value.ordered}
+    return value
+
+
+def _parse_import_line(line: str) -> Tuple[str, Any, Optional[float]]:
+    """The (key, value, expires_at) of an import line, raising ValueError if it's malformed.
+
+    A line is tab-separated fields: key, value, then optionally the absolute
+    expiry in ms since the epoch (empty for none) and the word dump, meaning
+    the value is a DUMP payload (how EXPORT writes keys that aren't strings).
+    Tabs, newlines, carriage returns and backslashes in a field are written
+    \\t, \\n, \\r and \\\\.
+    """
+    fields = line.split("\t")
+    if len(fields) < 2:
+        raise ValueError("expected key<TAB>value")
+    if len(fields) > 4 or (len(fields) == 4 and fields[3] != "dump"):
+        raise ValueError("unexpected fields after the expiry")
+    key = _unescape_field(fields[0])
+    if not key:
+        raise ValueError("empty key")
+    expires_at = None
+    if len(fields) > 2 and fields[2]:
+        try:
+            expires_at = int(fields[2])
+        except ValueError:
+            raise ValueError(f"expiry {fields[2][:20]!r} is not an integer") from None
+    if len(fields) == 4:
+        value, _ = _decode_dump(fields[1])  # The line's expiry field governs
+    else:
+        value = _unescape_field(fields[1])
+    return key, value, expires_at
+
+
+DURATION_UNITS = {"ns": 1e-6, "us": 1e-3, "µs": 1e-3, "ms": 1, "s": 1000, "m": 60_000, "h": 3_600_000}
+DURATION_PART = re.compile(r"(\d+(?:\.\d*)?|\.\d+)(ns|us|µs|ms|s|m|h)")
+
+
+def _parse_duration(text: str) -> Optional[float]:
+    """Milliseconds in a Go-style duration such as 90s, 1h30m or 1.5s, or None if it isn't one"""
+    sign = -1 if text.startswith("-") else 1
+    body = text[1:] if text[:1] in ("+", "-") else text
+    if body == "":
+        return None
+    ms, pos = 0.0, 0
+    while pos < len(body):
+        match = DURATION_PART.match(body, pos)
+        if match is None:
+            return None
+        ms += float(match.group(1)) * DURATION_UNITS[match.group(2)]
+        pos = match.end()
+    return sign * ms
+
+
+def _ttl_ms(text: str, unit_ms: int) -> Optional[float]:
+    """A relative TTL in milliseconds: a bare number counts in units of unit_ms, or a duration.
+    None if it's neither, or isn't finite (inf, nan, or too large for a float)."""
+    try:
+        ms = float(text) * unit_ms
+    except ValueError:
+        ms = _parse_duration(text)
+    return ms if ms is not None and math.isfinite(ms) else None
+
+
+def _format_score(score: float) -> str:
+    """Shortest round-tripping form of a score, without a trailing .0 for integers"""
+    text = repr(score)
+    return text[:-2] if text.endswith(".0") else text
+
+
+def _clamp_range(length: int, start: int, stop: int) -> Tuple[int, int]:
+    """Slice bounds for inclusive indexes start..stop, counting negatives from the end"""
+    if start < 0:
+        start = max(length + start, 0)
+    if stop < 0:
+        stop = length + stop
+    if stop < start:
+        return 0, 0
+    return start, stop + 1
+
+
+class SortedSet:
+    """Immutable set of members ordered by score, ties broken by member.
+
+    Changes return a new SortedSet, so stored values can be shared with
+    transaction snapshots like the other container types.
+    """
+
+    __slots__ = ("scores", "ordered")
+
+    def __init__(self, scores: Optional[Dict[str, float]] = None):
+        self.scores = dict(scores or {})  # Member -> score
+        self.ordered = sorted((score, member) for member, score in self.scores.items())
+
+    def added(self, pairs: List[Tuple[str, float]]) -> "SortedSet":
+        result = SortedSet()
+        result.scores = dict(self.scores)
+        result.ordered = list(self.ordered)
+        for member, score in pairs:
+            old = result.scores.get(member)
+            if old is not None:
+                del result.ordered[bisect.bisect_left(result.ordered, (old, member))]
+            result.scores[member] = score
+            bisect.insort(result.ordered, (score, member))
+        return result
+
+    def __len__(self) -> int:
+        return len(self.scores)
+
+    def __eq__(self, other) -> bool:
+        return isinstance(other, SortedSet) and self.scores == other.scores
+
+
+class CompressedString:
+    """A string value held zlib-compressed, to save memory on large compressible values.
+
+    The store compresses strings of at least compress_threshold bytes when that
+    makes them smaller. Commands never see one: _resolve and the other reads of
+    stored values expand it back to the str with _expanded.
+    """
+
+    __slots__ = ("packed",)
+
+    def __init__(self, packed: bytes):
+        self.packed = packed
+
+    @classmethod
+    def compress(cls, value: str, threshold: int) -> Any:
+        """value as a CompressedString if it's at least threshold bytes and compresses smaller, else value"""
+        raw = value.encode("utf-8", TEXT_ERRORS)
+        if len(raw) < threshold:
+            return value
+        packed = zlib.compress(raw)
+        return cls(packed) if len(packed) < len(raw) else value
+
+    def text(self) -> str:
+        return zlib.decompress(self.packed).decode("utf-8", TEXT_ERRORS)
+
+    def __eq__(self, other) -> bool:
+        return isinstance(other, CompressedString) and self.packed == other.packed
+
+
+def _expanded(value: Any) -> Any:
+    """A stored value as commands see it: compressed strings are decompressed"""
+    return value.text() if isinstance(value, CompressedString) else value
+
+
+def _unpack_compressed(token: str) -> CompressedString:
+    """The value of a SETZ or SETEXZ log entry, raising ValueError if it's malformed"""
+    try:
+        value = CompressedString(base64.b64decode(token, validate=True))
+        value.text()
+    except (binascii.Error, zlib.error) as e:
+        raise ValueError(f"bad compressed value: {e}") from e
+    return value
+
+
+def _entry_size(key: str, value: Any, ttl: Optional[float]) -> int:
+    """Approximate bytes held by an entry: its tuple, key, value (with any elements) and TTL.
+
+    This is an estimate from sys.getsizeof and ignores allocator overhead and
+    the list slot in KVStore.data.
+    """
+    size = sys.getsizeof((key, value, ttl)) + sys.getsizeof(key) + sys.getsizeof(value)
+    if isinstance(value, (list, frozenset)):
+        size += sum(sys.getsizeof(item) for item in value)
+    elif isinstance(value, dict):
+        size += sum(sys.getsizeof(field) + sys.getsizeof(item) for field, item in value.items())
+    elif isinstance(value, SortedSet):
+        size += sum(sys.getsizeof(member) + sys.getsizeof(score) for score, member in value.ordered)
+    elif isinstance(value, CompressedString):
+        size += sys.getsizeof(value.packed)
+    if ttl is not None:
+        size += sys.getsizeof(ttl)
+    return size
+
+
+# The stored value's Python type is its type tag; these are the names TYPE reports
+TYPE_NAMES = ((str, "string"), (CompressedString, "string"), (list, "list"), (dict, "hash"),
+              (frozenset, "set"), (SortedSet, "zset"))
+
+
+def _type_name(value: Any) -> str:
+    for kind, name in TYPE_NAMES:
+        if isinstance(value, kind):
+            return name
+    raise TypeError(f"unexpected stored value {type(value).__name__}")
+
+
+def _pushed(items: List[str], elements, left: bool) -> List[str]:
+    """A new list with elements pushed on the left (each becoming the head in turn) or right"""
+    if left:
+        return list(reversed(elements)) + items
+    return items + list(elements)
+
+
+class ManualClock:
+    """A KVStore clock that only moves when told to, so TTLs can be tested without sleeping.
+
+        clock = ManualClock()
+        store = KVStore(clock=clock)
+        store.setex("k", "10", "v")
+        clock.advance(11)
+        store.get("k")  # "nil"
+    """
+
+    def __init__(self, start: Optional[float] = None):
+        self.now = time.time() if start is None else start  # Seconds since the epoch
+
+    def __call__(self) -> float:
+        return self.now
+
+    def advance(self, seconds: float):
+        self.now += seconds
+
+
+class RWLock:
+    """Readers-writer lock allowing many concurrent readers or a single writer.
+
+    The lock is re-entrant: a thread holding the write lock may acquire it again
+    for reading or writing, and readers may nest reads. Upgrading a read lock to
+    a write lock is not supported and raises RuntimeError.
+
+    Writers take precedence: once one is waiting, new readers wait behind it,
+    so a steady stream of overlapping readers can't starve writes.
+    """
+
+    def __init__(self):
+        self._cond = threading.Condition()
+        self._readers = 0
+        self._writers_waiting = 0
+        self._writer = None  # Ident of the thread holding the write lock
+        self._write_depth = 0
+        self._local = threading.local()
+
+    def _read_depth(self) -> int:
+        return getattr(self._local, "depth", 0)
+
+    def acquire_read(self):
+        with self._cond:
+            if self._writer == threading.get_ident():
+                self._write_depth += 1
+                return
+            if self._read_depth() == 0:
+                while self._writer is not None or self._writers_waiting:
+                    self._cond.wait()
+                self._readers += 1
+            self._local.depth = self._read_depth() + 1
+
+    def release_read(self):
+        with self._cond:
+            if self._writer == threading.get_ident():
+                self._write_depth -= 1
+                return
+            self._local.depth = self._read_depth() - 1
+            if self._local.depth == 0:
+                self._readers -= 1
+                if self._readers == 0:
+                    self._cond.notify_all()
+
+    def acquire_write(self):
+        with self._cond:
+            if self._writer == threading.get_ident():
+                self._write_depth += 1
+                return
+            if self._read_depth() > 0:
+                raise RuntimeError("cannot upgrade a read lock to a write lock")
+            self._writers_waiting += 1
+            try:
+                while self._writer is not None or self._readers > 0:
+                    self._cond.wait()
+            finally:
+                self._writers_waiting -= 1
+            self._writer = threading.get_ident()
+            self._write_depth = 1
+
+    def release_write(self):
+        with self._cond:
+            self._write_depth -= 1
+            if self._write_depth == 0:
+                self._writer = None
+                self._cond.notify_all()
+
+    def write_held(self) -> bool:
+        """Whether the calling thread holds the write lock"""
+        return self._writer == threading.get_ident()
+
+    def held(self) -> bool:
+        """Whether the calling thread holds the lock in either mode"""
+        return self.write_held() or self._read_depth() > 0
+
+
+def _reads(method):
+    """Run a KVStore method under the shared read lock"""
+    @functools.wraps(method)
+    def wrapper(self, *args, **kwargs):
+        self._lock.acquire_read()
+        try:
+            return method(self, *args, **kwargs)
+        finally:
+            self._lock.release_read()
+            if not self._lock.held():
+                self._finish_expired()
+    return wrapper
+
+
+def _writes(method):
+    """Run a KVStore method under the exclusive write lock"""
+    @functools.wraps(method)
+    def wrapper(self, *args, **kwargs):
+        self._lock.acquire_write()
+        try:
+            return method(self, *args, **kwargs)
+        finally:
+            self._lock.release_write()
+            if not self._lock.held():
+                self._finish_expired()
+    return wrapper
+
+
+class Session:
+    """Per-client state; each connection runs its own transaction"""
+
+    def __init__(self, authenticated: bool = False):
+        self.transaction_buffer = None  # List of (operation, args) for current transaction, in issue order
+        # Buffer lengths at each nested BEGIN; the writes past a savepoint form its level
+        self.savepoints = []
+        self.watched = {}  # WATCHed (db index, key) -> the key's version when watched
+        # Copy of the store's sorted entries taken at the outermost BEGIN. Entries are
+        # immutable tuples, so this costs one pointer per key rather than a deep copy.
+        self.snapshot = None
+        self.authenticated = authenticated  # Whether AUTH succeeded (only checked with a password set)
+        self.db = 0  # Index of the SELECTed database
+        self.channels = set()  # SUBSCRIBEd channels
+        # Delivers a published (channel, message) to the client; unset, messages queue up here
+        self.push = None
+        self.messages = queue.Queue()
+
+
+class Keyspace:
+    """One logical database: its sorted entries plus per-key metadata"""
 
-class KVStore:
     def __init__(self):
         self.data = []  # List of (key, value, ttl) tuples, maintained in sorted order by key
-        self.transaction_buffer = None  # List of (operation, args) for current transaction
-        self.log_file = "data.db"
+        # Per-key versions for WATCH: the mutation sequence number of each key's last change.
+        # Deleted keys keep an entry only while watched, so a missing key reads as 0.
+        self.versions = {}
+        self.watch_refs = {}  # Key -> number of sessions watching it
+        # Key -> clock time of its last read or write, least recently used first
+        self.last_access = collections.OrderedDict()
+        self.access_counts = {}  # Key -> reads and writes since it was created (or loaded)
+        # Key -> clock time of its last change, value or TTL. Like last_access it isn't
+        # persisted: keys loaded at startup get the time they were loaded.
+        self.modified = {}
+
+
+class KVStore:
+    """Sorted key-value store backed by an append-only log.
+
+    Values are strings, lists (Python lists), hashes (dicts), sets (frozensets)
+    or sorted sets (SortedSet). Stored lists and hashes are never mutated in
+    place: every change builds a new container and replaces the entry, which
+    keeps transaction snapshots valid. A container that becomes empty is
+    deleted.
+
+    The store is safe for concurrent use: reads share an RWLock and mutations
+    take it exclusively. Transactions don't hold the lock between commands;
+    buffered writes are applied under a single write lock acquisition at COMMIT,
+    so other threads observe all of a transaction or none of it. Reads inside a
+    transaction see the transaction's own writes and otherwise the committed
+    state as of the outermost BEGIN (snapshot isolation). The snapshot is a
+    shallow copy of the sorted entry list, so each open transaction costs one
+    pointer per key for its lifetime.
+
+    BEGIN inside a transaction opens a nested level: ABORT discards only that
+    level's writes and COMMIT merges them into the enclosing level. Only the
+    outermost COMMIT applies the writes to the store and log. COMMIT or ABORT
+    with no transaction open returns an error.
+
+    WATCHed keys give optimistic concurrency: if any changed (or expired)
+    between WATCH and the outermost COMMIT, the transaction is discarded and
+    COMMIT returns nil. COMMIT and ABORT both clear the watch set.
+
+    Transaction state lives in a Session bound to the calling thread, so each
+    client connection runs its own transaction against the shared store.
+
+    The store holds several independent databases (Keyspace objects). Each
+    session works in the one it SELECTed, and self.data and the other per-key
+    attributes resolve to it. The log is shared: a SELECT entry switches the
+    database the entries after it apply to.
+
+    A readonly store is a replica of a log another process writes: it never
+    appends to the log, rejects write commands, and tail_log applies entries
+    as they're appended.
+    """
+
+    def __init__(self, requirepass: Optional[str] = None, strict: bool = False,
+                 fsync_policy: str = "always", slowlog_threshold_us: int = 10000,
+                 slowlog_max_len: int = 128, maxmemory: int = 0, maxkeys: int = 0,
+                 maxkeys_policy: str = "noeviction", track_frequency: bool = False,
+                 databases: int = 16, readonly: bool = False, log_format: str = "text",
+                 log_rotate_size: int = 0, log_keep: int = 3, notify_keyspace_events: bool = False,
+                 strict_arity: bool = True, sync_directory: Optional[Callable[[str], None]] = None,
+                 nocase_keys: bool = False, clock: Optional[Callable[[], float]] = None,
+                 path: str = "data.db", compress_threshold: int = 0,
+                 transfer_dir: Optional[str] = None):
+        if fsync_policy not in FSYNC_POLICIES:
+            raise ValueError(f"unknown fsync policy {fsync_policy!r}")
+        if maxkeys_policy not in MAXKEYS_POLICIES:
+            raise ValueError(f"unknown maxkeys policy {maxkeys_policy!r}")
+
+        if log_format not in LOG_CODECS:
+            raise ValueError(f"unknown log format {log_format!r}")
+        if databases < 1:
+            raise ValueError("at least one database is required")
+
+        self.databases = [Keyspace() for _ in range(databases)]
+        self.log_file = path  # Segments, the snapshot and temporary files live beside it
+        self.snapshot_file = self.log_file + ".snap"
+        # New logs (and COMPACT rewrites) use log_format; an existing log keeps the format it has
+        self.log_format = log_format
+        self._log_codec = LOG_CODECS[log_format]
+        # Past log_rotate_size bytes (0 disables) the log is rolled to a numbered segment and
+        # compacted; the newest log_keep segments are kept for backup
+        self.log_rotate_size = log_rotate_size
+        self.log_keep = log_keep
+        self._log_base_size = 0  # Size of the log when it was last rewritten by compaction
+        self.strict = strict  # Abort startup on corrupt log entries instead of skipping them
+        self.readonly = readonly  # Replica of another process's log: never writes it, rejects writes
+        # Reject extra arguments to fixed-arity commands; off, they're dropped as older versions did
+        self.strict_arity = strict_arity
+        # Lowercase every key commands name, so keys differing only in case are one key.
+        # Keys are stored and logged folded; switching this on an existing dataset leaves
+        # any mixed-case keys in it unreachable.
+        self.nocase_keys = nocase_keys
+        # Seconds since the epoch, like time.time (the default), read for every TTL decision.
+        # Expiries are stored and logged as absolute wall-clock times so they survive a
+        # restart; the flip side is that stepping the system clock expires keys early or
+        # late. Tests can pass a clock they advance by hand.
+        self.clock = clock or time.time
+        # Strings of at least this many bytes (0 disables) are kept and logged compressed
+        # when that saves space; see CompressedString
+        self.compress_threshold = compress_threshold
+        # The one directory IMPORT and EXPORT may read and write files in, by bare file
+        # name; None disables both commands (import_from and export_to work regardless)
+        self.transfer_dir = transfer_dir
+        self._log_offset = 0  # Bytes of the log replay has consumed; a replica tails from here
+        self._log_line_no = 0  # Records of the log replay has consumed, for replay_errors
+        self._log_inode = None  # Identity of the replayed log file, to notice it being rewritten
+        self._replay_session = Session(authenticated=True)  # Follows the log's SELECTs across replay and tail polls
+        self.checksum_failures = 0  # Log entries skipped during replay for a bad checksum
+        self.replay_errors = []  # (line number, reason) for each log entry replay couldn't apply
+        self.torn_tail_bytes = 0  # Size of an incomplete final record cut from the log on startup
+        self.torn_tail_file = None  # Where the bytes cut from the log were saved
+        # How startup used the snapshot: "loaded", "none" (no file), "stale" (the log was
+        # rewritten since) or "corrupt (<reason>)"; all but "loaded" replay the whole log
+        self.snapshot_status = "none"
+        self.fsync_policy = fsync_policy  # One of FSYNC_POLICIES
+        # Fsyncs a directory, after the log is created or renamed; swappable so tests can observe it
+        self._sync_directory = sync_directory or _fsync_directory
+        self._log = None  # Append handle for the log, opened on first write
+        self._log_dirty = False  # Whether the log has writes that haven't been fsynced
+        self._log_syncs = 0  # Times the log's pending writes reached the disk, for WAIT
+        self._log_synced = threading.Condition()  # Notified as _log_syncs advances
+        self._closed = threading.Event()  # Stops background threads on close
+        self._mutation_seq = 0  # Source of the per-key versions used by WATCH
+        self._log_db = 0  # Database the log's last entry applies to; None forces a SELECT
+        # Every logged operation gets the next sequence number. The log stores them
+        # implicitly: a SEQ entry numbers the entry after it, and each later one
+        # counts up from there. Replay skips entries numbered at or below _seq, so
+        # replaying a log again (or one overlapping it) doesn't apply anything twice.
+        self._seq = 0  # Sequence number of the last operation applied or logged
+        self._log_seq = None  # Number the log's next entry would implicitly get; None forces a SEQ
+        self._replay_seq = None  # Number of the next entry replay reads; None before any SEQ
+        self._replayed_segment = None  # Number of the segment replay just finished, if any
+        self.start_time = self.clock()
+        self.commands_processed = 0
+        self.command_counts = {}  # Uppercased command name -> calls
+        self.unknown_commands = 0  # Calls to commands that don't exist
+        self.expired_keys = 0  # Keys removed because their TTL passed
+        self.evicted_keys = 0  # Keys removed to stay under maxmemory or maxkeys
+        self.maxmemory = maxmemory  # Budget in bytes for used_memory; 0 means unlimited
+        self.used_memory = 0  # Sum of _entry_size over every stored entry
+        self.maxkeys = maxkeys  # Cap on stored keys; 0 means unlimited
+        self.maxkeys_policy = maxkeys_policy  # One of MAXKEYS_POLICIES
+        self.track_frequency = track_frequency  # Count accesses per key for OBJECT FREQ
+        self._stats_lock = threading.Lock()  # Guards the counters without taking the store lock
+        # Guards last_access and access_counts, which readers update holding only the shared lock
+        self._access_lock = threading.Lock()
+        self._subscribers = {}  # Channel -> sessions subscribed to it
+        # Publish each logged change to __keyspace__:<key> and __keyevent__:<event>
+        self.notify_keyspace_events = notify_keyspace_events
+        self._pending_events = []  # (event, key) logged but not yet published
+        self._pubsub_lock = threading.Lock()  # Guards _subscribers; pub/sub never takes the store lock
+        # Commands slower than the threshold (microseconds; negative disables) land in a bounded ring
+        self.slowlog_threshold_us = slowlog_threshold_us
+        self.slowlog = collections.deque(maxlen=slowlog_max_len)
+        self._slowlog_next_id = 0
+        self.expire_callbacks = []  # Callables invoked with the key name when a key expires
+        self._pending_expired = []  # Expired keys whose callbacks haven't run yet
+        self._lock = RWLock()  # Guards data, the log and transaction state
+        # Wakes blocked BLPOP/BRPOP callers; _list_writes counts list writes so a waiter can
+        # tell whether one happened since it last looked
+        self._list_ready = threading.Condition()
+        self._list_writes = 0
+        self._local = threading.local()  # Per-thread session and keys found expired under the read lock
+        self._default_session = Session(authenticated=True)  # Used by threads without a bound session (stdin, embedding)
+        # Only a digest of the password is kept; None disables authentication
+        self._password_digest = hashlib.sha256(requirepass.encode()).digest() if requirepass else None
         
         # Replay log on startup
+        self._recover_rotation()
         self._replay_log()
+
+        if fsync_policy == "everysec":
+            threading.Thread(target=self._run_fsync, name="kvs-fsync", daemon=True).start()
     
+    def execute(self, line: str) -> Optional[List[str]]:
+        """Run one protocol line as a client would, returning its response lines or None for EXIT"""
+        return process_command(self, line)
+
+    def _now_ms(self) -> float:
+        """The clock's current time in milliseconds since the epoch, the unit TTLs are stored in"""
+        return self.clock() * 1000
+
+    @property
+    def session(self) -> Session:
+        """The session bound to the calling thread"""
+        return getattr(self._local, "session", None) or self._default_session
+
+    def bind_session(self, session: Optional[Session]):
+        """Bind a session to the calling thread; None restores the default session"""
+        self._local.session = session
+
+    @property
+    def transaction_buffer(self) -> Optional[List[Tuple[str, tuple]]]:
+        return self.session.transaction_buffer
+
+    @transaction_buffer.setter
+    def transaction_buffer(self, buffer: Optional[List[Tuple[str, tuple]]]):
+        self.session.transaction_buffer = buffer
+
+    @property
+    def keyspace(self) -> Keyspace:
+        """The database the calling thread's session has SELECTed"""
+        return self.databases[self.session.db]
+
+    @property
+    def data(self) -> List[Tuple[str, Any, Optional[float]]]:
+        return self.keyspace.data
+
+    @data.setter
+    def data(self, entries: List[Tuple[str, Any, Optional[float]]]):
+        self.keyspace.data = entries
+
+    @property
+    def versions(self) -> Dict[str, int]:
+        return self.keyspace.versions
+
+    @property
+    def last_access(self) -> "collections.OrderedDict[str, float]":
+        return self.keyspace.last_access
+
+    @property
+    def access_counts(self) -> Dict[str, int]:
+        return self.keyspace.access_counts
+
+    @property
+    def modified(self) -> Dict[str, float]:
+        return self.keyspace.modified
+
+    @contextlib.contextmanager
+    def _using_db(self, index: int):
+        """Temporarily point the calling thread's session at another database"""
+        session = self.session
+        previous, session.db = session.db, index
+        try:
+            yield
+        finally:
+            session.db = previous
+
+    @_writes
+    def select(self, index: str) -> str:
+        try:
+            db = int(index)
+        except ValueError:
+            return ErrorReply("ERR value is not an integer")
+        if not 0 <= db < len(self.databases):
+            return ErrorReply("ERR DB index is out of range")
+        if self.transaction_buffer is not None:
+            return ErrorReply("ERR SELECT inside a transaction is not allowed")
+        self.session.db = db
+        return "OK"
+
+    def _swap_databases(self, first: int, second: int):
+        """Exchange two databases' contents; WATCH bookkeeping stays with the index"""
+        a, b = self.databases[first], self.databases[second]
+        self.databases[first], self.databases[second] = b, a
+        a.watch_refs, b.watch_refs = b.watch_refs, a.watch_refs
+        # Watched keys in either database may now hold different values
+        for db in (first, second):
+            with self._using_db(db):
+                for key in self.keyspace.watch_refs:
+                    self._touch(key)
+
+    @_writes
+    def swapdb(self, first: str, second: str) -> str:
+        try:
+            a, b = int(first), int(second)
+        except ValueError:
+            return ErrorReply("ERR value is not an integer")
+        if not (0 <= a < len(self.databases) and 0 <= b < len(self.databases)):
+            return ErrorReply("ERR DB index is out of range")
+        if self.transaction_buffer is not None:
+            return ErrorReply("ERR SWAPDB inside a transaction is not allowed")
+
+        if a != b:
+            self._swap_databases(a, b)
+            # Refers to databases by index, so it needs no SELECT
+            self._append_log([("SWAPDB", str(a), str(b))], select=False)
+        return "OK"
+
+    def _move_key(self, index: int, db: int):
+        """Move the entry at index, TTL included, from the current database into db"""
+        entry = self.data.pop(index)
+        self._forget(entry)
+        self._touch(entry[0], deleted=True)
+        with self._using_db(db):
+            self._set_key(*entry)
+
+    @_writes
+    def move(self, key: str, db: str) -> str:
+        try:
+            dest = int(db)
+        except ValueError:
+            return ErrorReply("ERR value is not an integer")
+        if not 0 <= dest < len(self.databases):
+            return ErrorReply("ERR DB index is out of range")
+        if dest == self.session.db:
+            return ErrorReply("ERR source and destination objects are the same")
+        if self.transaction_buffer is not None:
+            return ErrorReply("ERR MOVE inside a transaction is not allowed")
+
+        index = self._get_key_index(key)
+        if index == -1:
+            return "0"
+        with self._using_db(dest):
+            if self._get_key_index(key) != -1:
+                return "0"
+        # Replay needs the source database, which the SELECT in front of the entry gives it
+        self._move_key(self._find_key_index(key), dest)
+        self._append_log([("MOVE", key, str(dest))])
+        return "1"
+
+    def subscribe(self, *channels) -> List[str]:
+        """Subscribe the session to channels, one reply line per channel with its subscription count"""
+        session = self.session
+        replies = []
+        with self._pubsub_lock:
+            for channel in channels:
+                self._subscribers.setdefault(channel, set()).add(session)
+                session.channels.add(channel)
+                replies.append(_command_line("subscribe", channel, str(len(session.channels))))
+        return replies
+
+    def unsubscribe(self, *channels) -> List[str]:
+        """Unsubscribe the session from channels, or from all of them if none are given"""
+        session = self.session
+        replies = []
+        with self._pubsub_lock:
+            for channel in channels or sorted(session.channels):
+                subscribers = self._subscribers.get(channel, set())
+                subscribers.discard(session)
+                if not subscribers:
+                    self._subscribers.pop(channel, None)
+                session.channels.discard(channel)
+                replies.append(_command_line("unsubscribe", channel, str(len(session.channels))))
+        # Like Redis, answer even when there was nothing to unsubscribe from
+        return replies or [_command_line("unsubscribe", "", "0")]
+
+    def publish(self, channel: str, message: str) -> str:
+        """Send a message to every session subscribed to channel, returning how many there were.
+
+        Messages aren't logged or kept; a session that isn't subscribed when it's
+        published never sees it.
+        """
+        with self._pubsub_lock:
+            subscribers = list(self._subscribers.get(channel, ()))
+        # Deliver outside the lock so a slow client can't hold up other publishers
+        for session in subscribers:
+            if session.push is not None:
+                session.push(channel, message)
+            else:
+                session.messages.put((channel, message))
+        return str(len(subscribers))
+
+    def is_authenticated(self) -> bool:
+        """Whether the calling thread's session may run commands"""
+        return self._password_digest is None or self.session.authenticated
+
+    def check_password(self, password: str) -> bool:
+        """Whether password matches requirepass, without authenticating any session"""
+        if self._password_digest is None:
+            return True
+        digest = hashlib.sha256(password.encode()).digest()
+        return hmac.compare_digest(digest, self._password_digest)
+
+    def auth(self, password: str) -> str:
+        if self._password_digest is None:
+            return ErrorReply("ERR AUTH called without any password configured")
+
+        if not self.check_password(password):
+            return ErrorReply("ERR invalid password")
+        self.session.authenticated = True
+        return "OK"
+
     def _find_key_index(self, key: str) -> int:
         """Binary search to find the index of a key, returns -1 if not found"""
-        keys = [item[0] for item in self.data]
-        lo, hi = 0, len(keys) - 1
-        
-        while lo <= hi:
-            mid = (lo + hi) // 2
-            if keys[mid] == key:
-                return mid
-            elif keys[mid] < key:
-                lo = mid + 1
-            else:
-                hi = mid - 1
+        index = bisect.bisect_left(self.data, key, key=lambda item: item[0])
+        if index < len(self.data) and self.data[index][0] == key:
+            return index
         return -1
     
     def _is_expired(self, index: int) -> bool:
@@ -34,136 +1269,1286 @@ class KVStore:
             return True
         
         _, _, ttl = self.data[index]
-        if ttl is not None and time.time() * 1000 > ttl:
-            # Remove expired key
-            self.data.pop(index)
+        if ttl is not None and self._now_ms() > ttl:
+            self._remove_expired(index)
             return True
         return False
-    
-    def _get_key_index(self, key: str, check_expired: bool = True) -> int:
-        """Get index of key, handling expiration"""
-        index = self._find_key_index(key)
+
+    def _remove_expired(self, index: int):
+        """Remove an expired key, log its DEL and queue its expiry notification.
+
+        The removal and its DEL entry happen together under the write lock, so
+        no reader sees one without the other. A key is gone to every reader as
+        soon as its TTL passes, whether or not it has been removed yet: replay
+        drops it too, since TTLs are logged as absolute times.
+        """
+        if not self._lock.write_held():
+            # Readers can't mutate the store; the key is removed once the read lock is released
+            if not hasattr(self._local, "expired"):
+                self._local.expired = []
+            self._local.expired.append((self.session.db, self.data[index][0]))
+            return
+
+        entry = self.data.pop(index)
+        key = entry[0]
+        self._forget(entry)
+        self._touch(key, deleted=True)
+        self._write_to_log(("DEL", key), event="expired")
+        with self._stats_lock:
+            self.expired_keys += 1
+        self._pending_expired.append(key)
+
+    def _finish_expired(self):
+        """Remove keys readers found expired, then run expiry callbacks and publish
+        keyspace events outside the lock"""
+        expired = getattr(self._local, "expired", None)
+        if not expired and not self._pending_expired and not self._pending_events:
+            return
+
+        self._lock.acquire_write()
+        try:
+            if expired:
+                self._local.expired = []
+                for db, key in expired:
+                    # The key was found expired in db, which isn't necessarily the session's now
+                    with self._using_db(db):
+                        index = self._find_key_index(key)
+                        if index != -1:
+                            ttl = self.data[index][2]
+                            if ttl is not None and self._now_ms() > ttl:
+                                self._remove_expired(index)
+            pending, self._pending_expired = self._pending_expired, []
+            events, self._pending_events = self._pending_events, []
+        finally:
+            self._lock.release_write()
+
+        for key in pending:
+            for callback in self.expire_callbacks:
+                callback(key)
+        for event, key in events:
+            self.publish(f"__keyspace__:{key}", event)
+            self.publish(f"__keyevent__:{event}", key)
+
+    @_writes
+    def on_expire(self, callback: Callable[[str], None]):
+        """Register a callback invoked with the key name whenever a key expires.
+
+        Callbacks run after the DEL is logged and outside the store lock, so they
+        may safely call back into the store.
+        """
+        self.expire_callbacks.append(callback)
+
+    def start_sweeper(self, interval: float = SWEEP_INTERVAL) -> threading.Thread:
+        """Start a daemon thread that actively removes expired keys every interval seconds"""
+        def run():
+            self.bind_session(Session())  # Sweeping switches databases; keep that off shared sessions
+            while not self._closed.wait(interval):
+                self.sweep_expired()
+
+        sweeper = threading.Thread(target=run, name="kvs-sweeper", daemon=True)
+        sweeper.start()
+        return sweeper
+
+    @_writes
+    def sweep_expired(self) -> int:
+        """Actively remove every expired key in every database, returning how many were removed"""
+        now = self._now_ms()
+        removed = 0
+        for db in range(len(self.databases)):
+            with self._using_db(db):
+                index = 0
+                while index < len(self.data):
+                    ttl = self.data[index][2]
+                    if ttl is not None and now > ttl:
+                        self._remove_expired(index)
+                        removed += 1
+                    else:
+                        index += 1
+        return removed
+    
+    def _get_key_index(self, key: str, check_expired: bool = True) -> int:
+        """Get index of key, handling expiration"""
+        index = self._find_key_index(key)
         if index == -1:
             return -1
         
         if check_expired and self._is_expired(index):
             return -1
+        self._record_access(key)
         return index
-    
-    def _set_key(self, key: str, value: str, ttl: Optional[float] = None) -> bool:
-        """Internal method to set a key-value pair"""
+
+    def _snapshot_entry(self, key: str) -> Optional[Tuple[Any, Optional[float]]]:
+        """Look up the (value, ttl) a key had when the session's transaction began"""
+        snapshot = self.session.snapshot
+        index = bisect.bisect_left(snapshot, key, key=lambda item: item[0])
+        if index == len(snapshot) or snapshot[index][0] != key:
+            return None
+
+        _, value, ttl = snapshot[index]
+        if ttl is not None and self._now_ms() > ttl:
+            return None
+        return (_expanded(value), ttl)
+
+    def _resolve(self, key: str) -> Optional[Tuple[Any, Optional[float]]]:
+        """Resolve the (value, ttl) a key currently has, including buffered transaction writes.
+
+        Inside a transaction, keys the transaction hasn't written read from the
+        snapshot taken at BEGIN (snapshot isolation).
+        """
+        if self.transaction_buffer is None:
+            index = self._get_key_index(key)
+            return None if index == -1 else (_expanded(self.data[index][1]), self.data[index][2])
+
+        entry = self._snapshot_entry(key)
+        for op, args in self.transaction_buffer:
+            if args[0] != key:
+                continue
+            if op == "SET":
+                _, value, ttl, keep_ttl = args
+                if ttl is None and keep_ttl and entry is not None:
+                    ttl = entry[1]
+                entry = (value, ttl)
+            elif op == "DEL":
+                entry = None
+            elif op == "EXPIRE" and entry is not None:
+                entry = (entry[0], args[1])
+            elif op == "PERSIST" and entry is not None:
+                entry = (entry[0], None)
+        return entry
+
+    def _values_equal(self, a: Any, b: Any) -> bool:
+        """Structural comparison: lists are order-sensitive, sets are order-insensitive"""
+        if type(a) is not type(b):
+            return False
+        return a == b
+
+    def _touch(self, key: str, deleted: bool = False):
+        """Bump a key's version after it changes"""
+        self._mutation_seq += 1
+        if deleted and key not in self.keyspace.watch_refs:
+            self.versions.pop(key, None)
+        else:
+            self.versions[key] = self._mutation_seq
+
+    def _record_access(self, key: str):
+        """Mark a key as the most recently used"""
+        now = self.clock()
+        with self._access_lock:
+            self.last_access[key] = now
+            self.last_access.move_to_end(key)
+            if self.track_frequency:
+                self.access_counts[key] = self.access_counts.get(key, 0) + 1
+
+    def _forget(self, entry: Tuple[str, Any, Optional[float]]):
+        """Drop the memory accounting and access time of a removed entry"""
+        self.used_memory -= _entry_size(*entry)
+        self.last_access.pop(entry[0], None)
+        self.access_counts.pop(entry[0], None)
+        self.modified.pop(entry[0], None)
+
+    def _set_ttl(self, index: int, ttl: Optional[float]):
+        """Replace the ttl of the entry at index"""
+        key, value, old_ttl = self.data[index]
+        self.data[index] = (key, value, ttl)
+        self.used_memory += _entry_size(key, value, ttl) - _entry_size(key, value, old_ttl)
+        self.modified[key] = self.clock()
+        self._touch(key)
+
+    def _set_key(self, key: str, value: str, ttl: Optional[float] = None, keep_ttl: bool = True) -> bool:
+        """Internal method to set a key-value pair; without a ttl, an existing key
+        keeps its TTL if keep_ttl is set and loses it otherwise"""
+        if self.compress_threshold and isinstance(value, str):
+            value = CompressedString.compress(value, self.compress_threshold)
         index = self._find_key_index(key)
         
         if index != -1:
             # Update existing key
             current_ttl = self.data[index][2]
-            new_ttl = ttl if ttl is not None else current_ttl
+            new_ttl = current_ttl if ttl is None and keep_ttl else ttl
+            self.used_memory -= _entry_size(*self.data[index])
             self.data[index] = (key, value, new_ttl)
+            self.used_memory += _entry_size(key, value, new_ttl)
         else:
             # Insert new key in sorted position
             new_item = (key, value, ttl)
-            keys = [item[0] for item in self.data]
-            insert_pos = bisect.bisect_left(keys, key)
+            insert_pos = bisect.bisect_left(self.data, key, key=lambda item: item[0])
             self.data.insert(insert_pos, new_item)
+            self.used_memory += _entry_size(*new_item)
         
+        self.modified[key] = self.clock()
+        self._touch(key)
+        self._record_access(key)
+        if isinstance(value, list):
+            with self._list_ready:
+                self._list_writes += 1
+                self._list_ready.notify_all()
         return True
     
     def _delete_key(self, key: str) -> bool:
         """Internal method to delete a key"""
         index = self._find_key_index(key)
         if index != -1:
-            self.data.pop(index)
+            self._forget(self.data.pop(index))
+            self._touch(key, deleted=True)
             return True
         return False
     
+    def _entry_log_commands(self, key: str, value: Any, ttl: Optional[float]) -> List[LogEntry]:
+        """Log entries that recreate a key that doesn't exist yet with value and ttl"""
+        if isinstance(value, list):
+            commands = [("RPUSH", key, *value)]
+        elif isinstance(value, frozenset):
+            commands = [("SADD", key, *sorted(value))]
+        elif isinstance(value, SortedSet):
+            pairs = [token for score, member in value.ordered for token in (_format_score(score), member)]
+            commands = [("ZADD", key, *pairs)]
+        elif isinstance(value, dict):
+            commands = [("HSET", key, *(token for pair in value.items() for token in pair))]
+        else:
+            commands = [("SET", key, value)]
+        if ttl is not None:
+            commands.append(("PEXPIREAT", key, str(int(ttl))))
+        return commands
+
+    def _write_value(self, key: str, value: Any, log_command: LogEntry):
+        """Store a new value for a key written by a container command, deleting the key if it's empty.
+
+        Outside a transaction the change is applied and log_command, which replays
+        it, is logged. Inside one the whole new value is buffered instead.
+        log_command is checked first, so one the log can't encode leaves the store
+        unchanged rather than changed but unlogged.
+        """
+        if not all(isinstance(token, str) for token in log_command):
+            raise TypeError(f"{log_command[0]} log entry has a token that isn't a string")
+        if self.transaction_buffer is not None:
+            if value:
+                self.transaction_buffer.append(("SET", (key, value, None, True)))
+            else:
+                self.transaction_buffer.append(("DEL", (key,)))
+            return
+
+        if value:
+            self._set_key(key, value, None)
+        else:
+            self._delete_key(key)
+        self._write_to_log(log_command)
+
+    def _replay_value(self, key: str, kind: type) -> Any:
+        """The stored value a replayed container entry applies to, raising ValueError on a type mismatch"""
+        index = self._find_key_index(key)
+        if index == -1:
+            return kind()
+        value = self.data[index][1]
+        if not isinstance(value, kind):
+            raise ValueError(f"entry for {key} doesn't match its type")
+        return value
+
     def _replay_log(self):
-        """Replay the log file to rebuild state"""
+        """Rebuild state from the snapshot (if it matches the log) and the log entries after it"""
+        # Replay follows the log's SELECTs in a session of its own, which tail_log continues
+        previous = getattr(self._local, "session", None)
+        self.bind_session(self._replay_session)
+        self._log_offset = self._log_line_no = 0
+        self._replay_seq = None
         try:
-            with open(self.log_file, 'r') as f:
-                for line in f:
-                    line = line.strip()
-                    if not line:
-                        continue
-                    
-                    parts = line.split()
-                    if len(parts) < 2:
-                        continue
-                    
-                    cmd = parts[0]
-                    if cmd == "SET" and len(parts) >= 3:
-                        key, value = parts[1], " ".join(parts[2:])
-                        self._set_key(key, value, None)
-                    elif cmd == "DEL" and len(parts) >= 2:
-                        self._delete_key(parts[1])
-                    elif cmd == "EXPIRE" and len(parts) >= 3:
-                        key, ms = parts[1], parts[2]
-                        index = self._find_key_index(key)
-                        if index != -1:
-                            ttl = time.time() * 1000 + float(ms)
-                            key, value, _ = self.data[index]
-                            self.data[index] = (key, value, ttl)
+            with open(self.log_file, 'rb') as f:
+                self._log_codec = _detect_log_codec(f, LOG_CODECS[self.log_format])
+                self._log_inode = os.fstat(f.fileno()).st_ino
+                start = self._load_snapshot()
+                if not start:
+                    self._replay_segments(f)
+                # Count the records the snapshot covers so errors name the right record
+                self._log_offset = len(self._log_codec.header)
+                f.seek(self._log_offset)
+                while self._log_offset < start:
+                    self._log_offset += len(self._log_codec.read_record(f))
+                    self._log_line_no += 1
+                self._replay_records(f)
         except FileNotFoundError:
             pass  # First run, no log file
+        finally:
+            self.bind_session(previous)
+            self._replayed_segment = None
+        self._log_seq = self._replay_seq
+
+        if self.replay_errors and self.strict:
+            raise LogCorruptionError(self.replay_errors)
+
+    def _replay_segments(self, log):
+        """Replay the rotated segments that the log open in log continues, oldest first.
+
+        Rotation starts the fresh log with a ROTATED entry naming the segment the
+        old log went to, and a segment that was itself rotated in starts with one
+        too. Following them back gives the chain of segments leading up to the
+        log; it starts after any that were pruned. Each file restates the one
+        before it in its compacted entries, which are skipped, so only what it
+        added is applied on top.
+
+        A segment that doesn't replay cleanly abandons the chain, and the log is
+        replayed on its own.
+        """
+        codec = self._log_codec
+        segments = dict(self._log_segments())
+        chain = []
+        number = _rotated_from(log, codec)
+        while number in segments and number not in chain:
+            chain.insert(0, number)
+            with open(segments[number], 'rb') as f:
+                number = _rotated_from(f, _detect_log_codec(f, codec))
+        try:
+            for number in chain:
+                with open(segments[number], 'rb') as f:
+                    self._log_codec = _detect_log_codec(f, codec)
+                    f.seek(len(self._log_codec.header))
+                    self._replay_session.db = 0
+                    self._replay_seq = None
+                    for raw in iter(lambda: self._log_codec.read_record(f), b""):
+                        if not self._log_codec.complete(raw):
+                            raise ValueError(f"incomplete record in {segments[number]}")
+                        self._apply_log_entry(self._log_codec.decode(raw))
+                self._replayed_segment = number
+        except (ValueError, OSError):
+            self.databases = [Keyspace() for _ in self.databases]
+            self.used_memory = 0
+            self._seq = 0
+            self._replayed_segment = None
+        self._log_codec = codec
+        self._replay_session.db = 0
+        self._replay_seq = None
+
+    def _replay_records(self, f) -> int:
+        """Apply the records from f's position to the end, returning how many were read.
+
+        Each record is framed (a length header, or a text line's newline), so an
+        incomplete final record is recognized rather than applied. It's what a
+        crash mid-append leaves, and the log is truncated back to the last
+        complete record. A replica leaves it alone instead: the primary is still
+        writing it, and tail_log picks it up once it's complete.
+
+        An incomplete record that can't be a torn append (a corrupt length
+        header) is a replay error: strict mode refuses to start and leaves the
+        log alone, otherwise replay skips to the next valid record after it. A
+        cut is only made at the end of the log, and the bytes cut are saved
+        beside it first.
+        """
+        count = 0
+        while True:
+            raw = self._log_codec.read_record(f)
+            if not raw:
+                return count
+            if not self._log_codec.complete(raw):
+                if self.readonly:
+                    return count
+                raw += f.read()  # Everything truncating would cut
+                if self._log_codec.looks_torn(raw):
+                    self.torn_tail_bytes = len(raw)
+                    self._cut_log(self._log_offset, raw)
+                    return count
+                self._log_line_no += 1
+                self.replay_errors.append((self._log_line_no, f"corrupt record length at byte {self._log_offset}"))
+                resume = self._log_codec.next_record(raw)
+                if self.strict:
+                    return count
+                if resume is None:
+                    self._cut_log(self._log_offset, raw)  # Nothing but garbage to the end
+                    return count
+                self._log_offset += resume
+                f.seek(self._log_offset)
+                continue
+            self._replay_raw(raw)
+            count += 1
+
+    def _cut_log(self, size: int, tail: bytes):
+        """Truncate the log to size bytes, first saving the tail it held past them"""
+        path = f"{self.log_file}.cut.{size}"
+        with open(path, 'wb') as f:
+            f.write(tail)
+            f.flush()
+            os.fsync(f.fileno())
+        self._fsync_dir(path)
+        self.torn_tail_file = path
+        self._truncate_log(size)
+
+    def _truncate_log(self, size: int):
+        """Cut the log back to size bytes, durably"""
+        with open(self.log_file, 'r+b') as f:
+            f.truncate(size)
+            f.flush()
+            os.fsync(f.fileno())
+
+    def _replay_raw(self, raw: bytes):
+        """Apply one raw log record, recording it in replay_errors if it can't be applied"""
+        self._log_line_no += 1
+        self._log_offset += len(raw)
+        try:
+            self._apply_log_entry(self._log_codec.decode(raw))
+        except LogChecksumError as e:
+            self.checksum_failures += 1
+            self.replay_errors.append((self._log_line_no, str(e)))
+        except ValueError as e:
+            # Lenient replay skips bad entries but remembers where they were
+            self.replay_errors.append((self._log_line_no, str(e)))
+
+    def start_tailing(self, interval: float = TAIL_INTERVAL) -> threading.Thread:
+        """Start a daemon thread that keeps a read-only store in sync with the log"""
+        thread = threading.Thread(target=self.tail_log, args=(self._closed, interval),
+                                  name="kvs-tail", daemon=True)
+        thread.start()
+        return thread
+
+    def tail_log(self, stop: threading.Event, interval: float = TAIL_INTERVAL):
+        """Apply entries appended to the log by another process until stop is set"""
+        while not stop.is_set():
+            self.poll_log()
+            stop.wait(interval)
+
+    @_writes
+    def poll_log(self) -> int:
+        """Apply complete log entries written since the last poll, returning how many were applied.
+
+        A log that was replaced (COMPACT) or truncated is replayed from scratch.
+        Entries follow the log's SELECTs in the replay session, so the caller's
+        session keeps its database.
+        """
+        previous = getattr(self._local, "session", None)
+        self.bind_session(self._replay_session)
+        try:
+            try:
+                f = open(self.log_file, 'rb')
+            except FileNotFoundError:
+                return 0
+            with f:
+                stat = os.fstat(f.fileno())
+                if stat.st_ino != self._log_inode or stat.st_size < self._log_offset:
+                    self._reload()
+                    return 0
+                if self._log_offset == 0:
+                    # The log was empty at startup; its header says which codec it uses
+                    self._log_codec = _detect_log_codec(f, LOG_CODECS[self.log_format])
+                    self._log_offset = len(self._log_codec.header)
+                f.seek(self._log_offset)
+                return self._replay_records(f)
+        finally:
+            self.bind_session(previous)
+
+    def _reload(self):
+        """Discard the in-memory state and replay the log again"""
+        self.databases = [Keyspace() for _ in self.databases]
+        self.used_memory = 0
+        self._replay_session.db = 0
+        self._seq = 0
+        self._replay_log()
+
+    def _apply_log_entry(self, parts: List[str]):
+        """Apply a single log entry to the in-memory store, raising ValueError if it's malformed"""
+        if not parts:
+            return
+
+        cmd = parts[0]
+        if cmd not in UNSEQUENCED_ENTRIES:
+            # Entries from before sequence numbers existed simply count up
+            seq = self._seq + 1 if self._replay_seq is None else self._replay_seq
+            if self._replay_seq is not None:
+                self._replay_seq += 1
+            if seq <= self._seq:
+                return  # Already applied
+            self._seq = seq
+
+        if cmd == "SEQ" and len(parts) == 2:
+            self._replay_seq = int(parts[1])
+        elif cmd == "SET" and len(parts) >= 3:
+            # SET entries clear the TTL unless they end with the KEEPTTL flag
+            keep_ttl = len(parts) >= 4 and parts[-1] == "KEEPTTL"
+            key, value = parts[1], " ".join(parts[2:-1] if keep_ttl else parts[2:])
+            self._set_key(key, value, None, keep_ttl)
+        elif cmd == "SETEX" and len(parts) >= 4:
+            # SETEX entries carry the absolute expiry in ms since the epoch
+            key, ttl, value = parts[1], float(parts[2]), " ".join(parts[3:])
+            self._set_key(key, value, ttl)
+        elif cmd == "SETZ" and (len(parts) == 3 or len(parts) == 4 and parts[3] == "KEEPTTL"):
+            self._set_key(parts[1], _unpack_compressed(parts[2]), None, len(parts) == 4)
+        elif cmd == "SETEXZ" and len(parts) == 4:
+            self._set_key(parts[1], _unpack_compressed(parts[3]), float(parts[2]))
+        elif cmd == "DEL" and len(parts) == 2:
+            self._delete_key(parts[1])
+        elif cmd in ("PEXPIREAT", "EXPIRE") and len(parts) == 3:
+            # PEXPIREAT entries carry the absolute expiry in ms since the epoch. Logs from
+            # before them have EXPIRE entries, whose ms count from when they're replayed.
+            key, ttl = parts[1], float(parts[2])
+            if cmd == "EXPIRE":
+                ttl += self._now_ms()
+            index = self._find_key_index(key)
+            if index != -1:
+                self._set_ttl(index, ttl)
+        elif cmd == "PERSIST" and len(parts) == 2:
+            index = self._find_key_index(parts[1])
+            if index != -1:
+                self._set_ttl(index, None)
+        elif cmd in ("LPUSH", "RPUSH") and len(parts) >= 3:
+            key = parts[1]
+            items = _pushed(self._replay_value(key, list), parts[2:], cmd == "LPUSH")
+            self._set_key(key, items, None)
+        elif cmd in ("LPOP", "RPOP") and len(parts) == 2:
+            key = parts[1]
+            items = self._replay_value(key, list)
+            if len(items) > 1:
+                self._set_key(key, items[1:] if cmd == "LPOP" else items[:-1], None)
+            else:
+                self._delete_key(key)
+        elif cmd == "HSET" and len(parts) >= 4 and len(parts) % 2 == 0:
+            key = parts[1]
+            fields = dict(self._replay_value(key, dict))
+            fields.update(zip(parts[2::2], parts[3::2]))
+            self._set_key(key, fields, None)
+        elif cmd == "HDEL" and len(parts) >= 3:
+            key = parts[1]
+            fields = {field: value for field, value in self._replay_value(key, dict).items()
+                      if field not in parts[2:]}
+            if fields:
+                self._set_key(key, fields, None)
+            else:
+                self._delete_key(key)
+        elif cmd in ("SADD", "SREM") and len(parts) >= 3:
+            key = parts[1]
+            members = self._replay_value(key, frozenset)
+            members = members.union(parts[2:]) if cmd == "SADD" else members.difference(parts[2:])
+            if members:
+                self._set_key(key, members, None)
+            else:
+                self._delete_key(key)
+        elif cmd == "ZADD" and len(parts) >= 4 and len(parts) % 2 == 0:
+            key = parts[1]
+            pairs = [(member, float(score)) for score, member in zip(parts[2::2], parts[3::2])]
+            self._set_key(key, self._replay_value(key, SortedSet).added(pairs), None)
+        elif cmd == "SELECT" and len(parts) == 2:
+            db = int(parts[1])
+            if not 0 <= db < len(self.databases):
+                # Skipping it would apply the entries that follow to the wrong database
+                raise DatabaseCountError(f"log uses database {db} but only {len(self.databases)} are configured")
+            self.session.db = self._log_db = db
+        elif cmd == "SWAPDB" and len(parts) == 3:
+            a, b = int(parts[1]), int(parts[2])
+            if not (0 <= a < len(self.databases) and 0 <= b < len(self.databases)):
+                raise DatabaseCountError(f"log uses database {max(a, b)} but only {len(self.databases)} are configured")
+            self._swap_databases(a, b)
+        elif cmd == "MOVE" and len(parts) == 3:
+            db = int(parts[2])
+            if not 0 <= db < len(self.databases):
+                raise DatabaseCountError(f"log uses database {db} but only {len(self.databases)} are configured")
+            index = self._find_key_index(parts[1])
+            if index != -1:
+                self._move_key(index, db)
+        elif cmd == "SNAPSHOT" and len(parts) == 2:
+            self._log_db = None  # Writers SELECT again after a marker
+            self._replay_seq = None  # ...and number their entries again
+        elif cmd == "ROTATED" and len(parts) == 3:
+            if self._replayed_segment == int(parts[1]):
+                # The compacted entries that follow restate the segment, which was just replayed
+                self._seq = max(self._seq, int(parts[2]))
+        else:
+            raise ValueError(f"malformed entry: {_command_line(*parts)[:80]}")
+
+    def _load_snapshot(self) -> int:
+        """Load the snapshot if its marker is still in the log, returning the log offset to replay from"""
+        try:
+            with open(self.snapshot_file, 'rb') as f:
+                snapshot_id, offset, seq, databases = _decode_snapshot(f.read())
+        except FileNotFoundError:
+            self.snapshot_status = "none"
+            return 0
+        except (ValueError, struct.error, UnicodeDecodeError) as e:
+            self.snapshot_status = f"corrupt ({e})"  # Fall back to a full replay
+            return 0
+
+        # A rewritten log (e.g. after COMPACT) no longer holds the marker
+        marker = self._log_codec.encode(("SNAPSHOT", str(snapshot_id)))
+        try:
+            with open(self.log_file, 'rb') as f:
+                f.seek(offset)
+                if f.read(len(marker)) != marker:
+                    self.snapshot_status = "stale"
+                    return 0
+        except FileNotFoundError:
+            self.snapshot_status = "stale"
+            return 0
+        if len(databases) > len(self.databases):
+            # Saved with more databases than configured; the log replay reports it
+            self.snapshot_status = "stale"
+            return 0
+        self.snapshot_status = "loaded"
+        self._log_db = None  # Entries after the marker start with a SELECT (and a SEQ)
+        self._seq = seq  # Otherwise a compaction before the next write would number its entries from 0
+
+        now = self.clock()
+        for keyspace, entries in zip(self.databases, databases):
+            keyspace.data = entries
+            keyspace.last_access = collections.OrderedDict((entry[0], now) for entry in entries)
+            keyspace.modified = dict.fromkeys((entry[0] for entry in entries), now)
+            self.used_memory += sum(_entry_size(*entry) for entry in entries)
+        return offset + len(marker)
+
+    @_writes
+    def save_snapshot(self, path: Optional[str] = None) -> int:
+        """Write the live entries of every database to a snapshot file, returning the number of keys saved.
+
+        A SNAPSHOT marker is appended to the log and its offset recorded in the
+        snapshot, so startup only replays the log entries written after it.
+        Only the snapshot at snapshot_file is loaded on startup.
+        """
+        path = path or self.snapshot_file
+        snapshot_id = time.time_ns()
+        offset = self._open_log().tell()
+        # The marker must sit exactly at offset, so it isn't preceded by a SELECT; the
+        # next entry selects its database again instead
+        self._append_log([("SNAPSHOT", str(snapshot_id))], select=False)
+        self._log_db = self._log_seq = None
+
+        now = self._now_ms()
+        live = [[(key, value, ttl) for key, value, ttl in keyspace.data if ttl is None or now <= ttl]
+                for keyspace in self.databases]
+        tmp_path = path + ".tmp"
+        with open(tmp_path, 'wb') as f:
+            f.write(_encode_snapshot(snapshot_id, offset, self._seq, live))
+            f.flush()
+            os.fsync(f.fileno())
+        os.replace(tmp_path, path)
+        self._fsync_dir(path)
+        return sum(len(entries) for entries in live)
     
-    def _write_to_log(self, command: str):
-        """Write committed command to log file"""
-        with open(self.log_file, 'a') as f:
-            f.write(command + '\n')
+    def _write_to_log(self, command: LogEntry, event: Optional[str] = None):
+        """Append a committed command to the log, syncing it according to the fsync policy"""
+        self._append_log([command], event=event)
+
+    def _open_log(self):
+        """The append handle for the log, opening it (and writing a new log's header) if needed"""
+        if self._log is None:
+            created = not os.path.exists(self.log_file)
+            self._log = open(self.log_file, 'ab')
+            if created:
+                # Otherwise a crash could lose the new file's directory entry, synced writes and all
+                self._fsync_dir()
+            if self._log.tell() == 0:
+                self._log_codec = LOG_CODECS[self.log_format]
+                self._log.write(self._log_codec.header)
+        return self._log
+
+    def _append_log(self, commands: List[LogEntry], select: bool = True, event: Optional[str] = None):
+        """Append a batch of commands with a single write and at most one fsync.
+
+        The commands apply to the session's database; a SELECT entry is written
+        first if the log's last entry was for another one (unless select is False).
+        A crash mid-batch can leave a torn final record; startup cuts it off,
+        keeping every complete entry before it.
+
+        With keyspace notifications on, each command's event (or event, if given)
+        is queued to be published once the store lock is released.
+        """
+        if not commands or self.readonly:
+            return  # A replica's log belongs to the primary
+        if select and self._log_db != self.session.db:
+            commands = [("SELECT", str(self.session.db))] + commands
+            self._log_db = self.session.db
+        sequenced = sum(1 for command in commands if command[0] not in UNSEQUENCED_ENTRIES)
+        if sequenced:
+            if self._log_seq != self._seq + 1:
+                commands = [("SEQ", str(self._seq + 1))] + commands
+            self._seq += sequenced
+            self._log_seq = self._seq + 1
+        log = self._open_log()
+        log.write(b"".join(self._log_codec.encode(self._packed_entry(command)) for command in commands))
+        log.flush()
+
+        if self.fsync_policy == "always":
+            os.fsync(self._log.fileno())
+        else:
+            self._log_dirty = True
+
+        if self.notify_keyspace_events:
+            for command in commands:
+                name = KEYSPACE_EVENTS.get(command[0], command[0].lower())
+                if name is not None:
+                    self._pending_events.append((event or name, command[1]))
+
+        # Compaction alone may leave the log past the limit; wait until the writes since
+        # then are at least as large, so a big dataset doesn't rotate on every write
+        size = log.tell()
+        if self.log_rotate_size and size > self.log_rotate_size and size > 2 * self._log_base_size:
+            self._rotate_log()
+
+    def _packed_entry(self, command: LogEntry) -> LogEntry:
+        """command as it's written to the log: a SET or SETEX of a string that's stored
+        compressed, or would be, becomes a SETZ or SETEXZ carrying the compressed bytes"""
+        if command[0] not in ("SET", "SETEX"):
+            return command
+        at = 2 if command[0] == "SET" else 3  # A SET's KEEPTTL flag follows its value
+        value = command[at]
+        if isinstance(value, str) and self.compress_threshold:
+            value = CompressedString.compress(value, self.compress_threshold)
+        if not isinstance(value, CompressedString):
+            return command
+        return (command[0] + "Z", *command[1:at], base64.b64encode(value.packed).decode("ascii"), *command[at + 1:])
+
+    def _log_segments(self) -> List[Tuple[int, str]]:
+        """(number, path) of each rotated log segment, oldest first"""
+        directory = os.path.dirname(self.log_file) or "."
+        prefix = os.path.basename(self.log_file) + "."
+        segments = []
+        for name in os.listdir(directory):
+            if name.startswith(prefix) and name[len(prefix):].isdigit():
+                segments.append((int(name[len(prefix):]), os.path.join(directory, name)))
+        return sorted(segments)
+
+    def _rotate_log(self):
+        """Roll the log over to the next numbered segment, compact into a fresh log and
+        drop segments beyond log_keep"""
+        segments = self._log_segments()
+        number = segments[-1][0] + 1 if segments else 1
+        self.compact(segment=f"{self.log_file}.{number}")
+        pruned = self._log_segments()[:-self.log_keep or None]
+        for _, path in pruned:
+            os.remove(path)
+        if pruned:
+            self._fsync_dir()
+
+    def _recover_rotation(self):
+        """Put the newest segment back as the log if a crash mid-rotation left none.
+
+        Rotation renames the log to its segment just before renaming the compacted
+        log into place; in between, the segment still holds the complete log.
+        """
+        if self.readonly or os.path.exists(self.log_file):
+            return
+        segments = self._log_segments()
+        if segments:
+            os.replace(segments[-1][1], self.log_file)
+            self._fsync_dir()
+
+    def _run_fsync(self):
+        """Background loop for the everysec policy"""
+        while not self._closed.wait(1.0):
+            self.sync_log()
+
+    @_writes
+    def sync_log(self):
+        """Fsync any log writes that haven't reached the disk yet"""
+        if self._log is not None and self._log_dirty:
+            os.fsync(self._log.fileno())
+            self._mark_synced()
+
+    def _mark_synced(self):
+        """Record that every write logged so far is on disk, waking WAIT callers"""
+        self._log_dirty = False
+        with self._log_synced:
+            self._log_syncs += 1
+            self._log_synced.notify_all()
+
+    @_reads
+    def _sync_state(self) -> Tuple[bool, int]:
+        """Whether the log has unsynced writes, and the sync count they're waiting on"""
+        return self._log_dirty, self._log_syncs
+
+    def wait(self, numlocal: str, timeout: str) -> str:
+        """WAIT numlocal timeout: block until the writes logged so far are fsynced, up to
+        timeout ms (0 waits forever), returning 1 if they are and 0 on a timeout.
+
+        Under the always policy every write is synced before it returns, so this
+        returns at once; under everysec it waits for the background fsync. With
+        numlocal 0 it doesn't wait, just reports. The store lock isn't held while
+        waiting.
+        """
+        try:
+            wanted, ms = int(numlocal), int(timeout)
+        except ValueError:
+            return ErrorReply("ERR value is not an integer or out of range")
+        if wanted not in (0, 1):
+            return ErrorReply("ERR numlocal must be 0 or 1")
+        if ms < 0:
+            return ErrorReply("ERR timeout is negative")
+        dirty, syncs = self._sync_state()
+        if not dirty:
+            return "1"
+        if not wanted:
+            return "0"
+        if self.fsync_policy == "no":
+            return ErrorReply("ERR WAIT cannot be used when appendfsync is no")
+        with self._log_synced:
+            synced = self._log_synced.wait_for(lambda: self._log_syncs != syncs or self.closed,
+                                               ms / 1000 if ms else None)
+        return "1" if synced and self._log_syncs != syncs else "0"
+
+    @property
+    def closed(self) -> bool:
+        return self._closed.is_set()
+
+    @_writes
+    def close(self):
+        """Fsync and close the log and stop background threads"""
+        self._closed.set()
+        with self._list_ready:
+            self._list_ready.notify_all()  # Blocked pops give up
+        if self._log is not None:
+            if self._log_dirty:
+                os.fsync(self._log.fileno())
+                self._mark_synced()
+            self._log.close()
+            self._log = None
     
+    def record_command(self, cmd: Optional[str]):
+        """Count a processed command for INFO and COMMANDSTATS; None marks an unknown command"""
+        with self._stats_lock:
+            self.commands_processed += 1
+            if cmd is None:
+                self.unknown_commands += 1
+            else:
+                self.command_counts[cmd] = self.command_counts.get(cmd, 0) + 1
+
+    def record_duration(self, parts: List[str], duration_us: int):
+        """Add a command to the slowlog if it ran longer than the threshold.
+
+        AUTH's arguments are recorded as (redacted), keeping passwords out of SLOWLOG GET.
+        """
+        if self.slowlog_threshold_us < 0 or duration_us < self.slowlog_threshold_us:
+            return
+        if parts and parts[0].upper() == "AUTH":
+            parts = parts[:1] + ["(redacted)"] * (len(parts) - 1)
+        with self._stats_lock:
+            self.slowlog.append((self._slowlog_next_id, int(self.clock()), duration_us, " ".join(parts)))
+            self._slowlog_next_id += 1
+
+    def slowlog_command(self, subcommand: str, *args) -> List[str]:
+        sub = subcommand.upper()
+        if sub == "GET" and len(args) <= 1:
+            try:
+                count = int(args[0]) if args else 10
+            except ValueError:
+                return [ErrorReply("ERR value is not an integer")]
+
+            with self._stats_lock:
+                newest_first = list(reversed(self.slowlog))
+            if count >= 0:
+                newest_first = newest_first[:count]
+            result = [f"id:{entry_id} time:{timestamp} duration_us:{duration} command:{command}"
+                      for entry_id, timestamp, duration, command in newest_first]
+            result.append("END")
+            return result
+        if sub == "RESET" and not args:
+            with self._stats_lock:
+                self.slowlog.clear()
+            return ["OK"]
+        return [ErrorReply("ERR unknown SLOWLOG subcommand or wrong number of arguments")]
+
+    def commandstats(self) -> List[str]:
+        with self._stats_lock:
+            result = [f"cmdstat_{cmd.lower()}:calls={calls}"
+                      for cmd, calls in sorted(self.command_counts.items())]
+            result.append(f"unknown_commands:{self.unknown_commands}")
+        result.append("END")
+        return result
+
+    @_writes
+    def free_memory(self, needed: int = 0) -> Optional[str]:
+        """Evict least recently used keys until needed more bytes fit in maxmemory.
+
+        Called before commands that can grow the dataset. Each eviction is logged
+        as a DEL. Returns an OOM error if the budget can't be met.
+        """
+        if not self.maxmemory:
+            return None
+        if needed > self.maxmemory:
+            return ErrorReply("ERR OOM command not allowed when used memory > 'maxmemory'")
+
+        evicted = 0
+        while self.used_memory + needed > self.maxmemory:
+            # The least recently used key across all databases
+            oldest = None
+            for db, keyspace in enumerate(self.databases):
+                if keyspace.last_access:
+                    key, accessed = next(iter(keyspace.last_access.items()))
+                    if oldest is None or accessed < oldest[2]:
+                        oldest = (db, key, accessed)
+            if oldest is None:
+                break
+
+            db, key, _ = oldest
+            with self._using_db(db):
+                if not self._delete_key(key):
+                    del self.last_access[key]  # Defensive: no entry to evict
+                    continue
+                self._write_to_log(("DEL", key), event="evicted")
+            evicted += 1
+        with self._stats_lock:
+            self.evicted_keys += evicted
+
+        if self.used_memory + needed > self.maxmemory:
+            return ErrorReply("ERR OOM command not allowed when used memory > 'maxmemory'")
+        return None
+
+    @_writes
+    def reserve_keys(self, keys: List[str]) -> Optional[str]:
+        """Make room under maxkeys for the keys a write may create.
+
+        The cap covers all databases together. Expired keys the sweeper hasn't
+        removed yet still count. Under the random policy other keys are evicted,
+        each logged as a DEL; under noeviction, or if there's nothing left to
+        evict, an error is returned.
+        """
+        if not self.maxkeys:
+            return None
+        targets = set(keys)
+        created = sum(1 for key in targets if self._find_key_index(key) == -1)
+        overflow = sum(len(keyspace.data) for keyspace in self.databases) + created - self.maxkeys
+        if created == 0 or overflow <= 0:
+            return None
+        if self.maxkeys_policy == "noeviction":
+            return ErrorReply("ERR maxkeys reached")
+
+        current = self.session.db
+        candidates = [(db, key) for db, keyspace in enumerate(self.databases)
+                      for key, _, _ in keyspace.data if db != current or key not in targets]
+        if len(candidates) < overflow:
+            return ErrorReply("ERR maxkeys reached")
+        for db, key in random.sample(candidates, overflow):
+            with self._using_db(db):
+                self._delete_key(key)
+                self._write_to_log(("DEL", key), event="evicted")
+        with self._stats_lock:
+            self.evicted_keys += overflow
+        return None
+
+    @_reads
+    def info(self) -> List[str]:
+        now = self._now_ms()
+        live = [sum(1 for _, _, ttl in keyspace.data if ttl is None or now <= ttl)
+                for keyspace in self.databases]
+        try:
+            log_size = os.path.getsize(self.log_file)
+        except FileNotFoundError:
+            log_size = 0
+
+        # Databases holding keys, like the keyspace section of Redis INFO
+        keyspace_lines = [f"db{db}:keys={count}" for db, count in enumerate(live) if count]
+        with self._stats_lock:
+            return [
+                f"keys:{sum(live)}",
+                f"expired_keys:{self.expired_keys}",
+                f"evicted_keys:{self.evicted_keys}",
+                f"used_memory:{self.used_memory}",
+                f"maxmemory:{self.maxmemory}",
+                f"maxkeys:{self.maxkeys}",
+                f"total_commands_processed:{self.commands_processed}",
+                f"log_size_bytes:{log_size}",
+                f"uptime_seconds:{int(self.clock() - self.start_time)}",
+                f"databases:{len(self.databases)}",
+                *keyspace_lines,
+                "END",
+            ]
+
+    @_writes
+    def compact(self, segment: Optional[str] = None, cancel: Optional[threading.Event] = None) -> int:
+        """Rewrite the log as one SET or RPUSH (plus PEXPIREAT) per live key in every database,
+        returning the key count.
+
+        The new log is written to a temporary file and fsynced before being
+        renamed over the old one, so a crash mid-compaction leaves the original
+        log intact. The directory is fsynced after the rename so the rename
+        itself survives a crash. With segment, the old log is renamed there
+        instead of being replaced, and the new one starts with a ROTATED entry
+        naming it.
+
+        The rewritten entries are numbered to end at the current sequence number
+        (raised to their count if it's lower), so a store that has applied
+        everything up to it skips them all while a fresh one applies them all.
+
+        Setting cancel stops it with OperationCancelled while it's still
+        collecting entries, before any file is written.
+        """
+        now = self._now_ms()
+        tmp_path = self.log_file + ".tmp"
+        count = 0
+        log_db = 0  # Replay starts in database 0
+        commands = []
+        for db, keyspace in enumerate(self.databases):
+            for key, value, ttl in self._checking(keyspace.data, cancel):
+                if ttl is not None and now > ttl:
+                    continue
+                if db != log_db:
+                    commands.append(("SELECT", str(db)))
+                    log_db = db
+                commands.extend(self._entry_log_commands(key, value, ttl))
+                count += 1
+        sequenced = sum(1 for command in commands if command[0] not in UNSEQUENCED_ENTRIES)
+        # A SETEX becomes SET plus PEXPIREAT, so the rewrite can hold more entries than were
+        # ever logged; numbering from below 1 would have a fresh replay skip them
+        self._seq = max(self._seq, sequenced)
+        commands.insert(0, ("SEQ", str(self._seq - sequenced + 1)))
+        if segment is not None:
+            # Lets replay on open continue from the segment instead of from these entries
+            commands.insert(0, ("ROTATED", segment.rsplit(".", 1)[1], str(self._seq)))
+
+        codec = LOG_CODECS[self.log_format]  # Compacting converts the log to the configured format
+        with open(tmp_path, 'wb') as f:
+            f.write(codec.header)
+            for command in commands:
+                f.write(codec.encode(self._packed_entry(command)))
+            f.flush()
+            os.fsync(f.fileno())
+
+        # The append handle points at the old file; the next write reopens it
+        if self._log is not None:
+            self._log.close()
+            self._log = None
+            self._mark_synced()  # Everything the old log held is in the fsynced new one
+        if segment is not None and os.path.exists(self.log_file):
+            os.replace(self.log_file, segment)
+        os.replace(tmp_path, self.log_file)
+        self._fsync_dir()
+        self._log_base_size = os.path.getsize(self.log_file)
+        self._log_codec = codec
+        self._log_db = log_db
+        self._log_seq = self._seq + 1
+        return count
+
+    def _fsync_dir(self, path: Optional[str] = None):
+        """Fsync the directory holding path (by default the log), making renames and
+        newly created files in it durable.
+
+        Like the log itself, it's never fsynced under the "no" policy.
+        """
+        if self.fsync_policy != "no":
+            self._sync_directory(os.path.dirname(path or self.log_file) or ".")
+
     def _apply_transaction(self):
-        """Apply all operations in transaction buffer to main store"""
+        """Apply all operations in transaction buffer to main store.
+
+        The buffer is a list, so operations are applied and logged in exactly
+        the order they were issued within the transaction.
+        """
         if not self.transaction_buffer:
             return
         
+        log_cmds = []
         for op, args in self.transaction_buffer:
             if op == "SET":
-                key, value, ttl = args
-                self._set_key(key, value, ttl)
-                log_cmd = f"SET {key} {value}"
-                self._write_to_log(log_cmd)
+                key, value, ttl, keep_ttl = args
+                if ttl is None:
+                    self._get_key_index(key)  # Drop the key if it has expired, rather than keep its TTL
+                self._set_key(key, value, ttl, keep_ttl)
+                if not isinstance(value, str):
+                    # Containers are logged whole: RPUSH, HSET, SADD and ZADD merge into what the key holds
+                    final_ttl = self.data[self._find_key_index(key)][2]
+                    log_cmds.append(("DEL", key))
+                    log_cmds.extend(self._entry_log_commands(key, value, final_ttl))
+                elif ttl is not None:
+                    log_cmds.append(("SETEX", key, str(int(ttl)), value))
+                elif keep_ttl:
+                    log_cmds.append(("SET", key, value, "KEEPTTL"))
+                else:
+                    log_cmds.append(("SET", key, value))
             elif op == "DEL":
                 key = args[0]
                 if self._delete_key(key):
-                    self._write_to_log(f"DEL {key}")
+                    log_cmds.append(("DEL", key))
             elif op == "EXPIRE":
-                key, ms = args
+                key, ttl = args
                 index = self._find_key_index(key)
                 if index != -1:
-                    ttl = time.time() * 1000 + float(ms)
-                    key, value, _ = self.data[index]
-                    self.data[index] = (key, value, ttl)
-                    self._write_to_log(f"EXPIRE {key} {ms}")
+                    self._set_ttl(index, ttl)
+                    log_cmds.append(("PEXPIREAT", key, str(int(ttl))))
+            elif op == "PERSIST":
+                key = args[0]
+                index = self._find_key_index(key)
+                if index != -1 and self.data[index][2] is not None:
+                    self._set_ttl(index, None)
+                    log_cmds.append(("PERSIST", key))
+        self._append_log(log_cmds)
     
-    def set(self, key: str, value: str) -> str:
+    @_writes
+    def set(self, key: str, value: str, keep_ttl: bool = False) -> str:
+        """Set a string value, clearing the key's TTL unless keep_ttl is set.
+
+        With keep_ttl the entry is logged with a KEEPTTL flag, so replay keeps
+        the TTL too. A key whose TTL has passed is removed first (logging its
+        DEL), so the new value doesn't inherit the stale TTL.
+        """
+        self._get_key_index(key)
         if self.transaction_buffer is not None:
-            # In transaction - buffer the operation
-            current_ttl = None
-            index = self._find_key_index(key)
-            if index != -1:
-                current_ttl = self.data[index][2]
-            self.transaction_buffer.append(("SET", (key, value, current_ttl)))
+            # In transaction - buffer the operation; a kept TTL is the one the key has at COMMIT
+            self.transaction_buffer.append(("SET", (key, value, None, keep_ttl)))
         else:
             # Not in transaction - apply immediately
-            self._set_key(key, value, None)
-            self._write_to_log(f"SET {key} {value}")
+            self._set_key(key, value, None, keep_ttl)
+            self._write_to_log(("SET", key, value, "KEEPTTL") if keep_ttl else ("SET", key, value))
         return "OK"
     
+    @_writes
+    def cas(self, key: str, expected: str, value: str) -> str:
+        """Set key to value only if it currently holds expected.
+
+        A successful swap keeps the key's TTL, like SET KEEPTTL.
+        """
+        entry = self._resolve(key)
+        if entry is None:
+            return "0"
+        if not isinstance(entry[0], str):
+            return WRONGTYPE_ERROR
+        if entry[0] != expected:
+            return "0"
+        self.set(key, value, keep_ttl=True)
+        return "1"
+
+    @_writes
+    def cad(self, key: str, expected: str) -> str:
+        """Delete key only if it currently holds expected"""
+        entry = self._resolve(key)
+        if entry is None:
+            return "0"
+        if not isinstance(entry[0], str):
+            return WRONGTYPE_ERROR
+        if entry[0] != expected:
+            return "0"
+        self.delete(key)
+        return "1"
+
+    def _set_with_expiry(self, key: str, value: str, ttl: float) -> str:
+        """Set a value and its absolute expiry (ms since epoch) as one logged operation"""
+        if self.transaction_buffer is not None:
+            self.transaction_buffer.append(("SET", (key, value, ttl, False)))
+        else:
+            self._set_key(key, value, ttl)
+            self._write_to_log(("SETEX", key, str(int(ttl)), value))
+        return "OK"
+
+    @_writes
+    def setex(self, key: str, seconds: str, value: str) -> str:
+        try:
+            ttl_seconds = int(seconds)
+        except ValueError:
+            return ErrorReply("ERR value is not an integer")
+        if ttl_seconds <= 0:
+            return ErrorReply("ERR invalid expire time")
+        return self._set_with_expiry(key, value, int(self._now_ms()) + ttl_seconds * 1000)
+
+    @_writes
+    def psetex(self, key: str, milliseconds: str, value: str) -> str:
+        try:
+            ttl_ms = int(milliseconds)
+        except ValueError:
+            return ErrorReply("ERR value is not an integer")
+        if ttl_ms <= 0:
+            return ErrorReply("ERR invalid expire time")
+        return self._set_with_expiry(key, value, int(self._now_ms()) + ttl_ms)
+
+    @_reads
     def get(self, key: str) -> str:
-        # Check transaction buffer first for read-your-writes
+        # Inside a transaction read our own writes over the BEGIN snapshot
         if self.transaction_buffer is not None:
-            # Look for latest operation on this key in transaction buffer
-            for op, args in reversed(self.transaction_buffer):
-                if op == "SET" and args[0] == key:
-                    return args[1] if args[1] != "" else ""
-                elif op == "DEL" and args[0] == key:
-                    return "nil"
+            entry = self._resolve(key)
+            if entry is None:
+                return "nil"
+            return entry[0] if isinstance(entry[0], str) else WRONGTYPE_ERROR
         
         index = self._get_key_index(key)
         if index == -1:
             return "nil"
         
-        return self.data[index][1] if self.data[index][1] != "" else ""
+        value = _expanded(self.data[index][1])
+        return value if isinstance(value, str) else WRONGTYPE_ERROR
+
+    @_reads
+    def getrange(self, key: str, start: str, end: str) -> str:
+        """Bytes start to end inclusive of a string value; negative offsets count from the end.
+
+        Out-of-range offsets clamp, and a missing key reads as an empty string.
+        """
+        try:
+            first, last = int(start), int(end)
+        except ValueError:
+            return ErrorReply("ERR value is not an integer")
+
+        value, error = self._typed_entry(key, str)
+        if error:
+            return error
+        data = value.encode("utf-8", TEXT_ERRORS)
+        begin, stop = _clamp_range(len(data), first, last)
+        return data[begin:stop].decode("utf-8", TEXT_ERRORS)
+
+    @_writes
+    def setrange(self, key: str, offset: str, value: str) -> str:
+        """Overwrite a string from byte offset on, zero-padding it out to offset; returns the new length.
+
+        A missing key reads as an empty string. The whole new value is written
+        (and logged) as a SET, which keeps the key's TTL.
+        """
+        try:
+            start = int(offset)
+        except ValueError:
+            return ErrorReply("ERR value is not an integer")
+        if start < 0:
+            return ErrorReply("ERR offset is out of range")
+        if start + len(value.encode("utf-8", TEXT_ERRORS)) > MAX_STRING_SIZE:
+            return ErrorReply("ERR string exceeds maximum allowed size")
+
+        current, error = self._typed_entry(key, str)
+        if error:
+            return error
+        data = current.encode("utf-8", TEXT_ERRORS)
+        patch = value.encode("utf-8", TEXT_ERRORS)
+        if not patch:
+            return str(len(data))  # Nothing to write; a missing key stays missing
+
+        data = data[:start].ljust(start, b"\x00") + patch + data[start + len(patch):]
+        self.set(key, data.decode("utf-8", TEXT_ERRORS), keep_ttl=True)
+        return str(len(data))
     
+    @_writes
+    def getex(self, key: str, *options) -> str:
+        """GET that also sets (EX seconds, PX milliseconds) or removes (PERSIST) the key's TTL"""
+        option = options[0].upper() if options else None
+        if not (option is None
+                or (option in ("EX", "PX") and len(options) == 2)
+                or (option == "PERSIST" and len(options) == 1)):
+            return ErrorReply("ERR syntax error")
+        ttl_ms = None
+        if option in ("EX", "PX"):
+            try:
+                ttl_ms = int(options[1]) * (1000 if option == "EX" else 1)
+            except ValueError:
+                return ErrorReply("ERR value is not an integer")
+            if ttl_ms <= 0:
+                return ErrorReply("ERR invalid expire time")
+
+        entry = self._resolve(key)
+        if entry is None:
+            return "nil"
+        if not isinstance(entry[0], str):
+            return WRONGTYPE_ERROR
+        if ttl_ms is not None:
+            self._expire_at(key, int(self._now_ms()) + ttl_ms)
+        elif option == "PERSIST":
+            self.persist(key)
+        return entry[0]
+
+    @_reads
+    def getifnewer(self, key: str, since: str) -> str:
+        """GET, but only if the key changed after since (Unix time in ms); NOTMODIFIED if it hasn't.
+
+        Inside a transaction, a key the transaction has written counts as changed.
+        """
+        try:
+            since_ms = int(since)
+        except ValueError:
+            return ErrorReply("ERR value is not an integer or out of range")
+        entry = self._resolve(key)
+        if entry is None:
+            return "nil"
+        if not isinstance(entry[0], str):
+            return WRONGTYPE_ERROR
+        buffered = any(args[0] == key for _, args in self.transaction_buffer or [])
+        if not buffered and self.modified.get(key, self.start_time) * 1000 <= since_ms:
+            return "NOTMODIFIED"
+        return entry[0]
+
+    @_writes
     def delete(self, key: str) -> str:
         if self.transaction_buffer is not None:
             # In transaction - buffer the operation
@@ -171,125 +2556,230 @@ class KVStore:
             return "1"  # Assume it will be deleted
         else:
             # Not in transaction - apply immediately
-            index = self._get_key_index(key, check_expired=False)
-            if index != -1:
-                self.data.pop(index)
-                self._write_to_log(f"DEL {key}")
+            if self._delete_key(key):
+                self._write_to_log(("DEL", key))
                 return "1"
             return "0"
     
+    @_reads
     def exists(self, key: str) -> str:
         if self.transaction_buffer is not None:
-            # Check transaction buffer first
-            for op, args in reversed(self.transaction_buffer):
-                if op == "SET" and args[0] == key:
-                    return "1"
-                elif op == "DEL" and args[0] == key:
-                    return "0"
+            return "0" if self._resolve(key) is None else "1"
         
         index = self._get_key_index(key)
         return "1" if index != -1 else "0"
     
+    @_writes
     def mset(self, *args) -> str:
+        """Set several keys at once.
+
+        All keys are written under one write lock acquisition, so readers see
+        either none of them or all of them. They're logged as one batch with one
+        fsync, but as one entry per key: a crash partway through writing the
+        batch can leave the leading keys in the log, and a restart then applies
+        just those. Like SET, it clears the keys' TTLs.
+        """
         if len(args) % 2 != 0:
-            return "ERR wrong number of arguments for MSET"
+            return ErrorReply("ERR wrong number of arguments for MSET")
         
         if self.transaction_buffer is not None:
             for i in range(0, len(args), 2):
-                key, value = args[i], args[i+1]
-                current_ttl = None
-                index = self._find_key_index(key)
-                if index != -1:
-                    current_ttl = self.data[index][2]
-                self.transaction_buffer.append(("SET", (key, value, current_ttl)))
+                self.transaction_buffer.append(("SET", (args[i], args[i+1], None, False)))
         else:
+            log_cmds = []
             for i in range(0, len(args), 2):
                 key, value = args[i], args[i+1]
-                self._set_key(key, value, None)
-                self._write_to_log(f"SET {key} {value}")
+                self._get_key_index(key)  # Drop an expired key first, logging its DEL, as SET does
+                self._set_key(key, value, None, keep_ttl=False)
+                log_cmds.append(("SET", key, value))
+            self._append_log(log_cmds)
         
         return "OK"
     
+    @_writes
+    def msetnx(self, *args) -> str:
+        """Set several keys, like MSET, only if none of them exist; returns 1 if they were set, else 0"""
+        if len(args) % 2 != 0:
+            return ErrorReply("ERR wrong number of arguments for MSETNX")
+        # Every key is checked, against the transaction's view too, before anything is written
+        if any(self._resolve(key) is not None for key in args[::2]):
+            return "0"
+        self.mset(*args)
+        return "1"
+
+    @_reads
     def mget(self, *keys) -> List[str]:
+        """Values of several keys, read together under the read lock so a concurrent MSET is seen whole or not at all"""
         results = []
         for key in keys:
-            results.append(self.get(key))
+            # Keys holding other types read as missing, as in Redis
+            entry = self._resolve(key)
+            results.append(entry[0] if entry is not None and isinstance(entry[0], str) else "nil")
         return results
     
+    @_writes
     def begin(self) -> str:
+        """Start a transaction, or a nested level (savepoint) inside the current one"""
         if self.transaction_buffer is not None:
-            return "ERR transaction already in progress"
+            self.session.savepoints.append(len(self.transaction_buffer))
+            return "OK"
         self.transaction_buffer = []
+        self.session.snapshot = list(self.data)
         return "OK"
     
+    @_writes
     def commit(self) -> str:
+        """Merge the innermost level into its parent; only the outermost COMMIT applies and logs"""
         if self.transaction_buffer is None:
-            return "ERR no transaction in progress"
-        
-        self._apply_transaction()
+            return ErrorReply("ERR no transaction in progress")
+
+        if self.session.savepoints:
+            self.session.savepoints.pop()
+            return "OK"
+
+        # A watched key changed since WATCH: discard the whole transaction
+        conflict = any(self.databases[db].versions.get(key, 0) != version
+                       for (db, key), version in self.session.watched.items())
+        if not conflict:
+            self._apply_transaction()
         self.transaction_buffer = None
-        return "OK"
+        self.session.snapshot = None
+        self.unwatch()
+        return "nil" if conflict else "OK"
     
+    @_writes
     def abort(self) -> str:
+        """Discard the writes of the innermost level, leaving any outer levels open"""
         if self.transaction_buffer is None:
-            return "ERR no transaction in progress"
+            return ErrorReply("ERR no transaction in progress")
+
+        if self.session.savepoints:
+            del self.transaction_buffer[self.session.savepoints.pop():]
+            return "OK"
         
         self.transaction_buffer = None
+        self.session.snapshot = None
+        self.unwatch()
+        return "OK"
+
+    def txstatus(self) -> List[str]:
+        """The writes the session's transaction has queued, every level's, in the order COMMIT applies them.
+
+        The reply is their count, then the operation and key of each. Container
+        commands queue their key's whole new value, so they show as SET.
+        """
+        if self.transaction_buffer is None:
+            return [ErrorReply("ERR no transaction in progress")]
+        return [str(len(self.transaction_buffer)),
+                *(_command_line(op, args[0]) for op, args in self.transaction_buffer), "END"]
+
+    @_writes
+    def watch(self, *keys) -> str:
+        """Make the next COMMIT fail if any of the keys changes before it"""
+        if self.transaction_buffer is not None:
+            return ErrorReply("ERR WATCH inside a transaction is not allowed")
+
+        watch_refs = self.keyspace.watch_refs
+        for key in keys:
+            if (self.session.db, key) not in self.session.watched:
+                watch_refs[key] = watch_refs.get(key, 0) + 1
+                self.session.watched[(self.session.db, key)] = self.versions.get(key, 0)
+        return "OK"
+
+    @_writes
+    def unwatch(self) -> str:
+        for db, key in self.session.watched:
+            with self._using_db(db):
+                watch_refs = self.keyspace.watch_refs
+                watch_refs[key] -= 1
+                if watch_refs[key] == 0:
+                    del watch_refs[key]
+                    # Drop the version a deleted key kept only for watchers
+                    if self._find_key_index(key) == -1:
+                        self.versions.pop(key, None)
+        self.session.watched = {}
         return "OK"
     
-    def expire(self, key: str, milliseconds: str) -> str:
-        try:
-            ms = float(milliseconds)
-            if ms <= 0:
-                # Expire immediately
-                if self.transaction_buffer is not None:
-                    self.transaction_buffer.append(("DEL", (key,)))
-                else:
-                    index = self._find_key_index(key)
-                    if index != -1:
-                        self.data.pop(index)
-                        self._write_to_log(f"DEL {key}")
-                return "1"
-            
-            ttl = time.time() * 1000 + ms
-            
+    def _expire_at(self, key: str, ttl: float, flags: Tuple[str, ...] = ()) -> str:
+        """Set an absolute expiry (ms since epoch) on a key; a time in the past deletes it.
+
+        Flags make it conditional: NX only if the key has no TTL, XX only if it
+        has one, GT only if ttl is later than the current one and LT only if
+        it's sooner. A key without a TTL counts as never expiring for GT and LT.
+        """
+        conditions = {flag.upper() for flag in flags}
+        if not conditions <= {"NX", "XX", "GT", "LT"}:
+            return ErrorReply("ERR syntax error")
+        if "NX" in conditions and len(conditions) > 1:
+            return ErrorReply("ERR NX and XX, GT or LT options at the same time are not compatible")
+        if {"GT", "LT"} <= conditions:
+            return ErrorReply("ERR GT and LT options at the same time are not compatible")
+
+        entry = self._resolve(key)
+        if entry is None:
+            return "0"
+        current = entry[1]
+        if (("NX" in conditions and current is not None)
+                or ("XX" in conditions and current is None)
+                or ("GT" in conditions and (current is None or ttl <= current))
+                or ("LT" in conditions and current is not None and ttl >= current)):
+            return "0"
+
+        if ttl <= self._now_ms():
+            # Expire immediately
             if self.transaction_buffer is not None:
-                # Check if key exists in main store or will be created in transaction
-                exists = False
-                for op, args in self.transaction_buffer:
-                    if op == "SET" and args[0] == key:
-                        exists = True
-                        break
-                if not exists:
-                    index = self._find_key_index(key)
-                    if index == -1 or self._is_expired(index):
-                        return "0"
-                self.transaction_buffer.append(("EXPIRE", (key, milliseconds)))
+                self.transaction_buffer.append(("DEL", (key,)))
             else:
-                index = self._get_key_index(key, check_expired=False)
-                if index == -1:
-                    return "0"
-                key_name, value, _ = self.data[index]
-                self.data[index] = (key_name, value, ttl)
-                self._write_to_log(f"EXPIRE {key} {milliseconds}")
-            
+                self._delete_key(key)
+                self._write_to_log(("DEL", key))
             return "1"
+
+        if self.transaction_buffer is not None:
+            self.transaction_buffer.append(("EXPIRE", (key, ttl)))
+        else:
+            self._set_ttl(self._find_key_index(key), ttl)
+            self._write_to_log(("PEXPIREAT", key, str(int(ttl))))
+        return "1"
+
+    @_writes
+    def expire(self, key: str, seconds: str, *flags) -> str:
+        ms = _ttl_ms(seconds, 1000)
+        if ms is None:
+            return ErrorReply("ERR invalid expire time")
+        return self._expire_at(key, int(self._now_ms() + ms), flags)
+
+    @_writes
+    def pexpire(self, key: str, milliseconds: str, *flags) -> str:
+        ms = _ttl_ms(milliseconds, 1)
+        if ms is None:
+            return ErrorReply("ERR invalid expire time")
+        return self._expire_at(key, int(self._now_ms() + ms), flags)
+
+    @_writes
+    def expireat(self, key: str, unix_seconds: str, *flags) -> str:
+        try:
+            seconds = int(unix_seconds)
         except ValueError:
-            return "ERR invalid TTL value"
-    
-    def ttl(self, key: str) -> str:
-        # Check transaction buffer first
+            return ErrorReply("ERR invalid timestamp")
+        return self._expire_at(key, seconds * 1000, flags)
+
+    @_writes
+    def pexpireat(self, key: str, unix_millis: str, *flags) -> str:
+        try:
+            millis = int(unix_millis)
+        except ValueError:
+            return ErrorReply("ERR invalid milliseconds")
+        return self._expire_at(key, millis, flags)
+
+    @_reads
+    def pttl(self, key: str) -> str:
         if self.transaction_buffer is not None:
-            for op, args in reversed(self.transaction_buffer):
-                if op == "SET" and args[0] == key:
-                    # SET without EXPIRE in same transaction means no TTL
-                    return "-1"
-                elif op == "DEL" and args[0] == key:
-                    return "-2"
-                elif op == "EXPIRE" and args[0] == key:
-                    ms = float(args[1])
-                    remaining = ms - (time.time() * 1000 - (time.time() * 1000 - ms))
-                    return str(int(max(0, remaining)))
+            entry = self._resolve(key)
+            if entry is None:
+                return "-2"
+            if entry[1] is None:
+                return "-1"
+            return str(int(max(0, entry[1] - self._now_ms())))
         
         index = self._get_key_index(key, check_expired=False)
         if index == -1:
@@ -302,48 +2792,41 @@ class KVStore:
         if key_ttl is None:
             return "-1"
         
-        remaining = key_ttl - time.time() * 1000
-        if remaining <= 0:
-            self.data.pop(index)
+        # A key expires once the clock passes its expiry, so at exactly its expiry it has 0ms left
+        return str(int(key_ttl - self._now_ms()))
+
+    @_reads
+    def ttl(self, key: str) -> str:
+        remaining = int(self.pttl(key))
+        if remaining < 0:
+            return str(remaining)
+        # Whole seconds left, truncated: 1500ms reads 1 and a key with under a second left reads 0
+        return str(remaining // 1000)
+
+    @_reads
+    def pexpiretime(self, key: str) -> str:
+        entry = self._resolve(key)
+        if entry is None:
             return "-2"
-        
-        return str(int(remaining))
-    
+        if entry[1] is None:
+            return "-1"
+        return str(int(entry[1]))
+
+    @_reads
+    def expiretime(self, key: str) -> str:
+        expires_at = int(self.pexpiretime(key))
+        if expires_at < 0:
+            return str(expires_at)
+        return str(expires_at // 1000)
+    
+    @_writes
     def persist(self, key: str) -> str:
         if self.transaction_buffer is not None:
-            # Check if key exists and has TTL
-            has_ttl = False
-            for op, args in reversed(self.transaction_buffer):
-                if op == "SET" and args[0] == key:
-                    # If SET in transaction, check if it would have TTL
-                    if args[2] is not None:
-                        has_ttl = True
-                    break
-                elif op == "EXPIRE" and args[0] == key:
-                    has_ttl = True
-                    break
-            
-            if not has_ttl:
-                index = self._find_key_index(key)
-                if index == -1 or self._is_expired(index) or self.data[index][2] is None:
-                    return "0"
-            
-            # Buffer a SET operation that preserves value but removes TTL
-            current_value = None
-            for op, args in reversed(self.transaction_buffer):
-                if op == "SET" and args[0] == key:
-                    current_value = args[1]
-                    break
-            
-            if current_value is None:
-                index = self._find_key_index(key)
-                if index != -1 and not self._is_expired(index):
-                    current_value = self.data[index][1]
-            
-            if current_value is not None:
-                self.transaction_buffer.append(("SET", (key, current_value, None)))
-                return "1"
-            return "0"
+            entry = self._resolve(key)
+            if entry is None or entry[1] is None:
+                return "0"
+            self.transaction_buffer.append(("PERSIST", (key,)))
+            return "1"
         else:
             index = self._get_key_index(key)
             if index == -1:
@@ -353,104 +2836,1725 @@ class KVStore:
             if ttl is None:
                 return "0"
             
-            self.data[index] = (key_name, value, None)
-            # Note: PERSIST doesn't need to be logged as it's effectively a SET without TTL
-            self._write_to_log(f"SET {key_name} {value}")
+            self._set_ttl(index, None)
+            self._write_to_log(("PERSIST", key_name))
             return "1"
     
-    def range(self, start: str, end: str) -> List[str]:
-        result = []
+    def _checking(self, items, cancel: Optional[threading.Event]):
+        """Yield items, raising OperationCancelled once cancel is set or the store closes.
+
+        Long scans iterate through this so a caller (or shutdown) can stop them
+        partway; it checks every CANCEL_CHECK_INTERVAL items.
+        """
+        for count, item in enumerate(items):
+            if count % CANCEL_CHECK_INTERVAL == 0:
+                if self.closed:
+                    raise OperationCancelled("store closed")
+                if cancel is not None and cancel.is_set():
+                    raise OperationCancelled("operation cancelled")
+            yield item
+
+    def _range_keys(self, start: str, end: str, reverse: bool = False,
+                    offset: int = 0, limit: Optional[int] = None,
+                    cancel: Optional[threading.Event] = None) -> Iterator[str]:
+        """Yield live keys between start and end, in ascending order unless reverse.
+
+        Bounds are inclusive unless prefixed with "(" as in ZRANGEBYLEX. The
+        first offset matches are skipped and at most limit are yielded. Setting
+        cancel stops the scan with OperationCancelled.
+        """
+        if limit == 0:
+            return
+        produced = 0
         
+        start_exclusive = start.startswith("(")
+        end_exclusive = end.startswith("(")
+        if start_exclusive:
+            start = start[1:]
+        if end_exclusive:
+            end = end[1:]
+
         # Convert empty strings to None for open bounds
         start_key = start if start != "" else None
         end_key = end if end != "" else None
+
+        def in_bounds(key: str) -> bool:
+            if start_key is not None and (key <= start_key if start_exclusive else key < start_key):
+                return False
+            if end_key is not None and (key >= end_key if end_exclusive else key > end_key):
+                return False
+            return True
+
+        if self.transaction_buffer is not None:
+            # The BEGIN snapshot plus keys written in the transaction, resolved one by one
+            keys = {item[0] for item in self.session.snapshot}
+            keys.update(args[0] for _, args in self.transaction_buffer)
+            for key in self._checking(sorted(keys, reverse=reverse), cancel):
+                if not in_bounds(key):
+                    continue
+                if self._resolve(key) is None:
+                    continue
+                if offset > 0:
+                    offset -= 1
+                    continue
+                yield key
+                produced += 1
+                if limit is not None and produced == limit:
+                    return
+            return
         
-        for key, value, ttl in self.data:
-            # Check bounds
-            if start_key is not None and key < start_key:
-                continue
-            if end_key is not None and key > end_key:
+        # Start at the near bound rather than scanning up to it, so reading a range
+        # in chunks (iter_range) doesn't rescan the keys before each chunk
+        data = self.data
+        if reverse:
+            stop = len(data) if end_key is None else bisect.bisect_right(data, end_key, key=lambda item: item[0])
+            indexes = range(stop - 1, -1, -1)
+        else:
+            first = 0 if start_key is None else bisect.bisect_left(data, start_key, key=lambda item: item[0])
+            indexes = range(first, len(data))
+        far = start_key if reverse else end_key
+
+        current_time = self._now_ms()
+        for index in self._checking(indexes, cancel):
+            key, value, ttl = data[index]
+            if not in_bounds(key):
+                # Keys are sorted: once past the far bound, nothing else is in range
+                if far is not None and (key <= far if reverse else key >= far):
+                    return
                 continue
-            
+
             # Check if expired
-            current_time = time.time() * 1000
             if ttl is not None and current_time > ttl:
                 continue
-            
-            # Check transaction buffer for modifications
-            if self.transaction_buffer is not None:
-                key_in_txn = False
-                for op, args in reversed(self.transaction_buffer):
-                    if args[0] == key:
-                        if op == "DEL":
-                            key_in_txn = False
-                            break
-                        elif op == "SET":
-                            key_in_txn = True
-                            # Use the transaction value
-                            break
-                if not key_in_txn:
-                    continue
-            
+
+            if offset > 0:
+                offset -= 1
+                continue
+            yield key
+            produced += 1
+            if limit is not None and produced == limit:
+                return
+
+    @staticmethod
+    def _parse_range_options(options) -> Optional[Dict[str, int]]:
+        """Parse trailing LIMIT count / OFFSET n pairs, or None on a syntax error"""
+        parsed = {}
+        if len(options) % 2:
+            return None
+        for name, raw in zip(options[::2], options[1::2]):
+            name = name.upper()
+            if name not in ("LIMIT", "OFFSET"):
+                return None
+            try:
+                number = int(raw)
+            except ValueError:
+                return None
+            if number < 0:
+                return None
+            parsed[name.lower()] = number
+        return parsed
+
+    @_reads
+    def range(self, start: str, end: str, *options, cancel: Optional[threading.Event] = None) -> List[str]:
+        parsed = self._parse_range_options(options)
+        if parsed is None:
+            return [ErrorReply("ERR syntax error")]
+        return list(self._range_keys(start, end, cancel=cancel, **parsed)) + ["END"]
+
+    @_reads
+    def rangerev(self, start: str, end: str, *options, cancel: Optional[threading.Event] = None) -> List[str]:
+        """Like range, but from the highest key down"""
+        parsed = self._parse_range_options(options)
+        if parsed is None:
+            return [ErrorReply("ERR syntax error")]
+        return list(self._range_keys(start, end, reverse=True, cancel=cancel, **parsed)) + ["END"]
+
+    def iter_range(self, start: str = "", end: str = "", reverse: bool = False,
+                   cancel: Optional[threading.Event] = None) -> Iterator[str]:
+        """Iterate over the live keys RANGE start end (or RANGEREV) would return, without building the list.
+
+        Keys are read RANGE_ITER_CHUNK at a time, each chunk under the read lock,
+        and the lock isn't held while the caller handles them (so it may write
+        to the store meanwhile). Each chunk is consistent, but the iteration as
+        a whole is live rather than a snapshot: a change shows up if it lands
+        past the chunk already read, which may hold up to RANGE_ITER_CHUNK keys
+        the caller hasn't seen yet. Keys still come in order, each at most
+        once. The database is the session's at the call.
+        """
+        db = self.session.db
+
+        def chunks():
+            after_start, after_end = start, end
+            while True:
+                with self._using_db(db):
+                    keys = self._range_chunk(after_start, after_end, reverse, cancel)
+                yield from keys
+                if len(keys) < RANGE_ITER_CHUNK:
+                    return
+                # Resume just past the last key returned
+                if reverse:
+                    after_end = "(" + keys[-1]
+                else:
+                    after_start = "(" + keys[-1]
+        return chunks()
+
+    @_reads
+    def _range_chunk(self, start: str, end: str, reverse: bool,
+                     cancel: Optional[threading.Event]) -> List[str]:
+        return list(self._range_keys(start, end, reverse=reverse, limit=RANGE_ITER_CHUNK, cancel=cancel))
+
+    @_reads
+    def rangecount(self, start: str, end: str, cancel: Optional[threading.Event] = None) -> str:
+        """Number of live keys RANGE start end would return"""
+        return str(sum(1 for _ in self._range_keys(start, end, cancel=cancel)))
+
+    def _prefix_keys(self, prefix: str, cancel: Optional[threading.Event] = None) -> List[str]:
+        """Live keys starting with prefix, in sorted order"""
+        result = []
+
+        if self.transaction_buffer is not None:
+            keys = {item[0] for item in self.session.snapshot}
+            keys.update(args[0] for _, args in self.transaction_buffer)
+            for key in self._checking(sorted(keys), cancel):
+                if key.startswith(prefix) and self._resolve(key) is not None:
+                    result.append(key)
+            return result
+
+        # Keys sharing the prefix are contiguous, starting at the first key >= prefix
+        current_time = self._now_ms()
+        index = bisect.bisect_left(self.data, prefix, key=lambda item: item[0])
+        for key, value, ttl in self._checking(self.data[index:], cancel):
+            if not key.startswith(prefix):
+                break
+            if ttl is not None and current_time > ttl:
+                continue
             result.append(key)
-        
+        return result
+
+    @_reads
+    def prefix(self, prefix: str, cancel: Optional[threading.Event] = None) -> List[str]:
+        return self._prefix_keys(prefix, cancel) + ["END"]
+
+    def _pattern_keys(self, pattern: str, cancel: Optional[threading.Event] = None) -> List[str]:
+        """Live keys matching a glob pattern, scanning only those sharing its literal prefix"""
+        literal = re.match(r"[^*?\[\\]*", pattern).group()
+        return [key for key in self._prefix_keys(literal, cancel) if fnmatch.fnmatchcase(key, pattern)]
+
+    @_writes
+    def delpattern(self, pattern: str, cancel: Optional[threading.Event] = None) -> str:
+        """Delete every live key matching a glob pattern, returning how many were removed.
+
+        Only keys sharing the pattern's literal prefix (up to the first
+        wildcard) are scanned.
+        """
+        if pattern == "":
+            return ErrorReply("ERR pattern must not be empty")
+        matches = self._pattern_keys(pattern, cancel)  # Cancelling stops the scan before anything is deleted
+
+        if self.transaction_buffer is not None:
+            self.transaction_buffer.extend(("DEL", (key,)) for key in matches)
+            return str(len(matches))
+
+        for key in matches:
+            self._delete_key(key)
+        self._append_log([("DEL", key) for key in matches])
+        return str(len(matches))
+
+    @_writes
+    def expirepattern(self, pattern: str, milliseconds: str, cancel: Optional[threading.Event] = None) -> str:
+        """Give every live key matching a glob pattern the same TTL, returning how many were affected"""
+        if pattern == "":
+            return ErrorReply("ERR pattern must not be empty")
+        ms = _ttl_ms(milliseconds, 1)
+        if ms is None:
+            return ErrorReply("ERR invalid expire time")
+        # One expiry for every match, so they all lapse together
+        ttl = int(self._now_ms() + ms)
+        matches = self._pattern_keys(pattern, cancel)
+
+        if self.transaction_buffer is not None:
+            for key in matches:
+                self._expire_at(key, ttl)
+            return str(len(matches))
+
+        expired = ttl <= self._now_ms()
+        log_cmds = []
+        for key in matches:
+            if expired:
+                self._delete_key(key)
+                log_cmds.append(("DEL", key))
+            else:
+                self._set_ttl(self._find_key_index(key), ttl)
+                log_cmds.append(("PEXPIREAT", key, str(int(ttl))))
+        self._append_log(log_cmds)
+        return str(len(matches))
+
+    @_writes
+    def renameprefix(self, old_prefix: str, new_prefix: str, *flags) -> str:
+        replace = False
+        for flag in flags:
+            if flag.upper() != "REPLACE":
+                return ErrorReply("ERR syntax error")
+            replace = True
+
+        if self.transaction_buffer is not None:
+            return ErrorReply("ERR RENAMEPREFIX is not allowed inside a transaction")
+
+        # Snapshot the matching live keys before touching the store
+        now = self._now_ms()
+        moves = []
+        for key, value, ttl in self.data:
+            if key.startswith(old_prefix) and (ttl is None or now <= ttl):
+                moves.append((key, new_prefix + key[len(old_prefix):], value, ttl))
+
+        if old_prefix == new_prefix:
+            return str(len(moves))
+
+        # Fail before any write if a target outside the moved set is taken
+        sources = {key for key, _, _, _ in moves}
+        if not replace:
+            for _, target, _, _ in moves:
+                if target not in sources and self._get_key_index(target) != -1:
+                    return ErrorReply("ERR BUSYKEY target key name already exists")
+
+        log_cmds = []
+        for key, _, _, _ in moves:
+            self._delete_key(key)
+            log_cmds.append(("DEL", key))
+
+        for _, target, value, ttl in moves:
+            if self._delete_key(target):
+                log_cmds.append(("DEL", target))
+            self._set_key(target, value, ttl)
+            log_cmds.extend(self._entry_log_commands(target, value, ttl))
+        self._append_log(log_cmds)
+
+        return str(len(moves))
+
+    def _typed_entry(self, key: str, kind: type) -> Tuple[Any, Optional[str]]:
+        """Resolve a key expected to hold a container kind, returning (value, error).
+
+        A missing key reads as an empty container.
+        """
+        entry = self._resolve(key)
+        if entry is None:
+            return kind(), None
+        if not isinstance(entry[0], kind):
+            return None, WRONGTYPE_ERROR
+        return entry[0], None
+
+    def _push(self, cmd: str, key: str, elements) -> str:
+        items, error = self._typed_entry(key, list)
+        if error:
+            return error
+        items = _pushed(items, elements, cmd == "LPUSH")
+        self._write_value(key, items, (cmd, key, *elements))
+        return str(len(items))
+
+    def _pop(self, cmd: str, key: str) -> str:
+        items, error = self._typed_entry(key, list)
+        if error:
+            return error
+        if not items:
+            return "nil"
+        if cmd == "LPOP":
+            value, rest = items[0], items[1:]
+        else:
+            value, rest = items[-1], items[:-1]
+        self._write_value(key, rest, (cmd, key))
+        return value
+
+    @_writes
+    def lpush(self, key: str, *elements) -> str:
+        """Prepend elements one at a time, so LPUSH k a b leaves b first; returns the new length"""
+        return self._push("LPUSH", key, elements)
+
+    @_writes
+    def rpush(self, key: str, *elements) -> str:
+        return self._push("RPUSH", key, elements)
+
+    @_writes
+    def lpop(self, key: str) -> str:
+        return self._pop("LPOP", key)
+
+    @_writes
+    def rpop(self, key: str) -> str:
+        return self._pop("RPOP", key)
+
+    @_writes
+    def _pop_first(self, cmd: str, keys) -> Optional[List[str]]:
+        """Pop from the first non-empty list among keys as [key, element], or None if all are empty"""
+        for key in keys:
+            items, error = self._typed_entry(key, list)
+            if error:
+                return [error]
+            if items:
+                return [key, self._pop(cmd, key)]
+        return None
+
+    def _blocking_pop(self, cmd: str, keys, timeout: str) -> List[str]:
+        """Pop like _pop_first, waiting up to timeout seconds (0 waits forever) for a push.
+
+        The store lock isn't held while waiting. Inside a transaction, where
+        nothing else could push, the pop doesn't block.
+        """
+        try:
+            seconds = float(timeout)
+        except ValueError:
+            return [ErrorReply("ERR timeout is not a float or out of range")]
+        if not math.isfinite(seconds):
+            return [ErrorReply("ERR timeout is not a float or out of range")]
+        if seconds < 0:
+            return [ErrorReply("ERR timeout is negative")]
+
+        deadline = time.monotonic() + seconds if seconds else None
+        while True:
+            with self._list_ready:
+                seen = self._list_writes
+            popped = self._pop_first(cmd, keys)
+            if popped is not None:
+                return popped
+            if self.transaction_buffer is not None:
+                return ["nil"]
+
+            remaining = None if deadline is None else deadline - time.monotonic()
+            if remaining is not None and remaining <= 0:
+                return ["nil"]
+            with self._list_ready:
+                self._list_ready.wait_for(lambda: self._list_writes != seen or self.closed, remaining)
+            if self.closed:
+                return ["nil"]
+
+    def blpop(self, *args) -> List[str]:
+        """BLPOP key [key ...] timeout: LPOP the first non-empty list, blocking until one is pushed to"""
+        return self._blocking_pop("LPOP", args[:-1], args[-1])
+
+    def brpop(self, *args) -> List[str]:
+        return self._blocking_pop("RPOP", args[:-1], args[-1])
+
+    @_reads
+    def llen(self, key: str) -> str:
+        items, error = self._typed_entry(key, list)
+        return error or str(len(items))
+
+    @_reads
+    def lrange(self, key: str, start: str, stop: str) -> List[str]:
+        """Elements from index start to stop inclusive; negative indexes count from the end"""
+        try:
+            first, last = int(start), int(stop)
+        except ValueError:
+            return [ErrorReply("ERR value is not an integer")]
+
+        items, error = self._typed_entry(key, list)
+        if error:
+            return [error]
+        # Out-of-range indexes clamp to the list's bounds
+        begin, end = _clamp_range(len(items), first, last)
+        return items[begin:end] + ["END"]
+
+    @_writes
+    def hset(self, key: str, *pairs) -> str:
+        """Set field/value pairs, returning how many fields are new"""
+        if len(pairs) % 2:
+            return ErrorReply("ERR wrong number of arguments for HSET")
+        fields, error = self._typed_entry(key, dict)
+        if error:
+            return error
+
+        updated = dict(fields)
+        updated.update(zip(pairs[::2], pairs[1::2]))
+        self._write_value(key, updated, ("HSET", key, *pairs))
+        return str(len(updated) - len(fields))
+
+    @_reads
+    def hget(self, key: str, field: str) -> str:
+        fields, error = self._typed_entry(key, dict)
+        return error or fields.get(field, "nil")
+
+    @_writes
+    def hdel(self, key: str, *names) -> str:
+        """Remove fields, returning how many existed; removing the last field deletes the key"""
+        fields, error = self._typed_entry(key, dict)
+        if error:
+            return error
+
+        removed = [name for name in dict.fromkeys(names) if name in fields]
+        if not removed:
+            return "0"
+        remaining = {name: value for name, value in fields.items() if name not in removed}
+        self._write_value(key, remaining, ("HDEL", key, *removed))
+        return str(len(removed))
+
+    @_writes
+    def hincrby(self, key: str, field: str, delta: str) -> str:
+        """Add delta to an integer field (missing counts as 0), returning the new value"""
+        try:
+            increment = int(delta)
+        except ValueError:
+            return ErrorReply("ERR value is not an integer")
+        fields, error = self._typed_entry(key, dict)
+        if error:
+            return error
+        try:
+            current = int(fields.get(field, "0"))
+        except ValueError:
+            return ErrorReply("ERR hash value is not an integer")
+
+        result = current + increment
+        if not INT64_MIN <= result <= INT64_MAX:
+            return ErrorReply("ERR increment or decrement would overflow")
+        updated = dict(fields)
+        updated[field] = str(result)
+        # Log the resulting value so replay doesn't depend on re-applying the increment
+        self._write_value(key, updated, ("HSET", key, field, str(result)))
+        return str(result)
+
+    @_reads
+    def hgetall(self, key: str) -> List[str]:
+        """Alternating fields and values, in the order fields were first set"""
+        fields, error = self._typed_entry(key, dict)
+        if error:
+            return [error]
+        result = []
+        for field, value in fields.items():
+            result.extend((field, value))
+        result.append("END")
+        return result
+
+    @_writes
+    def sadd(self, key: str, *members) -> str:
+        """Add members, returning how many weren't already in the set"""
+        current, error = self._typed_entry(key, frozenset)
+        if error:
+            return error
+        added = [member for member in dict.fromkeys(members) if member not in current]
+        if added:
+            self._write_value(key, current.union(added), ("SADD", key, *added))
+        return str(len(added))
+
+    @_writes
+    def srem(self, key: str, *members) -> str:
+        """Remove members, returning how many were in the set"""
+        current, error = self._typed_entry(key, frozenset)
+        if error:
+            return error
+        removed = [member for member in dict.fromkeys(members) if member in current]
+        if removed:
+            self._write_value(key, current.difference(removed), ("SREM", key, *removed))
+        return str(len(removed))
+
+    @_reads
+    def sismember(self, key: str, member: str) -> str:
+        current, error = self._typed_entry(key, frozenset)
+        return error or ("1" if member in current else "0")
+
+    @_reads
+    def smembers(self, key: str) -> List[str]:
+        """Members in sorted order, so output is stable"""
+        current, error = self._typed_entry(key, frozenset)
+        if error:
+            return [error]
+        return sorted(current) + ["END"]
+
+    @_reads
+    def scard(self, key: str) -> str:
+        current, error = self._typed_entry(key, frozenset)
+        return error or str(len(current))
+
+    def _combine_sets(self, operation: str, keys) -> Tuple[Optional[frozenset], Optional[str]]:
+        """Combine the sets at keys with a frozenset method, returning (result, error); missing keys are empty sets"""
+        operands = []
+        for key in keys:
+            current, error = self._typed_entry(key, frozenset)
+            if error:
+                return None, error
+            operands.append(current)
+        return getattr(operands[0], operation)(*operands[1:]), None
+
+    def _set_algebra(self, operation: str, keys) -> List[str]:
+        result, error = self._combine_sets(operation, keys)
+        if error:
+            return [error]
+        return sorted(result) + ["END"]
+
+    def _set_algebra_store(self, operation: str, dest: str, keys) -> str:
+        """Store the combined sets at dest, replacing whatever it held (and its TTL); returns the size.
+
+        An empty result leaves dest deleted.
+        """
+        result, error = self._combine_sets(operation, keys)
+        if error:
+            return error
+
+        if self.transaction_buffer is not None:
+            self.transaction_buffer.append(("DEL", (dest,)))
+            if result:
+                self.transaction_buffer.append(("SET", (dest, result, None, False)))
+            return str(len(result))
+
+        log_cmds = []
+        if self._delete_key(dest):
+            log_cmds.append(("DEL", dest))
+        if result:
+            self._set_key(dest, result, None)
+            log_cmds.extend(self._entry_log_commands(dest, result, None))
+        self._append_log(log_cmds)
+        return str(len(result))
+
+    @_reads
+    def sinter(self, *keys) -> List[str]:
+        return self._set_algebra("intersection", keys)
+
+    @_reads
+    def sunion(self, *keys) -> List[str]:
+        return self._set_algebra("union", keys)
+
+    @_writes
+    def sinterstore(self, dest: str, *keys) -> str:
+        return self._set_algebra_store("intersection", dest, keys)
+
+    @_writes
+    def sunionstore(self, dest: str, *keys) -> str:
+        return self._set_algebra_store("union", dest, keys)
+
+    @_reads
+    def sdiff(self, *keys) -> List[str]:
+        """Members of the first set that are in none of the others"""
+        return self._set_algebra("difference", keys)
+
+    @_writes
+    def zadd(self, key: str, *pairs) -> str:
+        """Add score/member pairs or update existing scores, returning how many members are new"""
+        if len(pairs) % 2:
+            return ErrorReply("ERR syntax error")
+        try:
+            scores = [(member, float(score)) for score, member in zip(pairs[::2], pairs[1::2])]
+        except ValueError:
+            return ErrorReply("ERR value is not a valid float")
+        if any(score != score for _, score in scores):
+            return ErrorReply("ERR value is not a valid float")  # NaN can't be ordered
+
+        current, error = self._typed_entry(key, SortedSet)
+        if error:
+            return error
+        added = sum(1 for member in dict(scores) if member not in current.scores)
+        entries = [token for member, score in scores for token in (_format_score(score), member)]
+        self._write_value(key, current.added(scores), ("ZADD", key, *entries))
+        return str(added)
+
+    @_reads
+    def zscore(self, key: str, member: str) -> str:
+        current, error = self._typed_entry(key, SortedSet)
+        if error:
+            return error
+        score = current.scores.get(member)
+        return "nil" if score is None else _format_score(score)
+
+    @_reads
+    def zrange(self, key: str, start: str, stop: str, *flags) -> List[str]:
+        """Members by rank in ascending score order; WITHSCORES follows each with its score"""
+        with_scores = False
+        for flag in flags:
+            if flag.upper() != "WITHSCORES":
+                return [ErrorReply("ERR syntax error")]
+            with_scores = True
+        try:
+            first, last = int(start), int(stop)
+        except ValueError:
+            return [ErrorReply("ERR value is not an integer")]
+
+        current, error = self._typed_entry(key, SortedSet)
+        if error:
+            return [error]
+        begin, end = _clamp_range(len(current), first, last)
+        result = []
+        for score, member in current.ordered[begin:end]:
+            result.append(member)
+            if with_scores:
+                result.append(_format_score(score))
         result.append("END")
         return result
 
+    @_reads
+    def dump(self, key: str) -> str:
+        """Serialize a key's value and expiry into an opaque blob for RESTORE"""
+        entry = self._resolve(key)
+        if entry is None:
+            return "nil"
+        return _encode_dump(entry[0], entry[1])
+
+    @_writes
+    def restore(self, key: str, ttl: str, blob: str, *flags) -> str:
+        """Recreate a key from a DUMP blob.
+
+        A positive ttl (ms) replaces the dumped expiry; 0 keeps it. The key must
+        not exist unless REPLACE is given. An expiry already in the past leaves
+        the key absent.
+        """
+        replace = False
+        for flag in flags:
+            if flag.upper() != "REPLACE":
+                return ErrorReply("ERR syntax error")
+            replace = True
+        try:
+            ttl_ms = int(ttl)
+        except ValueError:
+            return ErrorReply("ERR value is not an integer")
+        if ttl_ms < 0:
+            return ErrorReply("ERR Invalid TTL value, must be >= 0")
+        try:
+            value, expires_at = _decode_dump(blob)
+        except ValueError:
+            return ErrorReply("ERR DUMP payload version or checksum are wrong")
+
+        if self._resolve(key) is not None and not replace:
+            return ErrorReply("ERR BUSYKEY Target key name already exists.")
+        if ttl_ms > 0:
+            expires_at = int(self._now_ms() + ttl_ms)
+        expired = expires_at is not None and expires_at <= self._now_ms()
+
+        if self.transaction_buffer is not None:
+            self.transaction_buffer.append(("DEL", (key,)))
+            if not expired:
+                self.transaction_buffer.append(("SET", (key, value, None, False)))
+                if expires_at is not None:
+                    self.transaction_buffer.append(("EXPIRE", (key, expires_at)))
+            return "OK"
+
+        log_cmds = []
+        if self._delete_key(key):
+            log_cmds.append(("DEL", key))
+        if not expired:
+            self._set_key(key, value, expires_at)
+            log_cmds.extend(self._entry_log_commands(key, value, expires_at))
+        self._append_log(log_cmds)
+        return "OK"
+
+    @_writes
+    def import_from(self, lines: Iterable[str]) -> int:
+        """Set a key for each line of lines (see _parse_import_line), returning the number set.
+
+        Every line is parsed before anything is written; if any is malformed,
+        ImportFormatError lists them all and nothing is imported. Like the DENYOOM
+        commands it evicts to make room under maxmemory and maxkeys, and raises
+        ValueError, importing nothing, if it can't. The keys are
+        applied under one write lock acquisition and logged as one batch with a
+        single fsync, replacing any value and TTL the keys had. Lines whose
+        expiry has passed are skipped, and blank lines ignored.
+        """
+        if self.transaction_buffer is not None:
+            raise ValueError("IMPORT is not allowed inside a transaction")
+        entries, errors = [], []
+        for line_no, line in enumerate(lines, 1):
+            line = line.rstrip("\r\n")
+            if not line:
+                continue
+            try:
+                entries.append(_parse_import_line(line))
+            except ValueError as e:
+                errors.append((line_no, str(e)))
+        if errors:
+            raise ImportFormatError(errors)
+
+        if self.nocase_keys:
+            entries = [(key.lower(), value, expires_at) for key, value, expires_at in entries]
+        # The same room-making as DENYOOM commands get, under the same lock as the writes
+        error = (self.free_memory(sum(_entry_size(*entry) for entry in entries))
+                 or self.reserve_keys([key for key, _, _ in entries]))
+        if error:
+            raise ValueError(error[len("ERR "):])
+
+        now = self._now_ms()
+        log_cmds = []
+        count = 0
+        for key, value, expires_at in entries:
+            self._get_key_index(key)  # Drop an expired key, so its DEL is logged first
+            if self._delete_key(key):
+                log_cmds.append(("DEL", key))
+            if expires_at is not None and expires_at <= now:
+                continue
+            self._set_key(key, value, expires_at)
+            log_cmds.extend(self._entry_log_commands(key, value, expires_at))
+            count += 1
+        self._append_log(log_cmds)
+        return count
+
+    @_reads
+    def _live_entries(self) -> List[Tuple[str, Any, Optional[float]]]:
+        """The session database's unexpired (key, value, ttl) entries, copied under the read lock"""
+        now = self._now_ms()
+        return [(key, _expanded(value), ttl) for key, value, ttl in self.data if ttl is None or now <= ttl]
+
+    def export_to(self, out, as_json: bool = False) -> int:
+        """Write a line import_from reads back for each live key to the text stream out,
+        returning the number of keys written.
+
+        The keys are those of the session's database, as committed when the export
+        starts; the store lock isn't held while writing. Expiries are absolute, so
+        an exported key expires at the same moment wherever it's imported.
+
+        With as_json, out gets a JSON object instead, mapping each key to
+        {"type", "value", "expiresAt"}: the TYPE name, the value (see
+        _json_value) and the expiry in ms since the epoch or null. Bytes that
+        aren't UTF-8 come out as \\udcXX escapes, which most decoders turn into
+        replacement characters. import_from doesn't read it.
+        """
+        entries = self._live_entries()
+        if not as_json:
+            for key, value, ttl in entries:
+                out.write(_format_export_line(key, value, ttl) + "\n")
+            return len(entries)
+
+        out.write("{")
+        for i, (key, value, ttl) in enumerate(entries):
+            record = {"type": _type_name(value), "value": _json_value(value),
+                      "expiresAt": None if ttl is None else int(ttl)}
+            out.write(("," if i else "") + "\n" + json.dumps(key) + ": " + json.dumps(record))
+        out.write("\n}\n" if entries else "}\n")
+        return len(entries)
+
+    def debug(self, subcommand: str, *args) -> str:
+        sub = subcommand.upper()
+        if sub == "SLEEP" and len(args) == 1:
+            return self.debug_sleep(args[0])
+        if sub == "OBJECT" and len(args) == 1:
+            return self.debug_object(args[0])
+        if sub == "EQUAL" and len(args) in (2, 3):
+            with_ttl = False
+            if len(args) == 3:
+                if args[2].upper() != "WITHTTL":
+                    return ErrorReply("ERR syntax error")
+                with_ttl = True
+            return self.debug_equal(args[0], args[1], with_ttl)
+        return ErrorReply("ERR unknown DEBUG subcommand or wrong number of arguments")
+
+    def debug_sleep(self, milliseconds: str) -> str:
+        """Block the calling client for a while without holding the store lock"""
+        try:
+            ms = float(milliseconds)
+        except ValueError:
+            return ErrorReply("ERR value is not a valid float")
+        if ms < 0:
+            return ErrorReply("ERR invalid sleep time")
+        time.sleep(ms / 1000)
+        return "OK"
+
+    @_reads
+    def debug_object(self, key: str) -> str:
+        """Internal details of a key's entry on one line; like OBJECT, this isn't an access"""
+        index = self._find_key_index(key)
+        if index == -1 or self._is_expired(index):
+            return ErrorReply("ERR no such key")
+        _, value, ttl = self.data[index]
+        pttl = -1 if ttl is None else max(0, int(ttl - self._now_ms()))
+        last_access = self.last_access.get(key)
+        last_access_ms = -1 if last_access is None else int(last_access * 1000)
+        return (f"type:{_type_name(value)} length:{len(_expanded(value))} volatile:{int(ttl is not None)} "
+                f"pttl:{pttl} last_access_ms:{last_access_ms} size:{_entry_size(key, value, ttl)}")
+
+    @_reads
+    def debug_equal(self, key1: str, key2: str, with_ttl: bool = False) -> str:
+        first = self._resolve(key1)
+        second = self._resolve(key2)
+
+        # Two missing keys hold the same (absent) value
+        if first is None or second is None:
+            return "1" if first is None and second is None else "0"
+
+        if not self._values_equal(first[0], second[0]):
+            return "0"
+        if with_ttl and first[1] != second[1]:
+            return "0"
+        return "1"
+
+    @_reads
+    def type_command(self, key: str) -> str:
+        """Name of the type of value key holds, or none if it doesn't exist"""
+        entry = self._resolve(key)
+        return "none" if entry is None else _type_name(entry[0])
+
+    @_reads
+    def object_command(self, subcommand: str, *args) -> str:
+        """OBJECT IDLETIME|FREQ|MTIME key; inspecting a key doesn't count as an access.
+
+        MTIME is the Unix time in ms of the key's last change, value or TTL.
+        """
+        sub = subcommand.upper()
+        if sub not in ("IDLETIME", "FREQ", "MTIME") or len(args) != 1:
+            return ErrorReply("ERR unknown OBJECT subcommand or wrong number of arguments")
+
+        key = args[0]
+        index = self._find_key_index(key)
+        if index == -1 or self._is_expired(index):
+            return ErrorReply("ERR no such key")
+        if sub == "IDLETIME":
+            now = self.clock()
+            return str(int(now - self.last_access.get(key, now)))
+        if sub == "MTIME":
+            return str(int(self.modified.get(key, self.start_time) * 1000))
+        if not self.track_frequency:
+            return ErrorReply("ERR access frequency is not tracked; start with --lfu")
+        return str(self.access_counts.get(key, 0))
+
+    @_reads
+    def memory(self, subcommand: str, *args) -> str:
+        if subcommand.upper() == "USAGE" and len(args) == 1:
+            return self.memory_usage(args[0])
+        return ErrorReply("ERR unknown MEMORY subcommand or wrong number of arguments")
+
+    @_reads
+    def memory_usage(self, key: str) -> str:
+        """Approximate bytes held by a key, as estimated by _entry_size"""
+        entry = self._resolve(key)
+        if entry is None:
+            return "nil"
+
+        return str(_entry_size(key, entry[0], entry[1]))
+
+
+class CommandSpec(NamedTuple):
+    """How execute_command runs a command"""
+    handler: Callable[[KVStore, List[str]], Optional[List[str]]]  # Returns response lines, None for EXIT
+    arity: int  # Minimum number of arguments
+    max_arity: Optional[int] = None  # Maximum number of arguments; None for variadic commands
+    write: bool = False  # Changes the store or its log, so a read-only replica rejects it
+
+
+def _command_list(store: KVStore, args: List[str]) -> List[str]:
+    return [f"{name} {spec.arity}" for name, spec in sorted(COMMAND_TABLE.items())] + ["END"]
+
+
+def _compact(store: KVStore, args: List[str]) -> List[str]:
+    store.compact()
+    return ["OK"]
+
+
+def _transfer_path(store: KVStore, name: str) -> str:
+    """The path of file name in the store's transfer_dir, for IMPORT and EXPORT.
+
+    Only a bare file name is accepted, so clients can't reach files elsewhere
+    on the server.
+    """
+    if store.transfer_dir is None:
+        raise ValueError("file transfer is disabled, start the server with --transfer-dir")
+    separators = {os.sep, os.altsep, "/"} - {None}
+    if name in ("", ".", "..") or any(sep in name for sep in separators) or "\0" in name:
+        raise ValueError(f"invalid file name {name!r}, expected a bare name in the transfer directory")
+    return os.path.join(store.transfer_dir, name)
+
+
+def _import(store: KVStore, args: List[str]) -> List[str]:
+    """IMPORT name: import_from a file in the transfer directory, replying with the number of keys set"""
+    path = _transfer_path(store, args[0])
+    try:
+        with open(path, encoding="utf-8", errors=TEXT_ERRORS, newline="\n") as f:
+            return [str(store.import_from(f))]
+    except ImportFormatError as e:
+        reasons = "; ".join(f"line {line_no}: {reason}" for line_no, reason in e.errors[:5])
+        more = f" (and {len(e.errors) - 5} more)" if len(e.errors) > 5 else ""
+        return [ErrorReply(f"ERR nothing imported, {reasons}{more}")]
+    except OSError as e:
+        return [ErrorReply(f"ERR can't read {args[0]}: {e.strerror}")]
+
+
+def _export(store: KVStore, args: List[str]) -> List[str]:
+    """EXPORT name [JSON]: export_to a file in the transfer directory, replacing it only once
+    it's complete. It's a write command since it writes a file, so replicas refuse it."""
+    if len(args) == 2 and args[1].upper() != "JSON":
+        return [ErrorReply("ERR syntax error")]
+    path = _transfer_path(store, args[0])
+    tmp_path = path + ".tmp"
+    try:
+        with open(tmp_path, "w", encoding="utf-8", errors=TEXT_ERRORS, newline="\n") as f:
+            count = store.export_to(f, as_json=len(args) == 2)
+        os.replace(tmp_path, path)
+    except BaseException as e:
+        # Whatever stopped it, a partial export isn't left in the transfer directory
+        with contextlib.suppress(OSError):
+            os.remove(tmp_path)
+        if isinstance(e, OSError):
+            return [ErrorReply(f"ERR can't write {args[0]}: {e.strerror}")]
+        raise
+    return [str(count)]
+
+
+def _set_command(store: KVStore, args: List[str]) -> List[str]:
+    """SET key value [KEEPTTL]; an unquoted value may span several arguments.
+
+    SET clears the key's TTL unless KEEPTTL is given, as in Redis.
+    """
+    words = args[1:]
+    keep_ttl = len(words) > 1 and words[-1].upper() == "KEEPTTL"
+    if keep_ttl:
+        words = words[:-1]
+    return [store.set(args[0], " ".join(words), keep_ttl)]
+
+
+def _snapshot(store: KVStore, args: List[str]) -> List[str]:
+    store.save_snapshot()
+    return ["OK"]
+
+
+# Every command execute_command dispatches; anything else counts as unknown in COMMANDSTATS.
+# Writes inside a transaction are rejected as they're queued, so COMMIT isn't a write
+COMMAND_TABLE = {
+    "ABORT": CommandSpec(lambda store, args: [store.abort()], 0, 0),
+    "AUTH": CommandSpec(lambda store, args: [store.auth(*args)], 1, 1),
+    "BEGIN": CommandSpec(lambda store, args: [store.begin()], 0, 0),
+    "BLPOP": CommandSpec(lambda store, args: store.blpop(*args), 2, write=True),
+    "BRPOP": CommandSpec(lambda store, args: store.brpop(*args), 2, write=True),
+    "CAD": CommandSpec(lambda store, args: [store.cad(args[0], " ".join(args[1:]))], 2, write=True),
+    "CAS": CommandSpec(
+        lambda store, args: [store.cas(args[0], args[1], " ".join(args[2:]))], 3, write=True),
+    "COMMAND": CommandSpec(_command_list, 0, 0),
+    "COMMANDSTATS": CommandSpec(lambda store, args: store.commandstats(), 0, 0),
+    "COMMIT": CommandSpec(lambda store, args: [store.commit()], 0, 0),
+    "COMPACT": CommandSpec(_compact, 0, 0, write=True),
+    "DEBUG": CommandSpec(lambda store, args: [store.debug(*args)], 1),
+    "DEL": CommandSpec(lambda store, args: [store.delete(*args)], 1, 1, write=True),
+    "DELPATTERN": CommandSpec(lambda store, args: [store.delpattern(*args)], 1, 1, write=True),
+    "DUMP": CommandSpec(lambda store, args: [store.dump(*args)], 1, 1),
+    "ECHO": CommandSpec(lambda store, args: [" ".join(args)], 1),
+    "EXISTS": CommandSpec(lambda store, args: [store.exists(*args)], 1, 1),
+    "EXIT": CommandSpec(lambda store, args: None, 0),
+    "EXPIRE": CommandSpec(lambda store, args: [store.expire(*args)], 2, write=True),
+    "EXPIREAT": CommandSpec(lambda store, args: [store.expireat(*args)], 2, write=True),
+    "EXPIREPATTERN": CommandSpec(lambda store, args: [store.expirepattern(*args)], 2, 2, write=True),
+    "EXPIRETIME": CommandSpec(lambda store, args: [store.expiretime(*args)], 1, 1),
+    "EXPORT": CommandSpec(_export, 1, 2, write=True),
+    "GET": CommandSpec(lambda store, args: [store.get(*args)], 1, 1),
+    "GETEX": CommandSpec(lambda store, args: [store.getex(*args)], 1),
+    "GETIFNEWER": CommandSpec(lambda store, args: [store.getifnewer(*args)], 2, 2),
+    "GETRANGE": CommandSpec(lambda store, args: [store.getrange(*args)], 3, 3),
+    "HDEL": CommandSpec(lambda store, args: [store.hdel(*args)], 2, write=True),
+    "HGET": CommandSpec(lambda store, args: [store.hget(*args)], 2, 2),
+    "HGETALL": CommandSpec(lambda store, args: store.hgetall(*args), 1, 1),
+    "HINCRBY": CommandSpec(lambda store, args: [store.hincrby(*args)], 3, 3, write=True),
+    "HSET": CommandSpec(lambda store, args: [store.hset(*args)], 3, write=True),
+    "IMPORT": CommandSpec(_import, 1, 1, write=True),
+    "INFO": CommandSpec(lambda store, args: store.info(), 0, 0),
+    "LLEN": CommandSpec(lambda store, args: [store.llen(*args)], 1, 1),
+    "LPOP": CommandSpec(lambda store, args: [store.lpop(*args)], 1, 1, write=True),
+    "LPUSH": CommandSpec(lambda store, args: [store.lpush(*args)], 2, write=True),
+    "LRANGE": CommandSpec(lambda store, args: store.lrange(*args), 3, 3),
+    "MEMORY": CommandSpec(lambda store, args: [store.memory(*args)], 1),
+    "MGET": CommandSpec(lambda store, args: store.mget(*args), 1),
+    "MOVE": CommandSpec(lambda store, args: [store.move(*args)], 2, 2, write=True),
+    "MSET": CommandSpec(lambda store, args: [store.mset(*args)], 2, write=True),
+    "MSETNX": CommandSpec(lambda store, args: [store.msetnx(*args)], 2, write=True),
+    "OBJECT": CommandSpec(lambda store, args: [store.object_command(*args)], 1),
+    "PERSIST": CommandSpec(lambda store, args: [store.persist(*args)], 1, 1, write=True),
+    "PEXPIRE": CommandSpec(lambda store, args: [store.pexpire(*args)], 2, write=True),
+    "PEXPIREAT": CommandSpec(lambda store, args: [store.pexpireat(*args)], 2, write=True),
+    "PEXPIRETIME": CommandSpec(lambda store, args: [store.pexpiretime(*args)], 1, 1),
+    "PING": CommandSpec(lambda store, args: [" ".join(args) if args else "PONG"], 0),
+    "PREFIX": CommandSpec(lambda store, args: store.prefix(*args), 1, 1),
+    "PSETEX": CommandSpec(
+        lambda store, args: [store.psetex(args[0], args[1], " ".join(args[2:]))],
+        3, write=True),
+    "PTTL": CommandSpec(lambda store, args: [store.pttl(*args)], 1, 1),
+    "PUBLISH": CommandSpec(lambda store, args: [store.publish(args[0], " ".join(args[1:]))], 2),
+    "RANGE": CommandSpec(lambda store, args: store.range(*args), 2),
+    "RANGECOUNT": CommandSpec(lambda store, args: [store.rangecount(*args)], 2, 2),
+    "RANGEREV": CommandSpec(lambda store, args: store.rangerev(*args), 2),
+    "RENAMEPREFIX": CommandSpec(lambda store, args: [store.renameprefix(*args)], 2, write=True),
+    "RESTORE": CommandSpec(lambda store, args: [store.restore(*args)], 3, write=True),
+    "RPOP": CommandSpec(lambda store, args: [store.rpop(*args)], 1, 1, write=True),
+    "RPUSH": CommandSpec(lambda store, args: [store.rpush(*args)], 2, write=True),
+    "SADD": CommandSpec(lambda store, args: [store.sadd(*args)], 2, write=True),
+    "SCARD": CommandSpec(lambda store, args: [store.scard(*args)], 1, 1),
+    "SDIFF": CommandSpec(lambda store, args: store.sdiff(*args), 1),
+    "SELECT": CommandSpec(lambda store, args: [store.select(*args)], 1, 1),
+    "SET": CommandSpec(_set_command, 2, write=True),
+    "SETEX": CommandSpec(
+        lambda store, args: [store.setex(args[0], args[1], " ".join(args[2:]))],
+        3, write=True),
+    "SETRANGE": CommandSpec(
+        lambda store, args: [store.setrange(args[0], args[1], " ".join(args[2:]))],
+        3, write=True),
+    "SINTER": CommandSpec(lambda store, args: store.sinter(*args), 1),
+    "SINTERSTORE": CommandSpec(lambda store, args: [store.sinterstore(*args)], 2, write=True),
+    "SISMEMBER": CommandSpec(lambda store, args: [store.sismember(*args)], 2, 2),
+    "SLOWLOG": CommandSpec(lambda store, args: store.slowlog_command(*args), 1),
+    "SMEMBERS": CommandSpec(lambda store, args: store.smembers(*args), 1, 1),
+    "SNAPSHOT": CommandSpec(_snapshot, 0, 0, write=True),
+    "SREM": CommandSpec(lambda store, args: [store.srem(*args)], 2, write=True),
+    "SUBSCRIBE": CommandSpec(lambda store, args: store.subscribe(*args), 1),
+    "SUNION": CommandSpec(lambda store, args: store.sunion(*args), 1),
+    "SUNIONSTORE": CommandSpec(lambda store, args: [store.sunionstore(*args)], 2, write=True),
+    "SWAPDB": CommandSpec(lambda store, args: [store.swapdb(*args)], 2, 2, write=True),
+    "TTL": CommandSpec(lambda store, args: [store.ttl(*args)], 1, 1),
+    "TXSTATUS": CommandSpec(lambda store, args: store.txstatus(), 0, 0),
+    "TYPE": CommandSpec(lambda store, args: [store.type_command(*args)], 1, 1),
+    "UNSUBSCRIBE": CommandSpec(lambda store, args: store.unsubscribe(*args), 0),
+    "UNWATCH": CommandSpec(lambda store, args: [store.unwatch()], 0, 0),
+    "WAIT": CommandSpec(lambda store, args: [store.wait(*args)], 2, 2),
+    "WATCH": CommandSpec(lambda store, args: [store.watch(*args)], 1),
+    "ZADD": CommandSpec(lambda store, args: [store.zadd(*args)], 3, write=True),
+    "ZRANGE": CommandSpec(lambda store, args: store.zrange(*args), 3),
+    "ZSCORE": CommandSpec(lambda store, args: [store.zscore(*args)], 2, 2),
+}
+
+# Redis names for commands, run as (and reported as) the command they stand for
+COMMAND_ALIASES = {"MULTI": "BEGIN", "DISCARD": "ABORT"}
+
+
+# Commands that can grow the dataset; with maxmemory or maxkeys set they evict first and
+# fail if the store still can't make room
+DENYOOM_COMMANDS = frozenset({
+    "CAS", "COMMIT", "HINCRBY", "HSET", "LPUSH", "MSET", "MSETNX", "PSETEX", "RESTORE", "RPUSH",
+    "SADD", "SET", "SETEX", "SETRANGE", "SINTERSTORE", "SUNIONSTORE", "ZADD",
+})
+
+
+# Which arguments of each command name keys (or key bounds, prefixes and patterns),
+# lowercased under nocase_keys
+KEY_ARGUMENTS = {
+    **dict.fromkeys((
+        "CAD", "CAS", "DEL", "DELPATTERN", "DUMP", "EXISTS", "EXPIRE", "EXPIREAT", "EXPIREPATTERN",
+        "EXPIRETIME", "GET", "GETEX", "GETIFNEWER", "GETRANGE", "HDEL", "HGET", "HGETALL", "HINCRBY",
+        "HSET", "LLEN", "LPOP", "LPUSH", "LRANGE", "MOVE", "PERSIST", "PEXPIRE", "PEXPIREAT",
+        "PEXPIRETIME", "PREFIX", "PSETEX", "PTTL", "RESTORE", "RPOP", "RPUSH", "SADD", "SCARD", "SET",
+        "SETEX", "SETRANGE", "SISMEMBER", "SMEMBERS", "SREM", "TTL", "TYPE", "ZADD", "ZRANGE", "ZSCORE",
+    ), slice(0, 1)),
+    **dict.fromkeys(("RANGE", "RANGECOUNT", "RANGEREV", "RENAMEPREFIX"), slice(0, 2)),
+    **dict.fromkeys(("MGET", "SDIFF", "SINTER", "SINTERSTORE", "SUNION", "SUNIONSTORE", "WATCH"), slice(None)),
+    **dict.fromkeys(("MSET", "MSETNX"), slice(None, None, 2)),
+    **dict.fromkeys(("BLPOP", "BRPOP"), slice(0, -1)),
+    **dict.fromkeys(("MEMORY", "OBJECT"), slice(1, 2)),
+    "DEBUG": slice(1, 3),  # DEBUG OBJECT key, DEBUG EQUAL a b
+}
+
+
+def _fold_keys(cmd: str, args: List[str]) -> List[str]:
+    """args with cmd's key arguments lowercased"""
+    positions = KEY_ARGUMENTS.get(cmd)
+    if positions is None:
+        return args
+    folded = list(args)
+    for index in range(len(args))[positions]:
+        folded[index] = args[index].lower()
+    return folded
+
+
+def _written_keys(store: KVStore, cmd: str, args: List[str]) -> List[str]:
+    """Keys a DENYOOM command may create, for the maxkeys check"""
+    if cmd in ("MSET", "MSETNX"):
+        return args[::2]
+    if cmd == "COMMIT":
+        return [op_args[0] for op, op_args in store.transaction_buffer or [] if op == "SET"]
+    return args[:1]
+
+
+def process_command(store: KVStore, line: str) -> Optional[List[str]]:
+    """Execute one protocol line, returning its response lines or None for EXIT.
+
+    Arguments may be quoted (see split_args) to hold spaces, newlines or any bytes.
+    """
+    try:
+        parts = split_args(line)
+    except ValueError as e:
+        return [ErrorReply(f"ERR Protocol error: {e}")]
+    return execute_command(store, parts)
+
+
+def process_batch(store: KVStore, lines: List[str]) -> List[Optional[List[str]]]:
+    """Execute protocol lines in order, returning each one's response lines.
+
+    An EXIT line gets None and ends the batch; the lines after it aren't run.
+    Other clients' commands may interleave with the batch's; wrap it in
+    BEGIN/COMMIT to apply its writes atomically.
+    """
+    results = []
+    for line in lines:
+        responses = process_command(store, line)
+        results.append(responses)
+        if responses is None:
+            break
+    return results
+
+
+def open_store(path: str = "data.db", **options) -> KVStore:
+    """Open the store logged at path (creating it on the first write), for use as a library.
+
+        store = open_store("/var/lib/app/kvs.db")
+        store.execute("SET greeting hello")  # ["OK"]
+        store.get("greeting")                 # "hello"
+        store.close()
+
+    options are KVStore's keyword arguments. The files are the ones the CLI
+    writes, so either can open a store the other made (though not at once).
+    """
+    return KVStore(path=path, **options)
+
+
+class TypedStore:
+    """Python-typed access to a KVStore's string values, for library callers.
+
+    Each method runs the matching command method, so it takes the same locks
+    and logs the same entries. Error replies are raised as CommandError. Keys
+    are lowercased under nocase_keys, as execute_command does.
+    """
+
+    def __init__(self, store: KVStore):
+        self.store = store
+
+    @staticmethod
+    def _checked(reply: str) -> str:
+        if isinstance(reply, ErrorReply):
+            raise CommandError(reply[len("ERR "):])
+        return reply
+
+    def _key(self, key: str) -> str:
+        return key.lower() if self.store.nocase_keys else key
+
+    @staticmethod
+    def _milliseconds(ttl: timedelta) -> str:
+        ms = int(ttl / timedelta(milliseconds=1))
+        if ms <= 0:
+            raise ValueError("ttl must be positive")
+        return str(ms)
+
+    def set(self, key: str, value: str, ttl: Optional[timedelta] = None):
+        """Set key to value, expiring after ttl; without one, any TTL the key had is cleared (like SET)"""
+        key = self._key(key)
+        if ttl is None:
+            self._checked(self.store.set(key, value))
+        else:
+            self._checked(self.store.psetex(key, self._milliseconds(ttl), value))
+
+    def get(self, key: str) -> Optional[str]:
+        """The key's value, or None if it doesn't exist"""
+        key = self._key(key)
+        value = self._checked(self.store.get(key))
+        # "nil" is also a legal stored value, so confirm the key is really missing
+        if value == "nil" and self.store.exists(key) == "0":
+            return None
+        return value
+
+    def delete(self, key: str) -> bool:
+        """Delete the key, returning whether it existed"""
+        return self._checked(self.store.delete(self._key(key))) == "1"
+
+    def expire(self, key: str, ttl: timedelta) -> bool:
+        """Expire the key after ttl, returning False if it doesn't exist"""
+        return self._checked(self.store.pexpire(self._key(key), self._milliseconds(ttl))) == "1"
+
+    def ttl(self, key: str) -> Optional[timedelta]:
+        """Time until the key expires, or None if it has no TTL; raises KeyError if it doesn't exist"""
+        remaining = int(self._checked(self.store.pttl(self._key(key))))
+        if remaining == -2:
+            raise KeyError(key)
+        return None if remaining == -1 else timedelta(milliseconds=remaining)
+
+
+def execute_command(store: KVStore, parts: List[str]) -> Optional[List[str]]:
+    """Execute an already tokenized command, returning its response lines or None for EXIT"""
+    if not parts:
+        return []
+
+    cmd = parts[0].upper()
+    cmd = COMMAND_ALIASES.get(cmd, cmd)
+    args = parts[1:]
+    spec = COMMAND_TABLE.get(cmd)
+
+    if store.closed:
+        return [ErrorReply("ERR server is shutting down")]
+
+    if not store.is_authenticated() and cmd not in ("AUTH", "EXIT"):
+        return [ErrorReply("ERR NOAUTH Authentication required")]
+    # Counted once past authentication, so unauthenticated clients can't inflate the stats
+    store.record_command(cmd if spec else None)
+
+    if spec is None:
+        return [ErrorReply("ERR invalid command or arguments")]
+    if spec.max_arity is not None and len(args) > spec.max_arity and not store.strict_arity:
+        args = args[:spec.max_arity]
+    if len(args) < spec.arity or (spec.max_arity is not None and len(args) > spec.max_arity):
+        return [ErrorReply(f"ERR wrong number of arguments for {cmd}")]
+    if store.nocase_keys:
+        args = _fold_keys(cmd, args)
+
+    # GETEX only writes when it changes the TTL
+    if store.readonly and (spec.write or (cmd == "GETEX" and len(args) > 1)):
+        return [READONLY_ERROR]
+
+    if cmd in DENYOOM_COMMANDS:
+        error = (store.free_memory(sum(sys.getsizeof(arg) for arg in args))
+                 or store.reserve_keys(_written_keys(store, cmd, args)))
+        if error:
+            return [error]
+
+    started = time.perf_counter()
+    try:
+        responses = spec.handler(store, args)
+    except Exception as e:
+        responses = [ErrorReply(f"ERR {str(e)}")]
+    store.record_duration(parts, int((time.perf_counter() - started) * 1_000_000))
+    return responses
+
+
+# RESP reply types by command; anything not listed replies with a simple string
+RESP_INTEGER_REPLIES = {
+    "DEL", "EXISTS", "EXPIRE", "PEXPIRE", "EXPIREAT", "PEXPIREAT", "TTL", "PTTL",
+    "EXPIRETIME", "PEXPIRETIME", "PERSIST", "RENAMEPREFIX", "DEBUG", "MEMORY", "OBJECT",
+    "DELPATTERN", "RANGECOUNT", "LPUSH", "RPUSH", "LLEN", "HSET", "HDEL", "HINCRBY",
+    "SADD", "SREM", "SISMEMBER", "SCARD", "ZADD", "MOVE", "CAS", "CAD",
+    "EXPIREPATTERN", "PUBLISH", "MSETNX", "SINTERSTORE", "SUNIONSTORE", "SETRANGE", "WAIT",
+    "IMPORT", "EXPORT",
+}
+RESP_BULK_REPLIES = {"GET", "GETEX", "GETIFNEWER", "GETRANGE", "LPOP", "RPOP", "HGET", "ZSCORE", "DUMP", "ECHO"}
+RESP_ARRAY_REPLIES = {
+    "MGET", "LRANGE", "HGETALL", "SMEMBERS", "SINTER", "SUNION", "SDIFF", "PREFIX",
+    "ZRANGE", "RANGE", "RANGEREV", "INFO", "COMMAND", "COMMANDSTATS", "SLOWLOG",
+    "BLPOP", "BRPOP", "TXSTATUS",
+}
+
+
+def _resp_bulk(value: str) -> bytes:
+    if value == "nil":
+        return b"$-1\r\n"
+    data = value.encode("utf-8", TEXT_ERRORS)
+    return b"$%d\r\n%s\r\n" % (len(data), data)
+
+
+def _resp_message(channel: str, message: str) -> bytes:
+    """A published message as the RESP push subscribers receive"""
+    return b"*3\r\n" + _resp_bulk("message") + _resp_bulk(channel) + _resp_bulk(message)
+
+
+def encode_resp(cmd: str, responses: List[str]) -> bytes:
+    """Encode a command's response lines as a RESP2 reply"""
+    if len(responses) == 1 and isinstance(responses[0], ErrorReply):
+        return f"-{responses[0]}\r\n".encode("utf-8", TEXT_ERRORS)
+
+    if cmd in ("BLPOP", "BRPOP") and responses == ["nil"]:
+        return b"*-1\r\n"  # Timed out: a null array, not an array holding nil
+    if cmd == "GETIFNEWER" and responses == ["NOTMODIFIED"]:
+        return b"+NOTMODIFIED\r\n"  # A status, unlike the bulk value it stands in for
+
+    if cmd in ("SUBSCRIBE", "UNSUBSCRIBE"):
+        # One [kind, channel, count] array per channel, as Redis sends them
+        replies = []
+        for response in responses:
+            kind, channel, count = split_args(response)
+            replies.append(b"*3\r\n" + _resp_bulk(kind) + _resp_bulk(channel) + b":%d\r\n" % int(count))
+        return b"".join(replies)
+
+    if cmd in RESP_ARRAY_REPLIES:
+        # The line protocol's END terminator is implied by the array length
+        items = responses[:-1] if responses and responses[-1] == "END" else responses
+        return b"*%d\r\n" % len(items) + b"".join(_resp_bulk(item) for item in items)
+
+    reply = responses[0] if responses else ""
+    # Some integer commands reply OK to a subcommand (DEBUG SLEEP)
+    if cmd in RESP_INTEGER_REPLIES and reply.lstrip("-").isdigit():
+        return f":{reply}\r\n".encode("utf-8")
+    if cmd in RESP_BULK_REPLIES or reply == "nil":
+        return _resp_bulk(reply)
+    return f"+{reply}\r\n".encode("utf-8", TEXT_ERRORS)
+
+
+def read_resp_command(rfile) -> Optional[List[str]]:
+    """Read one RESP array of bulk strings from a binary stream, or None at EOF"""
+    header = rfile.readline()
+    if not header:
+        return None
+    if not header.startswith(b"*"):
+        raise ValueError("Protocol error: expected '*'")
+
+    args = []
+    for _ in range(int(header[1:])):
+        line = rfile.readline()
+        if not line.startswith(b"$"):
+            raise ValueError("Protocol error: expected '$'")
+        length = int(line[1:])
+        data = rfile.read(length + 2)
+        if len(data) != length + 2:
+            return None
+        args.append(data[:length].decode("utf-8", TEXT_ERRORS))
+    return args
+
+
+def _pushing(wfile, encode: Callable[[str, str], bytes]):
+    """A Session.push writing encoded messages to a client, and the lock serializing its writes"""
+    lock = threading.Lock()
+
+    def push(channel: str, message: str):
+        with lock:
+            try:
+                wfile.write(encode(channel, message))
+                wfile.flush()
+            except OSError:
+                pass  # The client went away; its handler unsubscribes it
+    return push, lock
+
+
+def serve_resp(store: KVStore, rfile, wfile):
+    """Run RESP request/reply cycles between binary streams until EOF or EXIT"""
+    store.session.push, lock = _pushing(wfile, _resp_message)
+    while True:
+        try:
+            args = read_resp_command(rfile)
+        except ValueError as e:
+            wfile.write(f"-ERR {e}\r\n".encode("utf-8"))
+            return
+        if args is None:
+            return
+
+        responses = execute_command(store, args)
+        with lock:
+            if responses is None:
+                wfile.write(b"+OK\r\n")
+                return
+            if args:
+                wfile.write(encode_resp(args[0].upper(), responses))
+            wfile.flush()
+
+
+def format_line_reply(response: str) -> str:
+    """A response line for the line protocol; one holding newlines or raw bytes is quoted"""
+    return _quote_arg(response) if _needs_escape(response) else response
+
+
+def format_line_message(channel: str, message: str) -> str:
+    """A published message as the line subscribers receive: message, channel and message, quoted as needed"""
+    return _command_line("message", channel, message)
+
+
+def serve_lines(store: KVStore, rfile, wfile):
+    """Run the newline-delimited text protocol between binary streams until EOF or EXIT"""
+    store.session.push, lock = _pushing(
+        wfile, lambda channel, message: (format_line_message(channel, message) + "\n").encode("utf-8", TEXT_ERRORS))
+    pending = b""
+    while True:
+        # Run every complete line that has arrived as one batch, replying with a single flush
+        chunk = rfile.read1(65536)
+        if chunk:
+            *received, pending = (pending + chunk).split(b"\n")
+        else:
+            received, pending = [pending], b""  # A final line without a newline still runs
+        lines = [raw.decode("utf-8", TEXT_ERRORS).strip() for raw in received]
+        results = process_batch(store, [line for line in lines if line])
+        with lock:
+            for responses in results:
+                for response in responses or []:
+                    wfile.write((format_line_reply(response) + "\n").encode("utf-8", TEXT_ERRORS))
+            wfile.flush()
+        if not chunk or (results and results[-1] is None):
+            return
+
+
+class _ConnectionHandler(socketserver.StreamRequestHandler):
+    """Serves one client connection in its own session.
+
+    Clients speaking RESP (their first byte is '*') get RESP replies; everyone
+    else gets the line protocol.
+    """
+
+    def handle(self):
+        store = self.server.store
+        store.bind_session(Session())
+        try:
+            if self.rfile.peek(1)[:1] == b"*":
+                serve_resp(store, self.rfile, self.wfile)
+            else:
+                serve_lines(store, self.rfile, self.wfile)
+        finally:
+            store.unwatch()
+            store.unsubscribe()
+            store.bind_session(None)
+
+
+def _parse_addr(addr: str) -> Tuple[str, int]:
+    """Split host:port; an empty host listens on all interfaces"""
+    host, _, port = addr.rpartition(":")
+    return host, int(port)
+
+
+class KVServer(socketserver.ThreadingTCPServer):
+    """TCP server sharing one KVStore across connection threads"""
+
+    daemon_threads = True
+    allow_reuse_address = True
+
+    def __init__(self, store: KVStore, addr: str):
+        super().__init__(_parse_addr(addr), _ConnectionHandler)
+        self.store = store
+
+
+class _HTTPHandler(http.server.BaseHTTPRequestHandler):
+    """Maps GET/PUT/DELETE on /keys/{key} onto the store's get/set/del"""
+
+    def handle(self):
+        # Each HTTP connection gets its own session, like TCP clients
+        self.server.store.bind_session(Session())
+        try:
+            super().handle()
+        finally:
+            self.server.store.bind_session(None)
+
+    def log_message(self, format, *args):
+        pass  # Stay quiet like the TCP server
+
+    def _reply(self, status: int, body: str = "", headers: Optional[Dict[str, str]] = None):
+        data = body.encode("utf-8")
+        self.send_response(status)
+        for name, value in (headers or {}).items():
+            self.send_header(name, value)
+        if data:
+            self.send_header("Content-Type", "text/plain; charset=utf-8")
+        self.send_header("Content-Length", str(len(data)))
+        self.end_headers()
+        self.wfile.write(data)
+
+    def _authorized(self) -> bool:
+        """Check the request's bearer token against requirepass, replying 401 if it fails.
+
+        Every request carries its own credentials; passing once doesn't
+        authenticate the rest of a keep-alive connection.
+        """
+        store = self.server.store
+        scheme, _, token = self.headers.get("Authorization", "").partition(" ")
+        # Authenticates the session for execute_command, which checks it too
+        store.session.authenticated = scheme.lower() == "bearer" and store.check_password(token.strip())
+        if store.is_authenticated():
+            return True
+        self._reply(401, "authentication required\n", {"WWW-Authenticate": "Bearer"})
+        return False
+
+    def _parse(self) -> Tuple[Optional[str], Dict[str, List[str]]]:
+        """Return the key named by the request path (None if not a /keys/ path) and the query"""
+        url = urllib.parse.urlsplit(self.path)
+        if not url.path.startswith("/keys/") or url.path == "/keys/":
+            return None, {}
+        key = urllib.parse.unquote(url.path[len("/keys/"):])
+        if self.server.store.nocase_keys:
+            key = key.lower()
+        return key, urllib.parse.parse_qs(url.query)
+
+    def do_GET(self):
+        if not self._authorized():
+            return
+        key, _ = self._parse()
+        if key is None:
+            self._reply(404, "not found\n")
+            return
+
+        store = self.server.store
+        value = store.get(key)
+        # "nil" is also a legal stored value, so confirm the key is really missing
+        if value == "nil" and store.exists(key) == "0":
+            self._reply(404, "not found\n")
+            return
+        if isinstance(value, ErrorReply):  # A list, hash or set, which has no plain-text form
+            self._reply(409, value + "\n")
+            return
+        self._reply(200, value)
+
+    def do_PUT(self):
+        if not self._authorized():
+            return
+        key, query = self._parse()
+        if key is None:
+            self._reply(404, "not found\n")
+            return
+        if self.server.store.readonly:
+            self._reply(403, "read only replica\n")
+            return
+
+        length = int(self.headers.get("Content-Length", 0))
+        value = self.rfile.read(length).decode("utf-8", errors="replace")
+        if value == "" or "\n" in value or any(c.isspace() for c in key):
+            self._reply(400, "value must be non-empty and single-line, key must not contain whitespace\n")
+            return
+
+        ttl = query.get("ttl", [None])[-1]
+        if ttl is not None and (not ttl.isdigit() or int(ttl) <= 0):
+            self._reply(400, "ttl must be a positive number of milliseconds\n")
+            return
+
+        # Through execute_command, so the write makes room under maxmemory and maxkeys
+        # like any other; PSETEX applies the value and its expiry atomically
+        command = ["SET", key, value] if ttl is None else ["PSETEX", key, ttl, value]
+        reply = execute_command(self.server.store, command)[0]
+        if isinstance(reply, ErrorReply):
+            self._reply(503, reply + "\n")  # Out of room under maxmemory or maxkeys, or shutting down
+            return
+        self._reply(204)
+
+    def do_DELETE(self):
+        if not self._authorized():
+            return
+        key, _ = self._parse()
+        if key is None:
+            self._reply(404, "not found\n")
+            return
+        if self.server.store.readonly:
+            self._reply(403, "read only replica\n")
+            return
+
+        if self.server.store.delete(key) == "0":
+            self._reply(404, "not found\n")
+            return
+        self._reply(204)
+
+
+class KVHTTPServer(http.server.ThreadingHTTPServer):
+    """HTTP front end sharing one KVStore across request threads"""
+
+    daemon_threads = True
+
+    def __init__(self, store: KVStore, addr: str):
+        super().__init__(_parse_addr(addr), _HTTPHandler)
+        self.store = store
+
+
+def shutdown(store: KVStore, servers: List[socketserver.BaseServer],
+             timeout: float = SHUTDOWN_TIMEOUT) -> bool:
+    """Stop the servers accepting connections, then fsync and close the store.
+
+    Returns False if that didn't finish within timeout (e.g. a command is stuck
+    holding the store lock), leaving the log possibly unsynced.
+    """
+    def run():
+        for server in servers:
+            server.shutdown()
+            server.server_close()
+        store.close()
+
+    closer = threading.Thread(target=run, name="kvs-shutdown", daemon=True)
+    closer.start()
+    closer.join(timeout)
+    return not closer.is_alive()
+
+
+def _interrupt(signum, frame):
+    raise KeyboardInterrupt
+
 
 def main():
-    store = KVStore()
-    
-    for line in sys.stdin:
-        line = line.strip()
-        if not line:
-            continue
-        
-        parts = line.split()
-        if not parts:
-            continue
-        
-        cmd = parts[0].upper()
-        args = parts[1:]
-        
+    parser = argparse.ArgumentParser(description="Sorted key-value store with an append-only log")
+    parser.add_argument("--listen", metavar="ADDR",
+                        help="serve the line protocol over TCP on host:port instead of stdin")
+    parser.add_argument("--http", metavar="ADDR",
+                        help="serve the REST API over HTTP on host:port instead of stdin")
+    parser.add_argument("--requirepass", metavar="PASSWORD",
+                        help="require TCP clients to AUTH with this password before other commands, "
+                             "and HTTP requests to send it as a bearer token")
+    parser.add_argument("--strict", action="store_true",
+                        help="refuse to start if any log entry is corrupt or malformed")
+    parser.add_argument("--appendfsync", choices=FSYNC_POLICIES, default="always",
+                        help="when to fsync the log: after every write, once per second, or never (default: always)")
+    parser.add_argument("--slowlog-log-slower-than", type=int, default=10000, metavar="US",
+                        help="log commands slower than this many microseconds; negative disables (default: 10000)")
+    parser.add_argument("--maxmemory", type=int, default=0, metavar="BYTES",
+                        help="evict least recently used keys to keep data under BYTES; 0 disables (default: 0)")
+    parser.add_argument("--maxkeys", type=int, default=0, metavar="N",
+                        help="cap the number of keys at N; 0 disables (default: 0)")
+    parser.add_argument("--maxkeys-policy", choices=MAXKEYS_POLICIES, default="noeviction",
+                        help="at the key cap, reject new keys or evict random ones (default: noeviction)")
+    parser.add_argument("--databases", type=int, default=16, metavar="N",
+                        help="number of logical databases for SELECT (default: 16)")
+    parser.add_argument("--log-format", choices=sorted(LOG_CODECS), default="text",
+                        help="format for a new log or a COMPACT rewrite; an existing log is read in "
+                             "whichever format it has (default: text)")
+    parser.add_argument("--log-rotate-size", type=int, default=0, metavar="BYTES",
+                        help="roll the log to data.db.N and compact it once it passes BYTES; "
+                             "0 disables (default: 0)")
+    parser.add_argument("--log-keep", type=int, default=3, metavar="N",
+                        help="number of rotated log segments to keep (default: 3)")
+    parser.add_argument("--notify-keyspace-events", action="store_true",
+                        help="publish key changes to __keyspace__:<key> and __keyevent__:<event> channels")
+    parser.add_argument("--ignore-extra-args", action="store_true",
+                        help="drop extra arguments to fixed-arity commands instead of rejecting them")
+    parser.add_argument("--nocasekeys", action="store_true",
+                        help="treat keys case-insensitively by lowercasing them; "
+                             "unsafe to switch on or off for an existing dataset")
+    parser.add_argument("--compress-threshold", type=int, default=0, metavar="BYTES",
+                        help="keep and log string values of at least this size compressed (default: 0, off)")
+    parser.add_argument("--transfer-dir", metavar="DIR",
+                        help="let IMPORT and EXPORT read and write files by name in DIR; "
+                             "without it both are disabled")
+    parser.add_argument("--readonly", action="store_true",
+                        help="serve a read-only replica of data.db, following writes another process appends")
+    parser.add_argument("--lfu", action="store_true",
+                        help="count accesses per key for OBJECT FREQ")
+    parser.add_argument("--slowlog-max-len", type=int, default=128, metavar="N",
+                        help="number of slow commands to keep (default: 128)")
+    opts = parser.parse_args()
+
+    try:
+        store = KVStore(requirepass=opts.requirepass, strict=opts.strict,
+                        fsync_policy=opts.appendfsync,
+                        slowlog_threshold_us=opts.slowlog_log_slower_than,
+                        slowlog_max_len=opts.slowlog_max_len,
+                        maxmemory=opts.maxmemory, maxkeys=opts.maxkeys,
+                        maxkeys_policy=opts.maxkeys_policy, track_frequency=opts.lfu,
+                        databases=opts.databases, readonly=opts.readonly,
+                        log_format=opts.log_format, log_rotate_size=opts.log_rotate_size,
+                        log_keep=opts.log_keep, notify_keyspace_events=opts.notify_keyspace_events,
+                        strict_arity=not opts.ignore_extra_args, nocase_keys=opts.nocasekeys,
+                        compress_threshold=opts.compress_threshold, transfer_dir=opts.transfer_dir)
+    except LogCorruptionError as e:
+        for line_no, reason in e.errors:
+            print(f"kvs: log line {line_no}: {reason}", file=sys.stderr)
+        sys.exit(f"kvs: {e}")
+    except (DatabaseCountError, ValueError) as e:  # ValueError: a log in an unknown format
+        sys.exit(f"kvs: {e}")
+    if store.replay_errors:
+        print(f"kvs: skipped {len(store.replay_errors)} corrupt log entries", file=sys.stderr)
+    if store.torn_tail_bytes:
+        print(f"kvs: cut an incomplete {store.torn_tail_bytes}-byte record from the end of the log"
+              f" (saved to {store.torn_tail_file})",
+              file=sys.stderr)
+    if store.snapshot_status.startswith("corrupt"):
+        print(f"kvs: ignored {store.snapshot_file}: {store.snapshot_status}; replayed the whole log",
+              file=sys.stderr)
+    store.start_sweeper()
+    if store.readonly:
+        store.start_tailing()
+    # SIGTERM unwinds the main loop like Ctrl-C so both shut down cleanly
+    signal.signal(signal.SIGTERM, _interrupt)
+
+    servers = []
+    if opts.listen:
+        servers.append(KVServer(store, opts.listen))
+    if opts.http:
+        servers.append(KVHTTPServer(store, opts.http))
+
+    if servers:
+        for server in servers[1:]:
+            threading.Thread(target=server.serve_forever, daemon=True).start()
         try:
-            if cmd == "SET" and len(args) >= 2:
-                key, value = args[0], " ".join(args[1:])
-                print(store.set(key, value))
-            elif cmd == "GET" and len(args) == 1:
-                print(store.get(args[0]))
-            elif cmd == "DEL" and len(args) == 1:
-                print(store.delete(args[0]))
-            elif cmd == "EXISTS" and len(args) == 1:
-                print(store.exists(args[0]))
-            elif cmd == "MSET" and len(args) >= 2:
-                print(store.mset(*args))
-            elif cmd == "MGET" and len(args) >= 1:
-                results = store.mget(*args)
-                for res in results:
-                    print(res)
-            elif cmd == "BEGIN" and len(args) == 0:
-                print(store.begin())
-            elif cmd == "COMMIT" and len(args) == 0:
-                print(store.commit())
-            elif cmd == "ABORT" and len(args) == 0:
-                print(store.abort())
-            elif cmd == "EXPIRE" and len(args) == 2:
-                print(store.expire(args[0], args[1]))
-            elif cmd == "TTL" and len(args) == 1:
-                print(store.ttl(args[0]))
-            elif cmd == "PERSIST" and len(args) == 1:
-                print(store.persist(args[0]))
-            elif cmd == "RANGE" and len(args) == 2:
-                results = store.range(args[0], args[1])
-                for res in results:
-                    print(res)
-            elif cmd == "EXIT":
+            servers[0].serve_forever()
+        except KeyboardInterrupt:
+            pass
+        finally:
+            if not shutdown(store, servers):
+                sys.exit("kvs: shutdown timed out; the log may not be synced")
+        return
+    
+    # Pass bytes that aren't UTF-8 through unchanged, as the TCP protocols do
+    sys.stdin.reconfigure(errors=TEXT_ERRORS)
+    sys.stdout.reconfigure(errors=TEXT_ERRORS)
+    store.session.push = lambda channel, message: print(format_line_message(channel, message))
+    try:
+        for line in sys.stdin:
+            line = line.strip()
+            if not line:
+                continue
+
+            responses = process_command(store, line)
+            if responses is None:
                 break
-            else:
-                print("ERR invalid command or arguments")
-        except Exception as e:
-            print(f"ERR {str(e)}")
+            for response in responses:
+                print(format_line_reply(response))
+    except KeyboardInterrupt:
+        pass
+
+    if not shutdown(store, []):
+        sys.exit("kvs: shutdown timed out; the log may not be synced")
 
 if __name__ == "__main__":
-    main()
\ No newline at end of file
+    main()
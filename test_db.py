@@ -0,0 +1,3650 @@
+"""Tests for db.py; run with python3 -m unittest"""
+import collections
+import http.client
+import io
+import json
+import os
+import shutil
+import signal
+import socket
+import subprocess
+import sys
+import tempfile
+import threading
+import time
+import unittest
+import zlib
+from datetime import timedelta
+from typing import List, Optional, Tuple
+from unittest import mock
+
+import db
+
+
+class StoreTest(unittest.TestCase):
+    """Base for tests that open stores on a log in a fresh temporary directory"""
+
+    def setUp(self):
+        self.dir = tempfile.mkdtemp(prefix="kvs-test-")
+        self.addCleanup(shutil.rmtree, self.dir, ignore_errors=True)
+        self.path = os.path.join(self.dir, "data.db")
+
+    def open(self, **options) -> db.KVStore:
+        """A store on this test's log, closed when the test ends"""
+        store = db.KVStore(path=self.path, **options)
+        self.addCleanup(store.close)
+        return store
+
+    def reopen(self, store: db.KVStore, **options) -> db.KVStore:
+        """Close store and open its log again, as a restart would"""
+        store.close()
+        return self.open(**options)
+
+    @staticmethod
+    def other_client(store: db.KVStore, *lines: str) -> List[Optional[List[str]]]:
+        """Run lines as a separate client would, in a thread with a session of its own"""
+        results = []
+
+        def run():
+            store.bind_session(db.Session(authenticated=True))
+            results.extend(store.execute(line) for line in lines)
+
+        thread = threading.Thread(target=run)
+        thread.start()
+        thread.join()
+        return results
+
+    @staticmethod
+    def state(store: db.KVStore) -> List[list]:
+        """Every database's (key, value, expiry) entries, for comparing stores"""
+        return [list(keyspace.data) for keyspace in store.databases]
+
+    def assertError(self, responses):
+        """Assert a command replied with a single error"""
+        self.assertEqual(len(responses), 1, responses)
+        self.assertIsInstance(responses[0], db.ErrorReply, responses)
+
+
+class DebugEqualTest(StoreTest):
+    def test_sets_compare_regardless_of_insertion_order(self):
+        store = self.open()
+        store.execute("SADD a x y z")
+        store.execute("SADD b z x y")
+        self.assertEqual(store.execute("DEBUG EQUAL a b"), ["1"])
+
+    def test_lists_compare_in_order(self):
+        store = self.open()
+        store.execute("RPUSH a x y")
+        store.execute("RPUSH b y x")
+        self.assertEqual(store.execute("DEBUG EQUAL a b"), ["0"])
+
+    def test_withttl_also_compares_expiry(self):
+        store = self.open(clock=db.ManualClock())
+        store.execute("SET a v")
+        store.execute("SET b v")
+        store.execute("EXPIRE b 10")
+        self.assertEqual(store.execute("DEBUG EQUAL a b"), ["1"])
+        self.assertEqual(store.execute("DEBUG EQUAL a b WITHTTL"), ["0"])
+
+    def test_missing_keys(self):
+        store = self.open()
+        store.execute("SET a v")
+        self.assertEqual(store.execute("DEBUG EQUAL a missing"), ["0"])
+        self.assertEqual(store.execute("DEBUG EQUAL missing other"), ["1"])
+
+    def test_strings_compare_by_value(self):
+        store = self.open()
+        store.execute("SET a v")
+        store.execute("SET b v")
+        store.execute("SET c w")
+        self.assertEqual(store.execute("DEBUG EQUAL a b"), ["1"])
+        self.assertEqual(store.execute("DEBUG EQUAL a c"), ["0"])
+
+    def test_sees_pending_transaction_writes(self):
+        store = self.open()
+        store.execute("SET a v")
+        store.execute("BEGIN")
+        store.execute("SET b v")
+        self.assertEqual(store.execute("DEBUG EQUAL a b"), ["1"])
+        store.execute("ABORT")
+        self.assertEqual(store.execute("DEBUG EQUAL a b"), ["0"])
+
+    def test_rejects_unknown_option(self):
+        store = self.open()
+        self.assertError(store.execute("DEBUG EQUAL a b NOPE"))
+
+
+class ExpireAtTest(StoreTest):
+    def test_past_timestamp_removes_key(self):
+        clock = db.ManualClock(1_000_000)
+        store = self.open(clock=clock)
+        store.execute("SET k v")
+        self.assertEqual(store.execute("EXPIREAT k 999999"), ["1"])
+        self.assertEqual(store.execute("EXISTS k"), ["0"])
+
+    def test_future_timestamp_sets_ttl(self):
+        clock = db.ManualClock(1_000_000)
+        store = self.open(clock=clock)
+        store.execute("SET k v")
+        self.assertEqual(store.execute("EXPIREAT k 1000060"), ["1"])
+        self.assertEqual(store.execute("TTL k"), ["60"])
+
+    def test_missing_key(self):
+        store = self.open()
+        self.assertEqual(store.execute("EXPIREAT missing 4000000000"), ["0"])
+
+    def test_logs_absolute_expiry_as_pexpireat(self):
+        store = self.open(clock=db.ManualClock(1_000_000))
+        store.execute("SET k v")
+        store.execute("EXPIREAT k 1000060")
+        store.close()
+        with open(self.path) as f:
+            self.assertIn("PEXPIREAT k 1000060000", f.read())
+
+    def test_replays_old_expire_entries_as_relative(self):
+        # Logs from before PEXPIREAT recorded EXPIRE with ms left, counted from replay
+        with open(self.path, "w") as f:
+            f.write("SET k v\nEXPIRE k 60000\n")
+        store = self.open(clock=db.ManualClock(1_000_000))
+        self.assertEqual(store.execute("PTTL k"), ["60000"])
+
+
+class RenamePrefixTest(StoreTest):
+    def test_moves_keys_and_keeps_ttls(self):
+        clock = db.ManualClock(1_000_000)
+        store = self.open(clock=clock)
+        store.execute("SET a:1 one")
+        store.execute("SETEX a:2 30 two")
+        store.execute("SET other x")
+        self.assertEqual(store.execute("RENAMEPREFIX a: b:"), ["2"])
+        self.assertEqual(store.execute("PREFIX a:"), ["END"])
+        self.assertEqual(store.execute("PREFIX b:"), ["b:1", "b:2", "END"])
+        self.assertEqual(store.execute("GET b:2"), ["two"])
+        self.assertEqual(store.execute("PTTL b:1"), ["-1"])
+        self.assertEqual(store.execute("PTTL b:2"), ["30000"])
+        self.assertEqual(store.execute("GET other"), ["x"])
+
+    def test_refuses_to_overwrite_without_replace(self):
+        store = self.open()
+        store.execute("SET a:1 new")
+        store.execute("SET b:1 old")
+        self.assertError(store.execute("RENAMEPREFIX a: b:"))
+        self.assertEqual(store.execute("GET b:1"), ["old"])
+        self.assertEqual(store.execute("RENAMEPREFIX a: b: REPLACE"), ["1"])
+        self.assertEqual(store.execute("GET b:1"), ["new"])
+
+    def test_refused_inside_transaction(self):
+        store = self.open()
+        store.execute("SET a:1 one")
+        store.execute("BEGIN")
+        self.assertError(store.execute("RENAMEPREFIX a: b:"))
+        store.execute("ABORT")
+        self.assertEqual(store.execute("GET a:1"), ["one"])
+
+    def test_survives_restart(self):
+        store = self.open()
+        store.execute("SET a:1 one")
+        store.execute("RENAMEPREFIX a: b:")
+        store = self.reopen(store)
+        self.assertEqual(store.execute("PREFIX \"\""), ["b:1", "END"])
+
+
+class PExpireAtTest(StoreTest):
+    def test_expiry_survives_restart(self):
+        clock = db.ManualClock(1_000_000)
+        store = self.open(clock=clock)
+        store.execute("SET k v")
+        self.assertEqual(store.execute("PEXPIREAT k 1000000250"), ["1"])
+        store = self.reopen(store, clock=clock)
+        self.assertEqual(store.execute("PEXPIRETIME k"), ["1000000250"])
+        self.assertEqual(store.execute("PTTL k"), ["250"])
+        clock.advance(0.251)
+        self.assertEqual(store.execute("GET k"), ["nil"])
+
+    def test_rejects_non_integer_timestamp(self):
+        store = self.open()
+        store.execute("SET k v")
+        self.assertError(store.execute("PEXPIREAT k soon"))
+
+
+class TTLTest(StoreTest):
+    def test_ttl_in_seconds_and_pttl_in_milliseconds(self):
+        store = self.open(clock=db.ManualClock(1_000_000))
+        store.execute("PSETEX k 1500 v")
+        self.assertEqual(store.execute("TTL k"), ["1"])
+        self.assertEqual(store.execute("PTTL k"), ["1500"])
+
+    def test_truncates_to_whole_seconds(self):
+        clock = db.ManualClock(1_000_000)
+        store = self.open(clock=clock)
+        store.execute("SETEX k 10 v")
+        self.assertEqual(store.execute("TTL k"), ["10"])
+        clock.advance(0.002)
+        self.assertEqual(store.execute("TTL k"), ["9"])
+        self.assertEqual(store.execute("PTTL k"), ["9998"])
+        clock.advance(9.997)
+        self.assertEqual(store.execute("TTL k"), ["0"])
+        self.assertEqual(store.execute("PTTL k"), ["1"])
+
+    def test_sentinels(self):
+        store = self.open()
+        store.execute("SET k v")
+        self.assertEqual(store.execute("TTL k"), ["-1"])
+        self.assertEqual(store.execute("PTTL k"), ["-1"])
+        self.assertEqual(store.execute("TTL missing"), ["-2"])
+        self.assertEqual(store.execute("PTTL missing"), ["-2"])
+
+    def test_sees_pending_transaction_writes(self):
+        store = self.open(clock=db.ManualClock(1_000_000))
+        store.execute("SET k v")
+        store.execute("BEGIN")
+        store.execute("PEXPIRE k 1500")
+        self.assertEqual(store.execute("TTL k"), ["1"])
+        self.assertEqual(store.execute("PTTL k"), ["1500"])
+        store.execute("ABORT")
+        self.assertEqual(store.execute("PTTL k"), ["-1"])
+
+
+class ExpireTimeTest(StoreTest):
+    def test_matches_expireat_timestamp(self):
+        store = self.open(clock=db.ManualClock(1_000_000))
+        store.execute("SET k v")
+        store.execute("EXPIREAT k 1000060")
+        self.assertEqual(store.execute("EXPIRETIME k"), ["1000060"])
+        self.assertEqual(store.execute("PEXPIRETIME k"), ["1000060000"])
+
+    def test_sentinels(self):
+        store = self.open()
+        store.execute("SET k v")
+        self.assertEqual(store.execute("EXPIRETIME k"), ["-1"])
+        self.assertEqual(store.execute("PEXPIRETIME missing"), ["-2"])
+
+    def test_sees_pending_transaction_writes(self):
+        store = self.open(clock=db.ManualClock(1_000_000))
+        store.execute("BEGIN")
+        store.execute("SET k v")
+        store.execute("PEXPIREAT k 1000000500")
+        self.assertEqual(store.execute("PEXPIRETIME k"), ["1000000500"])
+        store.execute("ABORT")
+        self.assertEqual(store.execute("PEXPIRETIME k"), ["-2"])
+
+
+class PExpireTest(StoreTest):
+    def test_matches_expire_for_equal_durations(self):
+        store = self.open(clock=db.ManualClock(1_000_000))
+        store.execute("SET a v")
+        store.execute("SET b v")
+        self.assertEqual(store.execute("EXPIRE a 5"), ["1"])
+        self.assertEqual(store.execute("PEXPIRE b 5000"), ["1"])
+        self.assertEqual(store.execute("PTTL a"), store.execute("PTTL b"))
+        self.assertEqual(store.execute("TTL a"), store.execute("TTL b"))
+
+    def test_missing_key(self):
+        store = self.open()
+        self.assertEqual(store.execute("PEXPIRE missing 5000"), ["0"])
+
+    def test_non_positive_expires_key(self):
+        store = self.open()
+        store.execute("SET k v")
+        self.assertEqual(store.execute("PEXPIRE k 0"), ["1"])
+        self.assertEqual(store.execute("EXISTS k"), ["0"])
+
+
+class ExpireCallbackTest(StoreTest):
+    def test_fires_for_key_removed_by_sweeper(self):
+        store = self.open()
+        expired = threading.Event()
+        keys = []
+        store.on_expire(lambda key: (keys.append(key), expired.set()))
+        store.execute("PSETEX short 20 v")
+        store.execute("SET kept v")
+        store.start_sweeper(interval=0.01)
+        self.assertTrue(expired.wait(5))
+        self.assertEqual(keys, ["short"])
+        self.assertEqual(store.execute("EXISTS kept"), ["1"])
+
+    def test_fires_once_for_lazy_expiry(self):
+        clock = db.ManualClock(1_000_000)
+        store = self.open(clock=clock)
+        keys = []
+        store.on_expire(keys.append)
+        store.execute("SETEX k 1 v")
+        clock.advance(2)
+        self.assertEqual(store.execute("GET k"), ["nil"])
+        self.assertEqual(store.execute("GET k"), ["nil"])
+        self.assertEqual(keys, ["k"])
+
+    def test_callback_may_call_back_into_store(self):
+        clock = db.ManualClock(1_000_000)
+        store = self.open(clock=clock)
+        store.on_expire(lambda key: store.set("expired:" + key, "1"))
+        store.execute("SETEX k 1 v")
+        clock.advance(2)
+        self.assertEqual(store.sweep_expired(), 1)
+        self.assertEqual(store.execute("GET expired:k"), ["1"])
+
+    def test_expiry_is_logged(self):
+        clock = db.ManualClock(1_000_000)
+        store = self.open(clock=clock)
+        store.execute("SET k v")
+        store.execute("EXPIRE k 1")
+        clock.advance(2)
+        store.sweep_expired()
+        with open(self.path) as f:
+            self.assertTrue(f.read().splitlines()[-1].endswith("DEL k"))
+
+
+class ConcurrencyTest(StoreTest):
+    def test_hammer_set_get_del(self):
+        store = self.open(fsync_policy="no")
+        errors = []
+
+        def hammer(worker):
+            try:
+                for i in range(300):
+                    key = f"k{(worker * 7 + i) % 50}"
+                    store.execute(f"SET {key} {worker}")
+                    value = store.execute(f"GET {key}")[0]
+                    if value != "nil" and not value.isdigit():
+                        errors.append(f"GET {key} read {value!r}")
+                    if i % 3 == 0:
+                        store.execute(f"DEL {key}")
+            except Exception as e:
+                errors.append(repr(e))
+
+        threads = [threading.Thread(target=hammer, args=(worker,)) for worker in range(8)]
+        for thread in threads:
+            thread.start()
+        for thread in threads:
+            thread.join()
+
+        self.assertEqual(errors, [])
+        keys = [key for key, _, _ in store.data]
+        self.assertEqual(keys, sorted(set(keys)))
+        # The log replays to the same keys
+        expected = store.execute('PREFIX ""')
+        store = self.reopen(store)
+        self.assertEqual(store.execute('PREFIX ""'), expected)
+
+    def test_waiting_writer_goes_before_new_readers(self):
+        lock = db.RWLock()
+        order = []
+
+        def write():
+            lock.acquire_write()
+            order.append("write")
+            lock.release_write()
+
+        def read():
+            lock.acquire_read()
+            order.append("read")
+            lock.release_read()
+
+        lock.acquire_read()
+        try:
+            writer = threading.Thread(target=write)
+            writer.start()
+            time.sleep(0.05)  # The writer is waiting for this read lock
+            reader = threading.Thread(target=read)
+            reader.start()
+            time.sleep(0.05)
+            # Overlapping the held read lock would let a stream of readers starve the writer
+            self.assertEqual(order, [])
+        finally:
+            lock.release_read()
+        writer.join(5)
+        reader.join(5)
+        self.assertEqual(order, ["write", "read"])
+
+    def test_lock_is_reentrant(self):
+        lock = db.RWLock()
+        lock.acquire_write()
+        lock.acquire_read()
+        lock.acquire_write()
+        self.assertTrue(lock.write_held())
+        lock.release_write()
+        lock.release_read()
+        lock.release_write()
+        self.assertFalse(lock.held())
+
+    def test_read_lock_cannot_be_upgraded(self):
+        lock = db.RWLock()
+        lock.acquire_read()
+        try:
+            with self.assertRaises(RuntimeError):
+                lock.acquire_write()
+        finally:
+            lock.release_read()
+
+    def test_concurrent_reads_record_access_under_their_own_lock(self):
+        store = self.open(track_frequency=True)
+        store.execute("MSET a 1 b 2 c 3")
+        unguarded = []
+
+        class CheckedOrder(collections.OrderedDict):
+            def move_to_end(self, key, last=True):
+                if not store._access_lock.locked():
+                    unguarded.append(key)
+                super().move_to_end(key, last)
+
+        store.keyspace.last_access = CheckedOrder(store.keyspace.last_access)
+
+        def read():
+            for _ in range(200):
+                store.execute("MGET a b c")
+
+        threads = [threading.Thread(target=read) for _ in range(4)]
+        for thread in threads:
+            thread.start()
+        for thread in threads:
+            thread.join()
+        self.assertEqual(unguarded, [])
+        self.assertEqual(store.execute("OBJECT FREQ a"), ["801"])
+
+
+class ServerTest(StoreTest):
+    """Base for tests talking to a server on an ephemeral localhost port"""
+
+    def serve(self, server_class, store: db.KVStore):
+        server = server_class(store, "127.0.0.1:0")
+        threading.Thread(target=server.serve_forever, args=(0.05,), daemon=True).start()
+        self.addCleanup(server.server_close)
+        self.addCleanup(server.shutdown)
+        return server.server_address
+
+    def connect(self, address) -> socket.socket:
+        conn = socket.create_connection(address, timeout=5)
+        self.addCleanup(conn.close)
+        return conn
+
+    def read_lines(self, conn: socket.socket, count: int) -> List[str]:
+        """The next count newline-terminated lines from conn"""
+        data = b""
+        while data.count(b"\n") < count:
+            chunk = conn.recv(4096)
+            if not chunk:
+                break
+            data += chunk
+        return data.decode().split("\n")[:count]
+
+    def request(self, address, method: str, path: str, body: Optional[str] = None,
+                headers: Optional[dict] = None) -> Tuple[int, str]:
+        """The status and body of an HTTP request to address"""
+        conn = http.client.HTTPConnection(*address, timeout=5)
+        self.addCleanup(conn.close)
+        conn.request(method, path, body=body, headers=headers or {})
+        response = conn.getresponse()
+        return response.status, response.read().decode()
+
+
+class LineServerTest(ServerTest):
+    def test_set_and_get(self):
+        conn = self.connect(self.serve(db.KVServer, self.open()))
+        conn.sendall(b"SET greeting hello\nGET greeting\nGET missing\n")
+        self.assertEqual(self.read_lines(conn, 3), ["OK", "hello", "nil"])
+
+    def test_clients_share_the_store(self):
+        address = self.serve(db.KVServer, self.open())
+        first, second = self.connect(address), self.connect(address)
+        first.sendall(b"SET k v\n")
+        self.assertEqual(self.read_lines(first, 1), ["OK"])
+        second.sendall(b"GET k\n")
+        self.assertEqual(self.read_lines(second, 1), ["v"])
+
+
+def resp_command(*args: str) -> bytes:
+    """args encoded as a RESP array of bulk strings, as redis-cli sends commands"""
+    return b"*%d\r\n" % len(args) + b"".join(b"$%d\r\n%s\r\n" % (len(arg), arg.encode()) for arg in args)
+
+
+class RespTest(ServerTest):
+    def exchange(self, conn: socket.socket, request: bytes, expected: bytes):
+        conn.sendall(request)
+        data = b""
+        while len(data) < len(expected):
+            chunk = conn.recv(4096)
+            if not chunk:
+                break
+            data += chunk
+        self.assertEqual(data, expected)
+
+    def test_replies(self):
+        conn = self.connect(self.serve(db.KVServer, self.open()))
+        self.exchange(conn, resp_command("SET", "k", "hello world"), b"+OK\r\n")
+        self.exchange(conn, resp_command("GET", "k"), b"$11\r\nhello world\r\n")
+        self.exchange(conn, resp_command("GET", "missing"), b"$-1\r\n")
+        self.exchange(conn, resp_command("EXISTS", "k"), b":1\r\n")
+        self.exchange(conn, resp_command("RPUSH", "l", "a", "b"), b":2\r\n")
+        self.exchange(conn, resp_command("LRANGE", "l", "0", "-1"), b"*2\r\n$1\r\na\r\n$1\r\nb\r\n")
+        self.exchange(conn, resp_command("NOPE"), b"-ERR invalid command or arguments\r\n")
+
+    def test_values_starting_with_err_are_not_errors(self):
+        conn = self.connect(self.serve(db.KVServer, self.open()))
+        self.exchange(conn, resp_command("SET", "k", "ERRATA"), b"+OK\r\n")
+        self.exchange(conn, resp_command("GET", "k"), b"$6\r\nERRATA\r\n")
+        self.exchange(conn, resp_command("MGET", "k"), b"*1\r\n$6\r\nERRATA\r\n")
+
+    def test_pipelined_commands(self):
+        conn = self.connect(self.serve(db.KVServer, self.open()))
+        self.exchange(conn, resp_command("SET", "a", "1") + resp_command("GET", "a"), b"+OK\r\n$1\r\n1\r\n")
+
+    def test_encode_resp(self):
+        self.assertEqual(db.encode_resp("GET", ["nil"]), b"$-1\r\n")
+        self.assertEqual(db.encode_resp("GET", [db.WRONGTYPE_ERROR]), b"-" + db.WRONGTYPE_ERROR.encode() + b"\r\n")
+        self.assertEqual(db.encode_resp("PREFIX", ["a", "b", "END"]), b"*2\r\n$1\r\na\r\n$1\r\nb\r\n")
+
+
+class HTTPTest(ServerTest):
+    def test_put_get_delete(self):
+        address = self.serve(db.KVHTTPServer, self.open())
+        self.assertEqual(self.request(address, "PUT", "/keys/greeting", "hello")[0], 204)
+        self.assertEqual(self.request(address, "GET", "/keys/greeting"), (200, "hello"))
+        self.assertEqual(self.request(address, "DELETE", "/keys/greeting")[0], 204)
+        self.assertEqual(self.request(address, "GET", "/keys/greeting")[0], 404)
+        self.assertEqual(self.request(address, "DELETE", "/keys/greeting")[0], 404)
+
+    def test_key_is_url_decoded(self):
+        store = self.open()
+        address = self.serve(db.KVHTTPServer, store)
+        self.request(address, "PUT", "/keys/a%2Fb", "v")
+        self.assertEqual(store.execute("GET a/b"), ["v"])
+
+    def test_ttl_parameter(self):
+        store = self.open(clock=db.ManualClock(1_000_000))
+        address = self.serve(db.KVHTTPServer, store)
+        self.assertEqual(self.request(address, "PUT", "/keys/k?ttl=1500", "v")[0], 204)
+        self.assertEqual(store.execute("PTTL k"), ["1500"])
+        self.assertEqual(self.request(address, "PUT", "/keys/k?ttl=0", "v")[0], 400)
+        self.assertEqual(self.request(address, "PUT", "/keys/k?ttl=soon", "v")[0], 400)
+
+    def test_bad_requests(self):
+        address = self.serve(db.KVHTTPServer, self.open())
+        self.assertEqual(self.request(address, "GET", "/other")[0], 404)
+        self.assertEqual(self.request(address, "PUT", "/keys/k", "")[0], 400)
+        self.assertEqual(self.request(address, "PUT", "/keys/k", "two\nlines")[0], 400)
+
+    def test_replica_refuses_writes(self):
+        self.open().execute("SET k v")
+        address = self.serve(db.KVHTTPServer, self.open(readonly=True))
+        self.assertEqual(self.request(address, "PUT", "/keys/k", "w")[0], 403)
+        self.assertEqual(self.request(address, "DELETE", "/keys/k")[0], 403)
+        self.assertEqual(self.request(address, "GET", "/keys/k"), (200, "v"))
+
+
+class AuthTest(ServerTest):
+    def test_commands_rejected_before_auth(self):
+        conn = self.connect(self.serve(db.KVServer, self.open(requirepass="sekret")))
+        conn.sendall(b"SET k v\nAUTH wrong\nGET k\n")
+        self.assertEqual(self.read_lines(conn, 3), [
+            "ERR NOAUTH Authentication required", "ERR invalid password", "ERR NOAUTH Authentication required"])
+
+    def test_commands_accepted_after_auth(self):
+        conn = self.connect(self.serve(db.KVServer, self.open(requirepass="sekret")))
+        conn.sendall(b"AUTH sekret\nSET k v\nGET k\n")
+        self.assertEqual(self.read_lines(conn, 3), ["OK", "OK", "v"])
+
+    def test_auth_is_per_connection(self):
+        address = self.serve(db.KVServer, self.open(requirepass="sekret"))
+        first, second = self.connect(address), self.connect(address)
+        first.sendall(b"AUTH sekret\n")
+        self.assertEqual(self.read_lines(first, 1), ["OK"])
+        second.sendall(b"GET k\n")
+        self.assertEqual(self.read_lines(second, 1), ["ERR NOAUTH Authentication required"])
+
+    def test_auth_without_password_configured(self):
+        self.assertError(self.open().execute("AUTH anything"))
+
+    def test_http_requires_bearer_token(self):
+        address = self.serve(db.KVHTTPServer, self.open(requirepass="sekret"))
+        self.assertEqual(self.request(address, "PUT", "/keys/k", "v")[0], 401)
+        self.assertEqual(self.request(address, "GET", "/keys/k",
+                                      headers={"Authorization": "Bearer wrong"})[0], 401)
+        good = {"Authorization": "Bearer sekret"}
+        self.assertEqual(self.request(address, "PUT", "/keys/k", "v", headers=good)[0], 204)
+        self.assertEqual(self.request(address, "GET", "/keys/k", headers=good), (200, "v"))
+        self.assertEqual(self.request(address, "DELETE", "/keys/k")[0], 401)
+
+
+class CompactTest(StoreTest):
+    def test_one_entry_per_key(self):
+        store = self.open()
+        for i in range(100):
+            store.execute(f"SET k v{i}")
+        store.execute("SET other x")
+        store.execute("DEL other")
+        self.assertEqual(store.execute("COMPACT"), ["OK"])
+        store.close()
+        with open(self.path) as f:
+            entries = [line.split(" ", 1)[1] for line in f.read().splitlines()]
+        self.assertEqual([entry for entry in entries if " k " in f" {entry} "], ["SET k v99"])
+        self.assertFalse(any("other" in entry for entry in entries))
+
+    def test_state_survives(self):
+        clock = db.ManualClock(1_000_000)
+        store = self.open(clock=clock)
+        store.execute("SETEX a 60 1")
+        store.execute("RPUSH l x y")
+        store.execute("HSET h f v")
+        store.execute("SELECT 2")
+        store.execute("SADD s m")
+        expected = self.state(store)
+        store.execute("COMPACT")
+        store = self.reopen(store, clock=clock)
+        self.assertEqual(self.state(store), expected)
+
+
+class SnapshotTest(StoreTest):
+    def test_restart_loads_snapshot_and_replays_the_rest(self):
+        store = self.open()
+        for i in range(200):
+            store.execute(f"SET k{i} {i}")
+        store.execute("RPUSH l a b")
+        self.assertEqual(store.execute("SNAPSHOT"), ["OK"])
+        store.execute("SET after 1")
+        store.execute("DEL k0")
+        expected = self.state(store)
+        store.close()
+
+        with mock.patch.object(db.KVStore, "_apply_log_entry", autospec=True,
+                               side_effect=db.KVStore._apply_log_entry) as applied:
+            store = self.open()
+        self.assertEqual(store.snapshot_status, "loaded")
+        self.assertEqual(self.state(store), expected)
+        # Only the entries after the snapshot marker were replayed
+        self.assertLess(applied.call_count, 10)
+
+        store.close()
+        os.remove(self.path + ".snap")
+        store = self.open()
+        self.assertEqual(store.snapshot_status, "none")
+        self.assertEqual(self.state(store), expected)
+
+    def test_stale_after_compaction(self):
+        store = self.open()
+        store.execute("SET a 1")
+        store.execute("SNAPSHOT")
+        store.execute("SET b 2")
+        store.execute("COMPACT")
+        store = self.reopen(store)
+        self.assertEqual(store.snapshot_status, "stale")
+        self.assertEqual(store.execute("MGET a b"), ["1", "2"])
+
+
+class ChecksumTest(StoreTest):
+    def write_mangled_log(self):
+        store = self.open()
+        store.execute("SET a 1")
+        store.execute("SET b 2")
+        store.execute("SET c 3")
+        store.close()
+        with open(self.path) as f:
+            lines = f.read().splitlines()
+        # Change b's value without updating its checksum
+        lines = [line.replace("SET b 2", "SET b 9") for line in lines]
+        with open(self.path, "w") as f:
+            f.write("\n".join(lines) + "\n")
+
+    def test_mangled_entry_is_skipped(self):
+        self.write_mangled_log()
+        store = self.open()
+        self.assertEqual(store.checksum_failures, 1)
+        self.assertEqual(store.execute("MGET a b c"), ["1", "nil", "3"])
+
+    def test_entries_carry_checksums(self):
+        store = self.open()
+        store.execute("SET a 1")
+        store.close()
+        with open(self.path) as f:
+            for line in f.read().splitlines():
+                crc, entry = line.split(" ", 1)
+                self.assertEqual(int(crc, 16), zlib.crc32(entry.encode()))
+
+
+def log_line(entry: str) -> str:
+    """A text log line holding entry, with its checksum"""
+    return f"{zlib.crc32(entry.encode()):08x} {entry}\n"
+
+
+class StrictReplayTest(StoreTest):
+    def setUp(self):
+        super().setUp()
+        with open(self.path, "w") as f:
+            f.write(log_line("SET a 1"))
+            f.write(log_line("SET b 2").replace("SET b 2", "SET b 9"))  # Bad checksum
+            f.write(log_line("HSET h"))  # Too few arguments
+            f.write(log_line("SET c 3"))
+
+    def test_lenient_skips_and_reports_bad_entries(self):
+        store = self.open()
+        self.assertEqual(store.execute("MGET a b c"), ["1", "nil", "3"])
+        self.assertEqual([line_no for line_no, _ in store.replay_errors], [2, 3])
+
+    def test_strict_refuses_to_start(self):
+        with self.assertRaises(db.LogCorruptionError) as caught:
+            self.open(strict=True)
+        self.assertEqual([line_no for line_no, _ in caught.exception.errors], [2, 3])
+        with open(self.path) as f:
+            self.assertEqual(len(f.read().splitlines()), 4)  # The log is left as it was
+
+
+def log_entries(path: str) -> List[str]:
+    """The entries of a text log, without checksums or SEQ, SELECT and ROTATED bookkeeping"""
+    with open(path, newline="") as f:
+        # Only a newline ends a record; splitlines would also split at the other
+        # line boundaries a value can hold unescaped, such as U+2028
+        entries = [line.split(" ", 1)[1] for line in f.read().split("\n")[:-1]]
+    return [entry for entry in entries if entry.split(" ", 1)[0] not in ("SEQ", "SELECT", "ROTATED")]
+
+
+class TransactionOrderTest(StoreTest):
+    def test_commit_logs_writes_in_issue_order(self):
+        store = self.open(clock=db.ManualClock(1_000_000))
+        store.execute("BEGIN")
+        store.execute("SET z 1")
+        store.execute("SET a 2")
+        store.execute("DEL z")
+        store.execute("SET m 3")
+        store.execute("PEXPIRE a 5000")
+        store.execute("SET z 4")
+        self.assertEqual(store.execute("COMMIT"), ["OK"])
+        store.close()
+        self.assertEqual(log_entries(self.path), [
+            "SET z 1", "SET a 2", "DEL z", "SET m 3", "PEXPIREAT a 1000005000", "SET z 4"])
+
+    def test_replay_matches_commit(self):
+        store = self.open()
+        store.execute("BEGIN")
+        store.execute("SET k 1")
+        store.execute("DEL k")
+        store.execute("SET k 2")
+        store.execute("COMMIT")
+        store = self.reopen(store)
+        self.assertEqual(store.execute("GET k"), ["2"])
+
+
+BENCHMARKS = bool(os.environ.get("KVS_BENCH"))  # Benchmarks are slow and only print; run them on request
+
+
+class FsyncPolicyTest(StoreTest):
+    def fsyncs_for_sets(self, policy: str, count: int) -> int:
+        store = self.open(fsync_policy=policy)
+        store.execute("SET warmup 1")  # Creating the log fsyncs its directory
+        with mock.patch.object(db.os, "fsync", wraps=os.fsync) as fsync:
+            for i in range(count):
+                store.execute(f"SET k{i} v")
+            return fsync.call_count
+
+    def test_always_fsyncs_every_write(self):
+        self.assertEqual(self.fsyncs_for_sets("always", 5), 5)
+
+    def test_everysec_and_no_leave_fsyncs_to_later(self):
+        self.assertEqual(self.fsyncs_for_sets("everysec", 5), 0)
+        self.assertEqual(self.fsyncs_for_sets("no", 5), 0)
+
+    def test_everysec_syncs_in_background(self):
+        store = self.open(fsync_policy="everysec")
+        store.execute("SET k v")
+        self.assertEqual(store.execute("WAIT 1 5000"), ["1"])
+
+    def test_unknown_policy(self):
+        with self.assertRaises(ValueError):
+            self.open(fsync_policy="sometimes")
+
+
+@unittest.skipUnless(BENCHMARKS, "set KVS_BENCH=1 to run benchmarks")
+class FsyncPolicyBenchmark(StoreTest):
+    def test_set_throughput(self):
+        count = 2000
+        for policy in db.FSYNC_POLICIES:
+            store = self.open(fsync_policy=policy)
+            started = time.perf_counter()
+            for i in range(count):
+                store.execute(f"SET {policy}:{i} value")
+            elapsed = time.perf_counter() - started
+            store.close()
+            print(f"\nSET with appendfsync {policy}: {count / elapsed:,.0f} ops/s", file=sys.stderr)
+
+
+class BatchedFsyncTest(StoreTest):
+    def count_fsyncs(self, store: db.KVStore, *lines: str) -> int:
+        with mock.patch.object(db.os, "fsync", wraps=os.fsync) as fsync:
+            for line in lines:
+                store.execute(line)
+            return fsync.call_count
+
+    def test_one_fsync_per_mset(self):
+        store = self.open()
+        store.execute("SET warmup 1")
+        self.assertEqual(self.count_fsyncs(store, "MSET a 1 b 2 c 3 d 4"), 1)
+
+    def test_one_fsync_per_commit(self):
+        store = self.open()
+        store.execute("SET warmup 1")
+        self.assertEqual(self.count_fsyncs(store, "BEGIN", "SET a 1", "SET b 2", "DEL warmup", "COMMIT"), 1)
+
+
+@unittest.skipUnless(BENCHMARKS, "set KVS_BENCH=1 to run benchmarks")
+class BatchedFsyncBenchmark(StoreTest):
+    def test_mset_against_separate_sets(self):
+        keys = 500
+        store = self.open()
+        store.execute("SET warmup 1")
+        pairs = " ".join(f"m{i} v" for i in range(keys))
+        with mock.patch.object(db.os, "fsync", wraps=os.fsync) as fsync:
+            started = time.perf_counter()
+            store.execute(f"MSET {pairs}")
+            mset = time.perf_counter() - started, fsync.call_count
+        with mock.patch.object(db.os, "fsync", wraps=os.fsync) as fsync:
+            started = time.perf_counter()
+            for i in range(keys):
+                store.execute(f"SET s{i} v")
+            separate = time.perf_counter() - started, fsync.call_count
+        for name, (elapsed, fsyncs) in (("one MSET", mset), ("separate SETs", separate)):
+            print(f"\n{keys} keys by {name}: {elapsed * 1000:.1f} ms, {fsyncs} fsyncs", file=sys.stderr)
+
+
+class NestedTransactionTest(StoreTest):
+    def test_commit_without_transaction(self):
+        store = self.open()
+        self.assertError(store.execute("COMMIT"))
+        self.assertError(store.execute("ABORT"))
+
+    def test_inner_abort_outer_commit(self):
+        store = self.open()
+        store.execute("BEGIN")
+        store.execute("SET outer 1")
+        store.execute("BEGIN")
+        store.execute("SET inner 2")
+        store.execute("SET outer 3")
+        self.assertEqual(store.execute("GET outer"), ["3"])
+        self.assertEqual(store.execute("ABORT"), ["OK"])
+        self.assertEqual(store.execute("GET outer"), ["1"])
+        self.assertEqual(store.execute("COMMIT"), ["OK"])
+        self.assertEqual(store.execute("MGET outer inner"), ["1", "nil"])
+        store = self.reopen(store)
+        self.assertEqual(store.execute("MGET outer inner"), ["1", "nil"])
+
+    def test_inner_commit_applies_only_with_outer(self):
+        store = self.open()
+        store.execute("BEGIN")
+        store.execute("BEGIN")
+        store.execute("SET k v")
+        store.execute("COMMIT")
+        self.assertEqual(store.data, [])  # Not applied until the outermost COMMIT
+        store.execute("ABORT")
+        self.assertEqual(store.execute("GET k"), ["nil"])
+
+
+class WatchTest(StoreTest):
+    def test_concurrent_write_aborts_commit(self):
+        store = self.open()
+        store.execute("SET k 1")
+        store.execute("WATCH k")
+        store.execute("BEGIN")
+        store.execute("SET k 2")
+        self.assertEqual(self.other_client(store, "SET k 3"), [["OK"]])
+        self.assertEqual(store.execute("COMMIT"), ["nil"])
+        self.assertEqual(store.execute("GET k"), ["3"])
+
+    def test_unchanged_key_commits(self):
+        store = self.open()
+        store.execute("SET k 1")
+        store.execute("WATCH k")
+        self.other_client(store, "GET k", "SET other x")
+        store.execute("BEGIN")
+        store.execute("SET k 2")
+        self.assertEqual(store.execute("COMMIT"), ["OK"])
+        self.assertEqual(store.execute("GET k"), ["2"])
+
+    def test_watching_a_missing_key_sees_its_creation(self):
+        store = self.open()
+        store.execute("WATCH k")
+        self.other_client(store, "SET k 1")
+        store.execute("BEGIN")
+        store.execute("SET k 2")
+        self.assertEqual(store.execute("COMMIT"), ["nil"])
+
+    def test_unwatch(self):
+        store = self.open()
+        store.execute("SET k 1")
+        store.execute("WATCH k")
+        self.other_client(store, "SET k 3")
+        self.assertEqual(store.execute("UNWATCH"), ["OK"])
+        store.execute("BEGIN")
+        store.execute("SET k 2")
+        self.assertEqual(store.execute("COMMIT"), ["OK"])
+
+
+class SnapshotIsolationTest(StoreTest):
+    def test_repeatable_reads_under_concurrent_writer(self):
+        store = self.open()
+        store.execute("MSET a 1 b 1")
+        store.execute("BEGIN")
+        self.assertEqual(store.execute("MGET a b"), ["1", "1"])
+        self.other_client(store, "MSET a 2 b 2", "SET c 2", "DEL b")
+        self.assertEqual(store.execute("MGET a b c"), ["1", "1", "nil"])
+        self.assertEqual(store.execute("PREFIX \"\""), ["a", "b", "END"])
+        store.execute("COMMIT")
+        self.assertEqual(store.execute("MGET a b c"), ["2", "nil", "2"])
+
+    def test_reads_own_writes_over_snapshot(self):
+        store = self.open()
+        store.execute("SET a 1")
+        store.execute("BEGIN")
+        store.execute("SET a 5")
+        self.other_client(store, "SET a 2")
+        self.assertEqual(store.execute("GET a"), ["5"])
+        store.execute("ABORT")
+        self.assertEqual(store.execute("GET a"), ["2"])
+
+    def test_writer_keeps_running_during_long_transaction(self):
+        store = self.open()
+        store.execute("SET counter 0")
+        store.execute("BEGIN")
+        stop = threading.Event()
+        writes = []
+
+        def writer():
+            store.bind_session(db.Session(authenticated=True))
+            i = 0
+            while not stop.is_set():
+                i += 1
+                store.execute(f"SET counter {i}")
+                writes.append(i)
+                time.sleep(0.001)  # Like a client's round trip; RWLock doesn't queue readers fairly
+
+        thread = threading.Thread(target=writer)
+        thread.start()
+        try:
+            for _ in range(200):
+                self.assertEqual(store.execute("GET counter"), ["0"])
+        finally:
+            stop.set()
+            thread.join()
+        store.execute("ABORT")
+        self.assertEqual(store.execute("GET counter"), [str(writes[-1])])
+
+
+def info_fields(lines: List[str]) -> dict:
+    """INFO-style name:value lines as a dict, without the END terminator"""
+    return dict(line.split(":", 1) for line in lines if line != "END")
+
+
+class InfoTest(StoreTest):
+    def test_counters_advance(self):
+        clock = db.ManualClock(1_000_000)
+        store = self.open(clock=clock)
+        before = info_fields(store.execute("INFO"))
+        store.execute("SET a 1")
+        store.execute("SETEX b 1 2")
+        clock.advance(2)
+        store.execute("GET b")
+        after = info_fields(store.execute("INFO"))
+        self.assertEqual(int(after["total_commands_processed"]), int(before["total_commands_processed"]) + 4)
+        self.assertEqual(after["keys"], "1")
+        self.assertEqual(after["expired_keys"], "1")
+        self.assertGreater(int(after["used_memory"]), int(before["used_memory"]))
+        self.assertGreater(int(after["log_size_bytes"]), 0)
+        self.assertEqual(after["db0"], "keys=1")
+
+
+class CommandStatsTest(StoreTest):
+    def test_tallies(self):
+        store = self.open()
+        store.execute("SET a 1")
+        store.execute("set b 2")
+        store.execute("GET a")
+        store.execute("BOGUS")
+        # COMMANDSTATS counts itself before replying
+        self.assertEqual(store.execute("COMMANDSTATS"), [
+            "cmdstat_commandstats:calls=1", "cmdstat_get:calls=1", "cmdstat_set:calls=2", "unknown_commands:1", "END"])
+
+    def test_commands_refused_for_want_of_auth_are_not_counted(self):
+        store = self.open(requirepass="hunter2")
+        store.bind_session(db.Session())  # A client that hasn't authenticated
+        self.assertError(store.execute("GET a"))
+        self.assertError(store.execute("BOGUS"))
+        store.execute("AUTH hunter2")
+        self.assertEqual(store.execute("COMMANDSTATS"), [
+            "cmdstat_auth:calls=1", "cmdstat_commandstats:calls=1", "unknown_commands:0", "END"])
+
+
+class SlowlogTest(StoreTest):
+    def test_captures_slow_command(self):
+        store = self.open(slowlog_threshold_us=0)
+        store.execute("SET k v")
+        newest = store.execute("SLOWLOG GET 1")
+        self.assertEqual(len(newest), 2)
+        self.assertTrue(newest[0].endswith(" command:SET k v"), newest)
+
+    def test_fast_commands_stay_out(self):
+        store = self.open(slowlog_threshold_us=10_000_000)
+        store.execute("SET k v")
+        self.assertEqual(store.execute("SLOWLOG GET"), ["END"])
+
+    def test_bounded_and_reset(self):
+        store = self.open(slowlog_threshold_us=0, slowlog_max_len=3)
+        for i in range(10):
+            store.execute(f"SET k{i} v")
+        self.assertEqual(len(store.execute("SLOWLOG GET -1")), 4)
+        self.assertEqual(store.execute("SLOWLOG RESET"), ["OK"])
+        self.assertEqual(len(store.execute("SLOWLOG GET -1")), 2)  # Just the GET before it
+
+    def test_auth_password_is_redacted(self):
+        store = self.open(slowlog_threshold_us=0, requirepass="hunter2")
+        store.execute("AUTH hunter2")
+        entries = store.execute("SLOWLOG GET")
+        self.assertTrue(entries[0].endswith(" command:AUTH (redacted)"), entries)
+        self.assertFalse(any("hunter2" in entry for entry in entries))
+
+
+class MemoryUsageTest(StoreTest):
+    def test_longer_value_uses_more(self):
+        store = self.open()
+        store.execute("SET short x")
+        store.execute(f"SET long {'x' * 1000}")
+        self.assertGreater(int(store.execute("MEMORY USAGE long")[0]), int(store.execute("MEMORY USAGE short")[0]))
+
+    def test_counts_container_elements(self):
+        store = self.open()
+        store.execute("RPUSH small a")
+        store.execute("RPUSH big a b c d e f g h")
+        self.assertGreater(int(store.execute("MEMORY USAGE big")[0]), int(store.execute("MEMORY USAGE small")[0]))
+
+    def test_missing_key(self):
+        self.assertEqual(self.open().execute("MEMORY USAGE missing"), ["nil"])
+
+
+class RangeTest(StoreTest):
+    def setUp(self):
+        super().setUp()
+        self.store = self.open()
+        self.store.execute("MSET a 1 b 2 c 3 d 4 e 5")
+
+    def test_reverse_matches_ascending_reversed(self):
+        ascending = self.store.execute("RANGE b d")
+        self.assertEqual(ascending, ["b", "c", "d", "END"])
+        self.assertEqual(self.store.execute("RANGEREV b d"), ascending[-2::-1] + ["END"])
+        self.assertEqual(self.store.execute('RANGEREV "" ""'), ["e", "d", "c", "b", "a", "END"])
+
+    def test_limit_and_offset_paginate(self):
+        pages = [self.store.execute(f"RANGE \"\" \"\" LIMIT 2 OFFSET {offset}") for offset in (0, 2, 4, 6)]
+        self.assertEqual(pages, [["a", "b", "END"], ["c", "d", "END"], ["e", "END"], ["END"]])
+        self.assertEqual(self.store.execute("RANGEREV \"\" \"\" OFFSET 1 LIMIT 2"), ["d", "c", "END"])
+        self.assertEqual(self.store.execute("RANGE a e LIMIT 0"), ["END"])
+
+    def test_bad_options(self):
+        for options in ("LIMIT", "LIMIT -1", "LIMIT x", "SKIP 1"):
+            self.assertError(self.store.execute(f"RANGE a e {options}"))
+
+    def test_exclusive_bounds(self):
+        self.assertEqual(self.store.execute("RANGE b d"), ["b", "c", "d", "END"])
+        self.assertEqual(self.store.execute("RANGE (b d"), ["c", "d", "END"])
+        self.assertEqual(self.store.execute("RANGE b (d"), ["b", "c", "END"])
+        self.assertEqual(self.store.execute("RANGE (b (d"), ["c", "END"])
+        self.assertEqual(self.store.execute("RANGEREV (b (d"), ["c", "END"])
+        # Bounds needn't be keys themselves
+        self.assertEqual(self.store.execute("RANGE (bb (dd"), ["c", "d", "END"])
+
+    def test_count_matches_range(self):
+        for bounds in ("b d", "(b d", '"" ""', "x z", "(a (b"):
+            keys = self.store.execute(f"RANGE {bounds}")[:-1]
+            self.assertEqual(self.store.execute(f"RANGECOUNT {bounds}"), [str(len(keys))])
+
+
+class PrefixTest(StoreTest):
+    def test_prefix_scan(self):
+        store = self.open()
+        store.execute("MSET user:1 a user:2 b users x use y other z")
+        self.assertEqual(store.execute("PREFIX user:"), ["user:1", "user:2", "END"])
+        self.assertEqual(store.execute("PREFIX user"), ["user:1", "user:2", "users", "END"])
+        self.assertEqual(store.execute("PREFIX nope"), ["END"])
+        self.assertEqual(store.execute('PREFIX ""'), ["other", "use", "user:1", "user:2", "users", "END"])
+
+    def test_skips_expired_keys(self):
+        clock = db.ManualClock(1_000_000)
+        store = self.open(clock=clock)
+        store.execute("SET p:1 a")
+        store.execute("SETEX p:2 1 b")
+        clock.advance(2)
+        self.assertEqual(store.execute("PREFIX p:"), ["p:1", "END"])
+
+
+class ListTest(StoreTest):
+    def test_push_pop_ordering(self):
+        store = self.open()
+        self.assertEqual(store.execute("RPUSH l a b"), ["2"])
+        self.assertEqual(store.execute("LPUSH l x y"), ["4"])  # Each LPUSH argument becomes the head in turn
+        self.assertEqual(store.execute("LPOP l"), ["y"])
+        self.assertEqual(store.execute("RPOP l"), ["b"])
+        self.assertEqual(store.execute("LLEN l"), ["2"])
+        self.assertEqual(store.execute("LPOP l"), ["x"])
+        self.assertEqual(store.execute("LPOP l"), ["a"])
+        self.assertEqual(store.execute("EXISTS l"), ["0"])  # An emptied list is removed
+        self.assertEqual(store.execute("LPOP l"), ["nil"])
+        self.assertEqual(store.execute("LLEN l"), ["0"])
+
+    def test_wrongtype_on_string_key(self):
+        store = self.open()
+        store.execute("SET s v")
+        for line in ("LPUSH s a", "RPUSH s a", "LPOP s", "RPOP s", "LLEN s"):
+            self.assertEqual(store.execute(line), [db.WRONGTYPE_ERROR])
+
+    def test_survives_restart(self):
+        store = self.open()
+        store.execute("RPUSH l a b c")
+        store.execute("LPOP l")
+        store = self.reopen(store)
+        self.assertEqual(store.execute("LLEN l"), ["2"])
+        self.assertEqual(store.execute("LPOP l"), ["b"])
+
+    def test_lrange_indices(self):
+        store = self.open()
+        store.execute("RPUSH l a b c d e")
+        self.assertEqual(store.execute("LRANGE l 0 -1"), ["a", "b", "c", "d", "e", "END"])
+        self.assertEqual(store.execute("LRANGE l -2 -1"), ["d", "e", "END"])
+        self.assertEqual(store.execute("LRANGE l 1 2"), ["b", "c", "END"])
+        self.assertEqual(store.execute("LRANGE l -100 1"), ["a", "b", "END"])
+        self.assertEqual(store.execute("LRANGE l 3 100"), ["d", "e", "END"])
+        self.assertEqual(store.execute("LRANGE l 3 1"), ["END"])
+        self.assertEqual(store.execute("LRANGE l 10 20"), ["END"])
+        self.assertEqual(store.execute("LRANGE missing 0 -1"), ["END"])
+        self.assertError(store.execute("LRANGE l a 1"))
+
+
+class HashTest(StoreTest):
+    def test_multi_field_hset_and_hgetall_order(self):
+        store = self.open()
+        self.assertEqual(store.execute("HSET h b 2 a 1 c 3"), ["3"])
+        self.assertEqual(store.execute("HSET h a 9 d 4"), ["1"])  # Only new fields count
+        # Fields come back in the order they were first set
+        self.assertEqual(store.execute("HGETALL h"), ["b", "2", "a", "9", "c", "3", "d", "4", "END"])
+        self.assertEqual(store.execute("HGET h a"), ["9"])
+        self.assertEqual(store.execute("HGET h zz"), ["nil"])
+
+    def test_hdel(self):
+        store = self.open()
+        store.execute("HSET h a 1 b 2")
+        self.assertEqual(store.execute("HDEL h a missing"), ["1"])
+        self.assertEqual(store.execute("HDEL h b"), ["1"])
+        self.assertEqual(store.execute("EXISTS h"), ["0"])
+
+    def test_odd_field_value_pairs(self):
+        self.assertError(self.open().execute("HSET h a 1 b"))
+
+    def test_survives_restart(self):
+        store = self.open()
+        store.execute("HSET h a 1 b 2")
+        store.execute("HDEL h a")
+        store = self.reopen(store)
+        self.assertEqual(store.execute("HGETALL h"), ["b", "2", "END"])
+
+    def test_hincrby(self):
+        store = self.open()
+        self.assertEqual(store.execute("HINCRBY h fresh 5"), ["5"])
+        store.execute("HSET h preset 10")
+        self.assertEqual(store.execute("HINCRBY h preset -3"), ["7"])
+        store.execute("HSET h text abc")
+        self.assertError(store.execute("HINCRBY h text 1"))
+        self.assertError(store.execute("HINCRBY h preset x"))
+        store = self.reopen(store)
+        self.assertEqual(store.execute("HGET h fresh"), ["5"])
+        self.assertEqual(store.execute("HGET h preset"), ["7"])
+
+
+class SetTest(StoreTest):
+    def test_sadd_counts_only_new_members(self):
+        store = self.open()
+        self.assertEqual(store.execute("SADD s a b a"), ["2"])
+        self.assertEqual(store.execute("SADD s a b"), ["0"])
+        self.assertEqual(store.execute("SCARD s"), ["2"])
+        self.assertEqual(store.execute("SMEMBERS s"), ["a", "b", "END"])
+
+    def test_srem_and_sismember(self):
+        store = self.open()
+        store.execute("SADD s a b")
+        self.assertEqual(store.execute("SISMEMBER s a"), ["1"])
+        self.assertEqual(store.execute("SREM s a missing"), ["1"])
+        self.assertEqual(store.execute("SISMEMBER s a"), ["0"])
+        self.assertEqual(store.execute("SREM s b"), ["1"])
+        self.assertEqual(store.execute("EXISTS s"), ["0"])
+        self.assertEqual(store.execute("SCARD s"), ["0"])
+
+    def test_set_algebra(self):
+        store = self.open()
+        store.execute("SADD x a b c")
+        store.execute("SADD y b c d")
+        store.execute("SADD z e")
+        self.assertEqual(store.execute("SINTER x y"), ["b", "c", "END"])
+        self.assertEqual(store.execute("SUNION x y"), ["a", "b", "c", "d", "END"])
+        self.assertEqual(store.execute("SDIFF x y"), ["a", "END"])
+        # Disjoint sets
+        self.assertEqual(store.execute("SINTER x z"), ["END"])
+        self.assertEqual(store.execute("SDIFF x z"), ["a", "b", "c", "END"])
+        # A missing key is an empty set
+        self.assertEqual(store.execute("SINTER x missing"), ["END"])
+        self.assertEqual(store.execute("SUNION x missing"), ["a", "b", "c", "END"])
+        self.assertEqual(store.execute("SDIFF x missing"), ["a", "b", "c", "END"])
+        self.assertEqual(store.execute("SDIFF missing x"), ["END"])
+
+    def test_set_algebra_wrongtype(self):
+        store = self.open()
+        store.execute("SADD x a")
+        store.execute("SET s v")
+        self.assertEqual(store.execute("SUNION x s"), [db.WRONGTYPE_ERROR])
+
+
+class SortedSetTest(StoreTest):
+    def test_score_ordering_and_ties(self):
+        store = self.open()
+        self.assertEqual(store.execute("ZADD z 2 b 1 a 2 c 0.5 d"), ["4"])
+        # Ties order by member
+        self.assertEqual(store.execute("ZRANGE z 0 -1"), ["d", "a", "b", "c", "END"])
+        self.assertEqual(store.execute("ZRANGE z 1 2"), ["a", "b", "END"])
+
+    def test_withscores(self):
+        store = self.open()
+        store.execute("ZADD z 2 b 1 a")
+        self.assertEqual(store.execute("ZRANGE z 0 -1 WITHSCORES"), ["a", "1", "b", "2", "END"])
+
+    def test_update_score(self):
+        store = self.open()
+        store.execute("ZADD z 1 a 2 b")
+        self.assertEqual(store.execute("ZADD z 3 a"), ["0"])
+        self.assertEqual(store.execute("ZSCORE z a"), ["3"])
+        self.assertEqual(store.execute("ZRANGE z 0 -1"), ["b", "a", "END"])
+        self.assertEqual(store.execute("ZSCORE z missing"), ["nil"])
+
+    def test_bad_score(self):
+        self.assertError(self.open().execute("ZADD z abc a"))
+
+    def test_survives_restart(self):
+        store = self.open()
+        store.execute("ZADD z 1.5 a 2 b")
+        store = self.reopen(store)
+        self.assertEqual(store.execute("ZRANGE z 0 -1 WITHSCORES"), ["a", "1.5", "b", "2", "END"])
+
+
+class DumpRestoreTest(StoreTest):
+    def test_restore_under_new_name_keeps_value_and_ttl(self):
+        clock = db.ManualClock(1_000_000)
+        store = self.open(clock=clock)
+        store.execute("SETEX src 60 hello")
+        blob = store.execute("DUMP src")[0]
+        clock.advance(10)
+        self.assertEqual(store.execute(f"RESTORE dst 0 {blob}"), ["OK"])
+        self.assertEqual(store.execute("GET dst"), ["hello"])
+        self.assertEqual(store.execute("PTTL dst"), ["50000"])
+        self.assertEqual(store.execute("PTTL dst"), store.execute("PTTL src"))
+
+    def test_containers_round_trip(self):
+        store = self.open()
+        store.execute("RPUSH l a b")
+        store.execute("HSET h f v")
+        store.execute("SADD s x y")
+        store.execute("ZADD z 1 m")
+        for key in ("l", "h", "s", "z"):
+            blob = store.execute(f"DUMP {key}")[0]
+            store.execute(f"RESTORE {key}2 0 {blob}")
+            self.assertEqual(store.execute(f"DEBUG EQUAL {key} {key}2 WITHTTL"), ["1"])
+
+    def test_replace_and_explicit_ttl(self):
+        store = self.open(clock=db.ManualClock(1_000_000))
+        store.execute("SET src v")
+        store.execute("SET dst old")
+        blob = store.execute("DUMP src")[0]
+        self.assertError(store.execute(f"RESTORE dst 0 {blob}"))
+        self.assertEqual(store.execute(f"RESTORE dst 5000 {blob} REPLACE"), ["OK"])
+        self.assertEqual(store.execute("GET dst"), ["v"])
+        self.assertEqual(store.execute("PTTL dst"), ["5000"])
+
+    def test_bad_blob(self):
+        store = self.open()
+        self.assertEqual(store.execute("DUMP missing"), ["nil"])
+        self.assertError(store.execute("RESTORE k 0 garbage"))
+
+
+class MaxMemoryTest(ServerTest):
+    def test_evicts_least_recently_accessed_first(self):
+        store = self.open()
+        store.execute("MSET k1 v k2 v k3 v")
+        store.execute("GET k1")  # Now k2 is the least recently used
+        store.maxmemory = store.used_memory  # Room for exactly these three keys
+        self.assertEqual(store.execute("SET k4 v"), ["OK"])
+        self.assertEqual(store.execute('PREFIX ""'), ["k1", "k3", "k4", "END"])
+        store.execute("GET k3")
+        store.execute("SET k5 v")
+        self.assertEqual(store.execute("EXISTS k1"), ["0"])
+        self.assertEqual(store.evicted_keys, 2)
+        self.assertLessEqual(store.used_memory, store.maxmemory)
+
+    def test_evictions_are_logged(self):
+        store = self.open()
+        store.execute("MSET k1 v k2 v")
+        store.maxmemory = store.used_memory
+        store.execute("SET k3 v")
+        store = self.reopen(store)
+        self.assertEqual(store.execute('PREFIX ""'), ["k2", "k3", "END"])
+
+    def test_value_larger_than_limit(self):
+        store = self.open(maxmemory=100)
+        self.assertError(store.execute(f"SET k {'x' * 1000}"))
+        self.assertEqual(store.execute("EXISTS k"), ["0"])
+
+    def test_http_put_respects_limits(self):
+        store = self.open(maxkeys=1)
+        address = self.serve(db.KVHTTPServer, store)
+        statuses = [self.request(address, "PUT", f"/keys/k{i}", "v")[0] for i in range(3)]
+        self.assertEqual(statuses, [204, 503, 503])
+        self.assertEqual(store.execute('PREFIX ""'), ["k0", "END"])
+
+
+class MaxKeysTest(StoreTest):
+    def test_noeviction_rejects_new_keys_at_the_cap(self):
+        store = self.open(maxkeys=2)
+        store.execute("MSET a 1 b 2")
+        self.assertEqual(store.execute("SET c 3"), ["ERR maxkeys reached"])
+        self.assertEqual(store.execute("SET a 9"), ["OK"])  # Overwriting doesn't add a key
+        self.assertEqual(store.execute("MSET a 1 c 3"), ["ERR maxkeys reached"])
+        self.assertEqual(store.execute('PREFIX ""'), ["a", "b", "END"])
+
+    def test_random_evicts_to_make_room(self):
+        store = self.open(maxkeys=2, maxkeys_policy="random")
+        store.execute("MSET a 1 b 2")
+        self.assertEqual(store.execute("SET c 3"), ["OK"])
+        keys = store.execute('PREFIX ""')[:-1]
+        self.assertEqual(len(keys), 2)
+        self.assertIn("c", keys)
+        self.assertEqual(store.evicted_keys, 1)
+
+    def test_random_cannot_evict_the_keys_being_written(self):
+        store = self.open(maxkeys=2, maxkeys_policy="random")
+        self.assertEqual(store.execute("MSET a 1 b 2 c 3"), ["ERR maxkeys reached"])
+
+    def test_cap_covers_all_databases(self):
+        store = self.open(maxkeys=2)
+        store.execute("SET a 1")
+        store.execute("SELECT 1")
+        store.execute("SET b 2")
+        self.assertEqual(store.execute("SET c 3"), ["ERR maxkeys reached"])
+
+
+class IdleTimeTest(StoreTest):
+    def test_idletime_grows_until_next_access(self):
+        clock = db.ManualClock(1_000_000)
+        store = self.open(clock=clock)
+        store.execute("SET k v")
+        store.execute("GET k")
+        clock.advance(5)
+        self.assertEqual(store.execute("OBJECT IDLETIME k"), ["5"])
+        clock.advance(3)
+        self.assertEqual(store.execute("OBJECT IDLETIME k"), ["8"])  # OBJECT isn't an access
+        store.execute("GET k")
+        self.assertEqual(store.execute("OBJECT IDLETIME k"), ["0"])
+
+    def test_missing_key(self):
+        self.assertError(self.open().execute("OBJECT IDLETIME missing"))
+
+
+class SetExTest(StoreTest):
+    def test_pttl_within_bounds(self):
+        clock = db.ManualClock(1_000_000)
+        store = self.open(clock=clock)
+        self.assertEqual(store.execute("SETEX k 10 v"), ["OK"])
+        clock.advance(0.25)
+        remaining = int(store.execute("PTTL k")[0])
+        self.assertTrue(9000 < remaining <= 10000, remaining)
+        self.assertEqual(store.execute("GET k"), ["v"])
+
+    def test_with_real_clock(self):
+        store = self.open()
+        store.execute("SETEX k 10 v")
+        remaining = int(store.execute("PTTL k")[0])
+        self.assertTrue(9000 < remaining <= 10000, remaining)
+
+    def test_rejects_bad_ttl(self):
+        store = self.open()
+        self.assertError(store.execute("SETEX k 0 v"))
+        self.assertError(store.execute("SETEX k -5 v"))
+        self.assertError(store.execute("SETEX k ten v"))
+        self.assertEqual(store.execute("EXISTS k"), ["0"])
+
+    def test_survives_restart(self):
+        clock = db.ManualClock(1_000_000)
+        store = self.open(clock=clock)
+        store.execute("SETEX k 10 v")
+        store = self.reopen(store, clock=clock)
+        self.assertEqual(store.execute("PTTL k"), ["10000"])
+
+
+class PSetExTest(StoreTest):
+    def test_pttl_reflects_requested_milliseconds(self):
+        store = self.open(clock=db.ManualClock(1_000_000))
+        self.assertEqual(store.execute("PSETEX k 1234 v"), ["OK"])
+        self.assertEqual(store.execute("PTTL k"), ["1234"])
+        self.assertEqual(store.execute("GET k"), ["v"])
+
+    def test_rejects_bad_ttl(self):
+        store = self.open()
+        self.assertError(store.execute("PSETEX k 0 v"))
+        self.assertError(store.execute("PSETEX k 1.5 v"))
+
+
+class GetExTest(StoreTest):
+    def setUp(self):
+        super().setUp()
+        self.store = self.open(clock=db.ManualClock(1_000_000))
+        self.store.execute("SETEX k 100 v")
+
+    def test_no_option_leaves_ttl(self):
+        self.assertEqual(self.store.execute("GETEX k"), ["v"])
+        self.assertEqual(self.store.execute("PTTL k"), ["100000"])
+
+    def test_ex(self):
+        self.assertEqual(self.store.execute("GETEX k EX 5"), ["v"])
+        self.assertEqual(self.store.execute("PTTL k"), ["5000"])
+
+    def test_px(self):
+        self.assertEqual(self.store.execute("GETEX k PX 250"), ["v"])
+        self.assertEqual(self.store.execute("PTTL k"), ["250"])
+
+    def test_persist(self):
+        self.assertEqual(self.store.execute("GETEX k PERSIST"), ["v"])
+        self.assertEqual(self.store.execute("PTTL k"), ["-1"])
+
+    def test_bad_options(self):
+        for options in ("EX", "EX 0", "EX x", "PERSIST 5", "KEEP"):
+            self.assertError(self.store.execute(f"GETEX k {options}"))
+        self.assertEqual(self.store.execute("PTTL k"), ["100000"])
+
+    def test_missing_key(self):
+        self.assertEqual(self.store.execute("GETEX missing EX 5"), ["nil"])
+        self.assertEqual(self.store.execute("EXISTS missing"), ["0"])
+
+
+class DelPatternTest(StoreTest):
+    def test_removes_only_matching_keys(self):
+        store = self.open()
+        store.execute("MSET user:1 a user:2 b users c other d")
+        self.assertEqual(store.execute("DELPATTERN user:*"), ["2"])
+        self.assertEqual(store.execute('PREFIX ""'), ["other", "users", "END"])
+        self.assertEqual(store.execute("DELPATTERN ?sers"), ["1"])
+        self.assertEqual(store.execute("DELPATTERN nomatch*"), ["0"])
+
+    def test_empty_pattern_is_refused(self):
+        store = self.open()
+        store.execute("SET k v")
+        self.assertError(store.execute('DELPATTERN ""'))
+        self.assertEqual(store.execute("EXISTS k"), ["1"])
+
+
+class SelectTest(StoreTest):
+    def test_databases_are_isolated(self):
+        store = self.open()
+        store.execute("SET k zero")
+        self.assertEqual(store.execute("SELECT 1"), ["OK"])
+        self.assertEqual(store.execute("GET k"), ["nil"])
+        store.execute("SET k one")
+        store.execute("SELECT 0")
+        self.assertEqual(store.execute("GET k"), ["zero"])
+
+    def test_out_of_range(self):
+        store = self.open(databases=2)
+        self.assertError(store.execute("SELECT 2"))
+        self.assertError(store.execute("SELECT -1"))
+        self.assertError(store.execute("SELECT x"))
+
+    def test_survives_restart(self):
+        store = self.open()
+        store.execute("SELECT 3")
+        store.execute("SET k three")
+        store.execute("SELECT 0")
+        store.execute("SET k zero")
+        store = self.reopen(store)
+        self.assertEqual(store.execute("GET k"), ["zero"])
+        store.execute("SELECT 3")
+        self.assertEqual(store.execute("GET k"), ["three"])
+
+    def test_each_client_selects_its_own(self):
+        store = self.open()
+        store.execute("SELECT 1")
+        store.execute("SET k one")
+        self.assertEqual(self.other_client(store, "GET k"), [["nil"]])
+
+
+class SwapDBTest(StoreTest):
+    def test_swaps_contents(self):
+        store = self.open()
+        store.execute("SET a zero")
+        store.execute("SELECT 1")
+        store.execute("SET b one")
+        self.assertEqual(store.execute("SWAPDB 0 1"), ["OK"])
+        self.assertEqual(store.execute('PREFIX ""'), ["a", "END"])
+        store.execute("SELECT 0")
+        self.assertEqual(store.execute('PREFIX ""'), ["b", "END"])
+        store = self.reopen(store)
+        self.assertEqual(store.execute('PREFIX ""'), ["b", "END"])
+
+    def test_out_of_range(self):
+        self.assertError(self.open(databases=2).execute("SWAPDB 0 2"))
+
+
+class MoveTest(StoreTest):
+    def test_moves_key_with_ttl(self):
+        store = self.open(clock=db.ManualClock(1_000_000))
+        store.execute("SETEX k 30 v")
+        self.assertEqual(store.execute("MOVE k 2"), ["1"])
+        self.assertEqual(store.execute("EXISTS k"), ["0"])
+        store.execute("SELECT 2")
+        self.assertEqual(store.execute("GET k"), ["v"])
+        self.assertEqual(store.execute("PTTL k"), ["30000"])
+
+    def test_refuses_when_destination_has_key(self):
+        store = self.open()
+        store.execute("SET k src")
+        store.execute("SELECT 1")
+        store.execute("SET k dst")
+        store.execute("SELECT 0")
+        self.assertEqual(store.execute("MOVE k 1"), ["0"])
+        self.assertEqual(store.execute("GET k"), ["src"])
+
+    def test_missing_key_and_same_db(self):
+        store = self.open()
+        self.assertEqual(store.execute("MOVE missing 1"), ["0"])
+        store.execute("SET k v")
+        self.assertError(store.execute("MOVE k 0"))
+
+
+class ReplicaTest(StoreTest):
+    def test_replica_converges_with_primary(self):
+        primary = self.open()
+        primary.execute("SET a 1")
+        replica = self.open(readonly=True)
+        self.assertEqual(replica.execute("GET a"), ["1"])
+        primary.execute("SET b 2")
+        primary.execute("DEL a")
+        primary.execute("SELECT 1")
+        primary.execute("RPUSH l x")
+        self.assertGreater(replica.poll_log(), 0)
+        self.assertEqual(self.state(replica), self.state(primary))
+
+    def test_tailing_thread(self):
+        primary = self.open()
+        replica = self.open(readonly=True)
+        replica.start_tailing(interval=0.01)
+        for i in range(20):
+            primary.execute(f"SET k{i} {i}")
+        deadline = time.monotonic() + 5
+        while self.state(replica) != self.state(primary) and time.monotonic() < deadline:
+            time.sleep(0.01)
+        self.assertEqual(self.state(replica), self.state(primary))
+
+    def test_follows_compaction(self):
+        primary = self.open()
+        replica = self.open(readonly=True)
+        primary.execute("MSET a 1 b 2")
+        primary.execute("DEL a")
+        primary.execute("COMPACT")
+        primary.execute("SET c 3")
+        replica.poll_log()
+        self.assertEqual(self.state(replica), self.state(primary))
+
+    def test_poll_keeps_caller_database(self):
+        primary = self.open()
+        replica = self.open(readonly=True)
+        primary.execute("SELECT 2")
+        primary.execute("SET k v")
+        replica.poll_log()
+        self.assertEqual(replica.execute("GET k"), ["nil"])  # Still in database 0
+        replica.execute("SELECT 2")
+        self.assertEqual(replica.execute("GET k"), ["v"])
+
+    def test_replica_rejects_writes(self):
+        self.open()
+        replica = self.open(readonly=True)
+        self.assertEqual(replica.execute("SET k v"), [db.READONLY_ERROR])
+        self.assertFalse(os.path.exists(self.path))
+
+
+class ShutdownTest(StoreTest):
+    def test_syncs_log_and_stops_servers(self):
+        store = self.open(fsync_policy="no")
+        server = db.KVServer(store, "127.0.0.1:0")
+        threading.Thread(target=server.serve_forever, args=(0.05,), daemon=True).start()
+        store.execute("SET k v")
+        with mock.patch.object(db.os, "fsync", wraps=os.fsync) as fsync:
+            self.assertTrue(db.shutdown(store, [server]))
+        self.assertEqual(fsync.call_count, 1)
+        self.assertTrue(store.closed)
+        self.assertError(store.execute("GET k"))
+        with self.assertRaises(OSError):
+            socket.create_connection(server.server_address, timeout=1)
+
+    def test_gives_up_on_a_stuck_command(self):
+        store = self.open()
+        held, release = threading.Event(), threading.Event()
+
+        def stuck():
+            store._lock.acquire_write()
+            held.set()
+            release.wait()
+            store._lock.release_write()
+
+        threading.Thread(target=stuck, daemon=True).start()
+        held.wait()
+        try:
+            self.assertFalse(db.shutdown(store, [], timeout=0.1))
+        finally:
+            release.set()
+
+    def test_sigterm_exits_cleanly(self):
+        with subprocess.Popen([sys.executable, db.__file__, "--appendfsync", "no"], cwd=self.dir, text=True,
+                              stdin=subprocess.PIPE, stdout=subprocess.PIPE, stderr=subprocess.PIPE) as proc:
+            proc.stdin.write("SET k v\n")
+            proc.stdin.flush()
+            self.assertEqual(proc.stdout.readline(), "OK\n")
+            proc.send_signal(signal.SIGTERM)
+            self.assertEqual(proc.wait(10), 0)
+        self.assertEqual(log_entries(self.path), ["SET k v"])
+
+
+class CommandTest(StoreTest):
+    def test_lists_commands_with_arity(self):
+        listing = self.open().execute("COMMAND")
+        self.assertEqual(listing[-1], "END")
+        arities = dict(line.split(" ") for line in listing[:-1])
+        self.assertEqual(arities["GET"], "1")
+        self.assertEqual(arities["SET"], "2")
+        self.assertEqual(arities["CAS"], "3")
+        self.assertEqual(arities["PING"], "0")
+        self.assertEqual(list(arities), sorted(arities))
+        self.assertEqual(set(arities), set(db.COMMAND_TABLE))
+
+
+class CommandRegistryTest(StoreTest):
+    def test_arity_checked_before_handler_runs(self):
+        store = self.open()
+        handler = mock.Mock(return_value=["OK"])
+        with mock.patch.dict(db.COMMAND_TABLE, {"GET": db.CommandSpec(handler, 1, 1)}):
+            self.assertEqual(store.execute("GET"), ["ERR wrong number of arguments for GET"])
+            self.assertEqual(store.execute("GET a b"), ["ERR wrong number of arguments for GET"])
+            handler.assert_not_called()
+            store.execute("GET a")
+            handler.assert_called_once_with(store, ["a"])
+
+    def test_unknown_command(self):
+        self.assertEqual(self.open().execute("NOPE a"), ["ERR invalid command or arguments"])
+
+    def test_names_are_case_insensitive(self):
+        store = self.open()
+        self.assertEqual(store.execute("set k v"), ["OK"])
+        self.assertEqual(store.execute("Get k"), ["v"])
+
+    def test_handler_exception_becomes_error_reply(self):
+        store = self.open()
+        with mock.patch.dict(db.COMMAND_TABLE, {"GET": db.CommandSpec(mock.Mock(side_effect=ValueError("boom")), 1, 1)}):
+            self.assertEqual(store.execute("GET a"), ["ERR boom"])
+
+
+class PingEchoTest(StoreTest):
+    def test_ping(self):
+        store = self.open()
+        self.assertEqual(store.execute("PING"), ["PONG"])
+        self.assertEqual(store.execute("PING hello"), ["hello"])
+
+    def test_echo(self):
+        self.assertEqual(self.open().execute('ECHO "hello world"'), ["hello world"])
+
+
+class CompareAndSetTest(StoreTest):
+    def test_match(self):
+        store = self.open()
+        store.execute("SET k old")
+        self.assertEqual(store.execute("CAS k old new"), ["1"])
+        self.assertEqual(store.execute("GET k"), ["new"])
+
+    def test_mismatch(self):
+        store = self.open()
+        store.execute("SET k old")
+        self.assertEqual(store.execute("CAS k other new"), ["0"])
+        self.assertEqual(store.execute("GET k"), ["old"])
+
+    def test_missing_key(self):
+        store = self.open()
+        self.assertEqual(store.execute("CAS k old new"), ["0"])
+        self.assertEqual(store.execute("EXISTS k"), ["0"])
+
+    def test_keeps_ttl_and_survives_restart(self):
+        clock = db.ManualClock(1_000_000)
+        store = self.open(clock=clock)
+        store.execute("SETEX k 30 old")
+        store.execute("CAS k old new")
+        store = self.reopen(store, clock=clock)
+        self.assertEqual(store.execute("GET k"), ["new"])
+        self.assertEqual(store.execute("PTTL k"), ["30000"])
+
+    def test_wrongtype(self):
+        store = self.open()
+        store.execute("RPUSH l a")
+        self.assertEqual(store.execute("CAS l a b"), [db.WRONGTYPE_ERROR])
+
+
+class CompareAndDeleteTest(StoreTest):
+    def test_mismatch_keeps_key(self):
+        store = self.open()
+        store.execute("SET k mine")
+        self.assertEqual(store.execute("CAD k theirs"), ["0"])
+        self.assertEqual(store.execute("GET k"), ["mine"])
+
+    def test_match_deletes(self):
+        store = self.open()
+        store.execute("SET k mine")
+        self.assertEqual(store.execute("CAD k mine"), ["1"])
+        store = self.reopen(store)
+        self.assertEqual(store.execute("EXISTS k"), ["0"])
+
+    def test_missing_key(self):
+        self.assertEqual(self.open().execute("CAD k v"), ["0"])
+
+
+class ExpirePatternTest(StoreTest):
+    def test_unmatched_keys_keep_their_ttl(self):
+        clock = db.ManualClock(1_000_000)
+        store = self.open(clock=clock)
+        store.execute("MSET session:1 a session:2 b other c")
+        store.execute("SETEX kept 90 d")
+        self.assertEqual(store.execute("EXPIREPATTERN session:* 5000"), ["2"])
+        self.assertEqual(store.execute("PTTL session:1"), ["5000"])
+        self.assertEqual(store.execute("PTTL session:2"), ["5000"])
+        self.assertEqual(store.execute("PTTL other"), ["-1"])
+        self.assertEqual(store.execute("PTTL kept"), ["90000"])
+        clock.advance(6)
+        self.assertEqual(store.execute('PREFIX ""'), ["kept", "other", "END"])
+
+    def test_survives_restart(self):
+        clock = db.ManualClock(1_000_000)
+        store = self.open(clock=clock)
+        store.execute("MSET a:1 x a:2 y")
+        store.execute("EXPIREPATTERN a:* 5000")
+        store = self.reopen(store, clock=clock)
+        self.assertEqual(store.execute("PTTL a:2"), ["5000"])
+
+    def test_empty_pattern_is_refused(self):
+        self.assertError(self.open().execute('EXPIREPATTERN "" 5000'))
+
+
+class ExpireFlagsTest(StoreTest):
+    def setUp(self):
+        super().setUp()
+        self.store = self.open(clock=db.ManualClock(1_000_000))
+        self.store.execute("SET plain v")
+        self.store.execute("SETEX timed 100 v")
+
+    def expire(self, key: str, seconds: int, flag: str) -> Tuple[str, str]:
+        """EXPIRE's reply and the key's PTTL after it"""
+        return self.store.execute(f"EXPIRE {key} {seconds} {flag}")[0], self.store.execute(f"PTTL {key}")[0]
+
+    def test_nx(self):
+        self.assertEqual(self.expire("plain", 50, "NX"), ("1", "50000"))
+        self.assertEqual(self.expire("timed", 50, "NX"), ("0", "100000"))
+
+    def test_xx(self):
+        self.assertEqual(self.expire("plain", 50, "XX"), ("0", "-1"))
+        self.assertEqual(self.expire("timed", 50, "XX"), ("1", "50000"))
+
+    def test_gt(self):
+        self.assertEqual(self.expire("plain", 50, "GT"), ("0", "-1"))  # No TTL counts as forever
+        self.assertEqual(self.expire("timed", 50, "GT"), ("0", "100000"))
+        self.assertEqual(self.expire("timed", 200, "GT"), ("1", "200000"))
+
+    def test_lt(self):
+        self.assertEqual(self.expire("plain", 50, "LT"), ("1", "50000"))
+        self.assertEqual(self.expire("timed", 200, "LT"), ("0", "100000"))
+        self.assertEqual(self.expire("timed", 50, "LT"), ("1", "50000"))
+
+    def test_incompatible_flags(self):
+        for flags in ("NX XX", "GT LT", "NX GT", "SOON"):
+            self.assertError(self.store.execute(f"EXPIRE timed 50 {flags}"))
+        self.assertEqual(self.store.execute("PTTL timed"), ["100000"])
+
+    def test_flags_on_pexpire_and_expireat(self):
+        self.assertEqual(self.store.execute("PEXPIRE timed 500 GT"), ["0"])
+        self.assertEqual(self.store.execute("EXPIREAT plain 1000010 NX"), ["1"])
+        self.assertEqual(self.store.execute("PEXPIREAT plain 1000020000 XX"), ["1"])
+        self.assertEqual(self.store.execute("PTTL plain"), ["20000"])
+
+
+class DurationTest(StoreTest):
+    def test_numeric_and_suffixed_ttls(self):
+        store = self.open(clock=db.ManualClock(1_000_000))
+        store.execute("SET k v")
+        for seconds, expected in (("90", "90000"), ("5s", "5000"), ("2m", "120000"), ("1h", "3600000"),
+                                  ("1h30m", "5400000"), ("1.5s", "1500"), ("250ms", "250")):
+            self.assertEqual(store.execute(f"EXPIRE k {seconds}"), ["1"])
+            self.assertEqual(store.execute("PTTL k"), [expected], seconds)
+        store.execute("PEXPIRE k 1500")
+        self.assertEqual(store.execute("PTTL k"), ["1500"])
+        store.execute("PEXPIRE k 2s")
+        self.assertEqual(store.execute("PTTL k"), ["2000"])
+
+    def test_parse_duration(self):
+        self.assertEqual(db._parse_duration("1m30s"), 90_000)
+        self.assertEqual(db._parse_duration("-2s"), -2000)
+        for text in ("", "5", "5x", "s", "1h 2m"):
+            self.assertIsNone(db._parse_duration(text), text)
+
+    def test_rejects_invalid_and_non_finite_ttls(self):
+        store = self.open()
+        store.execute("SET k v")
+        for ttl in ("soon", "5 s", "inf", "-inf", "nan", "1e400", "9" * 400 + "h"):
+            self.assertEqual(store.execute(f'EXPIRE k "{ttl}"'), ["ERR invalid expire time"], ttl)
+        self.assertEqual(store.execute("PEXPIRE k nan"), ["ERR invalid expire time"])
+        self.assertEqual(store.execute("EXPIREPATTERN k* inf"), ["ERR invalid expire time"])
+        self.assertEqual(store.execute("PTTL k"), ["-1"])
+
+
+class WrongTypeTest(ServerTest):
+    def test_string_commands_on_list_and_list_commands_on_string(self):
+        store = self.open()
+        store.execute("RPUSH l a")
+        store.execute("SET s v")
+        self.assertEqual(store.execute("GET l"), [db.WRONGTYPE_ERROR])
+        self.assertEqual(store.execute("LPUSH s a"), [db.WRONGTYPE_ERROR])
+        self.assertEqual(store.execute("HSET s f v"), [db.WRONGTYPE_ERROR])
+        self.assertEqual(store.execute("SADD l m"), [db.WRONGTYPE_ERROR])
+        self.assertEqual(store.execute("ZADD s 1 m"), [db.WRONGTYPE_ERROR])
+        # The failed writes changed nothing
+        self.assertEqual(store.execute("TYPE l"), ["list"])
+        self.assertEqual(store.execute("GET s"), ["v"])
+
+    def test_set_replaces_any_type(self):
+        store = self.open()
+        store.execute("RPUSH l a")
+        self.assertEqual(store.execute("SET l v"), ["OK"])
+        self.assertEqual(store.execute("GET l"), ["v"])
+
+    def test_http_get_of_non_string_is_a_conflict(self):
+        store = self.open()
+        store.execute("HSET h f v")
+        store.execute("SET s ERRATA")
+        address = self.serve(db.KVHTTPServer, store)
+        status, body = self.request(address, "GET", "/keys/h")
+        self.assertEqual(status, 409)
+        self.assertIn("WRONGTYPE", body)
+        self.assertEqual(self.request(address, "GET", "/keys/s"), (200, "ERRATA"))
+
+
+class BinarySafeTest(StoreTest):
+    VALUE = "nul\x00new\nline\r\ttab \"quoted\" \\ bytes:\udcff\udc80"
+
+    def test_round_trip_through_restart(self):
+        store = self.open()
+        self.assertEqual(store.set("key with spaces\n", self.VALUE), "OK")
+        store.execute("HSET h f\x00 " + db._quote_arg(self.VALUE))
+        store = self.reopen(store)
+        self.assertEqual(store.get("key with spaces\n"), self.VALUE)
+        self.assertEqual(store.execute("HGET h f\x00"), [self.VALUE])
+
+    def test_quoted_protocol_arguments(self):
+        store = self.open()
+        store.execute('SET k "a\\x00b\\nc\\xff"')
+        self.assertEqual(store.get("k"), "a\x00b\nc\udcff")
+        self.assertEqual(db.format_line_reply(store.get("k")), '"a\\x00b\\nc\\xff"')
+
+    def test_binary_log_format(self):
+        store = self.open(log_format="binary")
+        store.set("k", self.VALUE)
+        store = self.reopen(store)
+        self.assertEqual(store.get("k"), self.VALUE)
+
+
+class LogFormatTest(StoreTest):
+    def write_and_replay(self, log_format: str):
+        store = self.open(log_format=log_format)
+        store.execute("SET a 1")
+        store.execute("RPUSH l x y")
+        store.execute("HSET h f v")
+        store.execute("DEL a")
+        store.execute("SET b 2")
+        return self.reopen(store, log_format=log_format)
+
+    def test_text_format(self):
+        store = self.write_and_replay("text")
+        self.assertEqual(store.execute("MGET a b"), ["nil", "2"])
+        self.assertEqual(store.execute("LRANGE l 0 -1"), ["x", "y", "END"])
+        with open(self.path, "rb") as f:
+            self.assertNotEqual(f.read(1), b"\x00")
+
+    def test_binary_format(self):
+        store = self.write_and_replay("binary")
+        self.assertEqual(store.execute("MGET a b"), ["nil", "2"])
+        self.assertEqual(store.execute("HGET h f"), ["v"])
+        with open(self.path, "rb") as f:
+            self.assertEqual(f.read(len(db.BinaryLogCodec.header)), db.BinaryLogCodec.header)
+
+    def test_existing_log_keeps_its_format(self):
+        store = self.open(log_format="binary")
+        store.execute("SET a 1")
+        # The header says binary, whatever the store is configured with
+        store = self.reopen(store, log_format="text")
+        store.execute("SET b 2")
+        store = self.reopen(store)
+        self.assertEqual(store.execute("MGET a b"), ["1", "2"])
+        with open(self.path, "rb") as f:
+            self.assertTrue(f.read().startswith(db.BinaryLogCodec.header))
+
+    def test_compact_converts_to_configured_format(self):
+        store = self.open()
+        store.execute("SET a 1")
+        store = self.reopen(store, log_format="binary")
+        store.execute("COMPACT")
+        store = self.reopen(store)
+        self.assertEqual(store.execute("GET a"), ["1"])
+        with open(self.path, "rb") as f:
+            self.assertTrue(f.read().startswith(db.BinaryLogCodec.header))
+
+    def test_unknown_header_is_refused(self):
+        with open(self.path, "wb") as f:
+            f.write(b"\x00KVSLOG9")
+        with self.assertRaises(ValueError):
+            self.open()
+
+
+class RotationTest(StoreTest):
+    def segments(self) -> List[str]:
+        prefix = os.path.basename(self.path) + "."
+        return sorted(name for name in os.listdir(self.dir) if name.startswith(prefix) and name[len(prefix):].isdigit())
+
+    def test_tiny_threshold_rotates_and_state_survives(self):
+        store = self.open(log_rotate_size=200, log_keep=2)
+        for i in range(100):
+            store.execute(f"SET k{i % 10} v{i}")
+        store.execute("DEL k0")
+        self.assertTrue(self.segments())
+        self.assertLessEqual(len(self.segments()), 2)
+        store = self.reopen(store, log_rotate_size=200, log_keep=2)
+        self.assertEqual(len(self.state(store)[0]), 9)
+        self.assertEqual(store.execute("MGET k0 k1 k9"), ["nil", "v91", "v99"])
+
+    def test_restart_replays_segments_in_order(self):
+        store = self.open(log_rotate_size=200, log_keep=5, clock=db.ManualClock(1_000_000))
+        for i in range(80):
+            # Each SETEX is compacted to two entries, so rotation numbers them past the segment's end
+            store.execute(f"SETEX k{i} 100 v{i}")
+            if i == 3:
+                store.execute("RPUSH list a b c")
+            if i % 10 == 9:
+                store.execute(f"DEL k{i - 5}")
+        store.execute("SET k1 v")
+        store.execute("EXPIRE k1 100")
+        self.assertGreaterEqual(len(self.segments()), 3)
+        with open(self.path) as f:
+            self.assertTrue(f.readline().split(" ", 1)[1].startswith("ROTATED "))
+        expected = self.state(store)
+        store = self.reopen(store, log_rotate_size=200, log_keep=5, clock=db.ManualClock(1_000_000))
+        self.assertEqual(self.state(store), expected)
+        self.assertEqual(store.execute("LRANGE list 0 -1"), ["a", "b", "c", "END"])  # Not restated on top of itself
+        self.assertEqual(store.execute("TTL k1"), ["100"])
+
+    def test_segments_before_a_manual_compaction_are_left_out(self):
+        store = self.open(log_rotate_size=200, log_keep=5)
+        for i in range(40):
+            store.execute(f"SET k{i % 4} v{i}")
+        self.assertTrue(self.segments())
+        store.execute("DEL k0")
+        store.execute("COMPACT")  # Starts the log afresh, continuing no segment
+        store = self.reopen(store, log_rotate_size=200, log_keep=5)
+        self.assertEqual(store.execute("MGET k0 k1"), ["nil", "v37"])
+
+    def test_damaged_segment_falls_back_to_the_log(self):
+        store = self.open(log_rotate_size=200, log_keep=5)
+        for i in range(40):
+            store.execute(f"SET k{i % 4} v{i}")
+        self.assertTrue(self.segments())
+        with open(os.path.join(self.dir, self.segments()[-1]), "a") as f:
+            f.write("SET k0 ")  # No newline: an incomplete record
+        store = self.reopen(store, log_rotate_size=200, log_keep=5)
+        self.assertEqual(store.execute("MGET k0 k3"), ["v36", "v39"])
+        self.assertEqual(store.replay_errors, [])
+
+    def test_disabled_by_default(self):
+        store = self.open()
+        for i in range(100):
+            store.execute(f"SET k{i} v{i}")
+        self.assertEqual(self.segments(), [])
+
+    def test_crash_between_renames_restores_the_segment(self):
+        store = self.open()
+        store.execute("SET a 1")
+        store.close()
+        # Rotation renamed the log to its segment but not the compacted log into place
+        os.replace(self.path, self.path + ".1")
+        store = self.open()
+        self.assertEqual(store.execute("GET a"), ["1"])
+        self.assertTrue(os.path.exists(self.path))
+
+
+class TornRecordTest(StoreTest):
+    def test_truncated_text_record_is_cut(self):
+        with open(self.path, "w") as f:
+            f.write(log_line("SET a 1"))
+            f.write(log_line("SET b 2")[:-5])  # A crash mid-append
+        store = self.open()
+        self.assertEqual(store.execute("MGET a b"), ["1", "nil"])
+        self.assertEqual(store.replay_errors, [])
+        self.assertEqual(os.path.getsize(self.path), len(log_line("SET a 1")))
+        with open(store.torn_tail_file) as f:
+            self.assertEqual(f.read(), log_line("SET b 2")[:-5])
+        store.execute("SET c 3")
+        store = self.reopen(store)
+        self.assertEqual(store.execute("MGET a b c"), ["1", "nil", "3"])
+
+    def test_truncated_binary_record_is_cut(self):
+        codec = db.LOG_CODECS["binary"]
+        good = codec.header + codec.encode(("SET", "a", "1"))
+        with open(self.path, "wb") as f:
+            f.write(good + codec.encode(("SET", "b", "x" * 100))[:50])
+        store = self.open()
+        self.assertEqual(store.execute("MGET a b"), ["1", "nil"])
+        self.assertEqual(store.torn_tail_bytes, 50)
+        self.assertEqual(store.torn_tail_file, f"{self.path}.cut.{len(good)}")
+        self.assertEqual(os.path.getsize(self.path), len(good))
+        store.execute("SET c 3")
+        store = self.reopen(store)
+        self.assertEqual(store.execute("MGET a b c"), ["1", "nil", "3"])
+
+    def write_corrupt_length(self) -> bytes:
+        codec = db.LOG_CODECS["binary"]
+        middle = bytearray(codec.encode(("SET", "b", "2")))
+        middle[0:4] = (1000).to_bytes(4, "big")  # Runs past the end, yet a valid record follows
+        data = (codec.header + codec.encode(("SET", "a", "1")) + bytes(middle)
+                + codec.encode(("SET", "c", "3")))
+        with open(self.path, "wb") as f:
+            f.write(data)
+        return data
+
+    def test_corrupt_length_mid_log_is_resynced(self):
+        self.write_corrupt_length()
+        store = self.open()
+        self.assertEqual(store.execute("MGET a b c"), ["1", "nil", "3"])
+        self.assertEqual(len(store.replay_errors), 1)
+        self.assertIsNone(store.torn_tail_file)
+
+    def test_corrupt_length_mid_log_refuses_strict_start(self):
+        data = self.write_corrupt_length()
+        with self.assertRaises(db.LogCorruptionError):
+            self.open(strict=True)
+        with open(self.path, "rb") as f:
+            self.assertEqual(f.read(), data)  # The log is left as it was
+
+
+class DebugSleepTest(ServerTest):
+    def test_sleeps_at_least_the_requested_time(self):
+        store = self.open()
+        start = time.monotonic()
+        self.assertEqual(store.execute("DEBUG SLEEP 100"), ["OK"])
+        self.assertGreaterEqual(time.monotonic() - start, 0.1)
+
+    def test_invalid_durations(self):
+        store = self.open()
+        self.assertError(store.execute("DEBUG SLEEP -1"))
+        self.assertError(store.execute("DEBUG SLEEP soon"))
+
+    def test_blocks_only_its_own_connection(self):
+        address = self.serve(db.KVServer, self.open())
+        sleeper, other = self.connect(address), self.connect(address)
+        start = time.monotonic()
+        sleeper.sendall(b"DEBUG SLEEP 500\n")
+        time.sleep(0.05)
+        other.sendall(b"SET k v\nGET k\n")
+        self.assertEqual(self.read_lines(other, 2), ["OK", "v"])
+        self.assertLess(time.monotonic() - start, 0.5)
+        self.assertEqual(self.read_lines(sleeper, 1), ["OK"])
+        self.assertGreaterEqual(time.monotonic() - start, 0.5)
+
+
+class DebugObjectTest(StoreTest):
+    def debug_object(self, store: db.KVStore, key: str) -> dict:
+        (reply,) = store.execute(f"DEBUG OBJECT {key}")
+        return dict(field.split(":", 1) for field in reply.split())
+
+    def test_fields_of_key_with_ttl(self):
+        clock = db.ManualClock(1_000_000)
+        store = self.open(clock=clock)
+        store.execute("SETEX k 10 hello")
+        clock.advance(2)
+        store.execute("GET k")
+        clock.advance(1)
+        fields = self.debug_object(store, "k")
+        self.assertEqual(fields["type"], "string")
+        self.assertEqual(fields["length"], "5")
+        self.assertEqual(fields["volatile"], "1")
+        self.assertEqual(fields["pttl"], "7000")
+        self.assertEqual(fields["last_access_ms"], "1000002000")  # DEBUG OBJECT isn't an access
+        self.assertIn("size", fields)
+
+    def test_fields_of_persistent_list(self):
+        store = self.open()
+        store.execute("RPUSH l a b c")
+        fields = self.debug_object(store, "l")
+        self.assertEqual((fields["type"], fields["length"]), ("list", "3"))
+        self.assertEqual((fields["volatile"], fields["pttl"]), ("0", "-1"))
+
+    def test_missing_key(self):
+        store = self.open()
+        self.assertEqual(store.execute("DEBUG OBJECT nope"), ["ERR no such key"])
+        self.assertError(store.execute("DEBUG OBJECT nope"))
+
+
+class PubSubTest(ServerTest):
+    def test_in_process_subscriber_receives_message(self):
+        store = self.open()
+        self.assertEqual(store.execute("SUBSCRIBE news sport"), ["subscribe news 1", "subscribe sport 2"])
+        self.assertEqual(self.other_client(store, "PUBLISH news hello", "PUBLISH weather rain"), [["1"], ["0"]])
+        self.assertEqual(store.session.messages.get(timeout=1), ("news", "hello"))
+        self.assertTrue(store.session.messages.empty())
+
+    def test_unsubscribed_session_stops_receiving(self):
+        store = self.open()
+        store.execute("SUBSCRIBE news")
+        self.assertEqual(store.execute("UNSUBSCRIBE"), ["unsubscribe news 0"])
+        self.assertEqual(self.other_client(store, "PUBLISH news hello"), [["0"]])
+        self.assertTrue(store.session.messages.empty())
+
+    def test_messages_are_not_logged(self):
+        store = self.open()
+        store.execute("PUBLISH news hello")
+        store.execute("SET k v")
+        self.assertEqual(log_entries(self.path), ["SET k v"])
+
+    def test_server_pushes_to_subscriber_connection(self):
+        address = self.serve(db.KVServer, self.open())
+        subscriber, publisher = self.connect(address), self.connect(address)
+        subscriber.sendall(b"SUBSCRIBE news\n")
+        self.assertEqual(self.read_lines(subscriber, 1), ["subscribe news 1"])
+        publisher.sendall(b"PUBLISH news \"hello world\"\n")
+        self.assertEqual(self.read_lines(publisher, 1), ["1"])
+        self.assertEqual(self.read_lines(subscriber, 1), ['message news "hello world"'])
+
+
+class KeyspaceEventTest(StoreTest):
+    def drain(self, session: db.Session) -> List[Tuple[str, str]]:
+        messages = []
+        while not session.messages.empty():
+            messages.append(session.messages.get_nowait())
+        return messages
+
+    def test_keyevent_set_notification(self):
+        store = self.open(notify_keyspace_events=True)
+        store.execute("SUBSCRIBE __keyevent__:set")
+        self.other_client(store, "SET k v", "SETEX t 10 v", "DEL k")
+        self.assertEqual(self.drain(store.session), [("__keyevent__:set", "k"), ("__keyevent__:set", "t")])
+
+    def test_keyspace_channel_names_the_events(self):
+        clock = db.ManualClock(1_000_000)
+        store = self.open(notify_keyspace_events=True, clock=clock)
+        store.execute("SUBSCRIBE __keyspace__:k")
+        self.other_client(store, "SET k v", "EXPIRE k 1")
+        clock.advance(2)
+        self.other_client(store, "GET k")
+        self.assertEqual([message for _, message in self.drain(store.session)], ["set", "expire", "expired"])
+
+    def test_disabled_by_default(self):
+        store = self.open()
+        store.execute("SUBSCRIBE __keyevent__:set")
+        self.other_client(store, "SET k v")
+        self.assertEqual(self.drain(store.session), [])
+
+
+class BlockingPopTest(StoreTest):
+    def blocked_client(self, store: db.KVStore, line: str) -> Tuple[threading.Thread, list]:
+        """A thread running line as a client of its own, and the list its reply lands in"""
+        results = []
+
+        def run():
+            store.bind_session(db.Session(authenticated=True))
+            results.append(store.execute(line))
+
+        thread = threading.Thread(target=run)
+        thread.start()
+        return thread, results
+
+    def test_push_unblocks_waiting_pop(self):
+        store = self.open()
+        thread, results = self.blocked_client(store, "BLPOP a b 5")
+        time.sleep(0.05)
+        self.assertEqual(results, [])  # Still waiting
+        store.execute("RPUSH b x y")
+        thread.join(5)
+        self.assertEqual(results, [["b", "x"]])
+        self.assertEqual(store.execute("LRANGE b 0 -1"), ["y", "END"])
+
+    def test_brpop_pops_from_the_tail(self):
+        store = self.open()
+        thread, results = self.blocked_client(store, "BRPOP l 5")
+        time.sleep(0.05)
+        store.execute("LPUSH l x y")
+        thread.join(5)
+        self.assertEqual(results, [["l", "x"]])
+
+    def test_available_element_returns_at_once(self):
+        store = self.open()
+        store.execute("RPUSH l x")
+        self.assertEqual(store.execute("BLPOP l 0"), ["l", "x"])
+
+    def test_timeout_returns_nil(self):
+        store = self.open()
+        start = time.monotonic()
+        self.assertEqual(store.execute("BLPOP l 0.1"), ["nil"])
+        self.assertGreaterEqual(time.monotonic() - start, 0.1)
+
+    def test_close_wakes_waiters(self):
+        store = self.open()
+        thread, results = self.blocked_client(store, "BLPOP l 0")
+        time.sleep(0.05)
+        store.close()
+        thread.join(5)
+        self.assertEqual(results, [["nil"]])
+
+    def test_invalid_timeouts(self):
+        store = self.open()
+        self.assertError(store.execute("BLPOP l -1"))
+        self.assertError(store.execute("BLPOP l soon"))
+        self.assertError(store.execute("BLPOP l inf"))
+
+
+class MsetAtomicityTest(StoreTest):
+    def test_mget_never_sees_half_applied_mset(self):
+        store = self.open(fsync_policy="no")
+        store.execute("MSET a 0 b 0 c 0")
+        stop = threading.Event()
+        torn = []
+
+        def write():
+            store.bind_session(db.Session(authenticated=True))
+            for i in range(1, 100):
+                store.execute(f"MSET a {i} b {i} c {i}")
+                time.sleep(0.001)  # The lock doesn't queue fairly; let readers in
+            stop.set()
+
+        def read():
+            store.bind_session(db.Session(authenticated=True))
+            while not stop.is_set():
+                values = store.execute("MGET a b c")
+                if len(set(values)) != 1:
+                    torn.append(values)
+
+        threads = [threading.Thread(target=write)] + [threading.Thread(target=read) for _ in range(3)]
+        for thread in threads:
+            thread.start()
+        for thread in threads:
+            thread.join(30)
+        self.assertEqual(torn, [])
+        self.assertEqual(store.execute("MGET a b c"), ["99", "99", "99"])
+
+    def test_fsyncs_once_per_mset(self):
+        store = self.open()
+        store.execute("SET warm up")
+        with mock.patch.object(db.os, "fsync", wraps=os.fsync) as fsync:
+            store.execute("MSET a 1 b 2 c 3")
+        self.assertEqual(fsync.call_count, 1)
+        self.assertEqual(log_entries(self.path)[-3:], ["SET a 1", "SET b 2", "SET c 3"])
+
+    def test_odd_argument_count_writes_nothing(self):
+        store = self.open()
+        self.assertError(store.execute("MSET a 1 b"))
+        self.assertEqual(store.execute("MGET a b"), ["nil", "nil"])
+
+
+class MsetnxTest(StoreTest):
+    def test_sets_all_when_none_exist(self):
+        store = self.open()
+        self.assertEqual(store.execute("MSETNX a 1 b 2"), ["1"])
+        self.assertEqual(store.execute("MGET a b"), ["1", "2"])
+
+    def test_one_existing_key_makes_it_a_no_op(self):
+        store = self.open()
+        store.execute("SET b old")
+        self.assertEqual(store.execute("MSETNX a 1 b 2 c 3"), ["0"])
+        self.assertEqual(store.execute("MGET a b c"), ["nil", "old", "nil"])
+        self.assertEqual(log_entries(self.path), ["SET b old"])
+
+    def test_key_of_another_type_counts_as_existing(self):
+        store = self.open()
+        store.execute("RPUSH b x")
+        self.assertEqual(store.execute("MSETNX a 1 b 2"), ["0"])
+        self.assertEqual(store.execute("GET a"), ["nil"])
+
+    def test_consults_the_transaction_buffer(self):
+        store = self.open()
+        store.execute("BEGIN")
+        store.execute("SET b queued")
+        self.assertEqual(store.execute("MSETNX a 1 b 2"), ["0"])
+        store.execute("DEL b")
+        self.assertEqual(store.execute("MSETNX a 1 b 2"), ["1"])
+        store.execute("COMMIT")
+        self.assertEqual(store.execute("MGET a b"), ["1", "2"])
+
+    def test_expired_key_doesnt_count(self):
+        clock = db.ManualClock(1_000_000)
+        store = self.open(clock=clock)
+        store.execute("SETEX b 1 old")
+        clock.advance(2)
+        self.assertEqual(store.execute("MSETNX a 1 b 2"), ["1"])
+        self.assertEqual(store.execute("TTL b"), ["-1"])
+
+
+class SetStoreTest(StoreTest):
+    def setUp(self):
+        super().setUp()
+        self.store = self.open()
+        self.store.execute("SADD x a b c")
+        self.store.execute("SADD y b c d")
+
+    def test_stored_results_match_reads(self):
+        store = self.store
+        self.assertEqual(store.execute("SINTERSTORE i x y"), ["2"])
+        self.assertEqual(store.execute("SMEMBERS i"), store.execute("SINTER x y"))
+        self.assertEqual(store.execute("SUNIONSTORE u x y missing"), ["4"])
+        self.assertEqual(store.execute("SMEMBERS u"), store.execute("SUNION x y missing"))
+
+    def test_overwrites_destination_of_any_type(self):
+        store = self.store
+        store.execute("SETEX dest 100 old")
+        self.assertEqual(store.execute("SUNIONSTORE dest x"), ["3"])
+        self.assertEqual(store.execute("TYPE dest"), ["set"])
+        self.assertEqual(store.execute("TTL dest"), ["-1"])
+
+    def test_destination_can_be_a_source(self):
+        store = self.store
+        self.assertEqual(store.execute("SINTERSTORE x x y"), ["2"])
+        self.assertEqual(store.execute("SMEMBERS x"), ["b", "c", "END"])
+
+    def test_empty_result_deletes_destination(self):
+        store = self.store
+        store.execute("SADD dest z")
+        self.assertEqual(store.execute("SINTERSTORE dest x missing"), ["0"])
+        self.assertEqual(store.execute("TYPE dest"), ["none"])
+
+    def test_wrong_type_source_leaves_destination(self):
+        store = self.store
+        store.execute("SET s v")
+        store.execute("SADD dest z")
+        self.assertEqual(store.execute("SUNIONSTORE dest x s"), [db.WRONGTYPE_ERROR])
+        self.assertEqual(store.execute("SMEMBERS dest"), ["z", "END"])
+
+    def test_results_survive_restart(self):
+        self.store.execute("SINTERSTORE i x y")
+        self.store.execute("SINTERSTORE gone x missing")
+        store = self.reopen(self.store)
+        self.assertEqual(store.execute("SMEMBERS i"), ["b", "c", "END"])
+        self.assertEqual(store.execute("TYPE gone"), ["none"])
+
+
+class GetRangeTest(StoreTest):
+    def setUp(self):
+        super().setUp()
+        self.store = self.open()
+        self.store.execute("SET k 'Hello World'")
+
+    def test_positive_offsets_are_inclusive(self):
+        self.assertEqual(self.store.execute("GETRANGE k 0 4"), ["Hello"])
+        self.assertEqual(self.store.execute("GETRANGE k 6 6"), ["W"])
+
+    def test_negative_offsets_count_from_the_end(self):
+        self.assertEqual(self.store.execute("GETRANGE k -5 -1"), ["World"])
+        self.assertEqual(self.store.execute("GETRANGE k 0 -1"), ["Hello World"])
+        self.assertEqual(self.store.execute("GETRANGE k -3 2"), [""])
+
+    def test_out_of_range_offsets_clamp(self):
+        self.assertEqual(self.store.execute("GETRANGE k -100 4"), ["Hello"])
+        self.assertEqual(self.store.execute("GETRANGE k 6 100"), ["World"])
+        self.assertEqual(self.store.execute("GETRANGE k 50 100"), [""])
+
+    def test_missing_key_is_empty(self):
+        self.assertEqual(self.store.execute("GETRANGE missing 0 -1"), [""])
+
+    def test_offsets_are_bytes(self):
+        self.store.set("u", "héllo")
+        self.assertEqual(self.store.execute("GETRANGE u 0 2"), ["hé"])
+
+    def test_errors(self):
+        self.store.execute("RPUSH l a")
+        self.assertEqual(self.store.execute("GETRANGE l 0 -1"), [db.WRONGTYPE_ERROR])
+        self.assertError(self.store.execute("GETRANGE k a 1"))
+
+
+class SetRangeTest(StoreTest):
+    def test_overwrite_in_the_middle(self):
+        store = self.open()
+        store.execute("SET k 'Hello World'")
+        self.assertEqual(store.execute("SETRANGE k 6 Redis"), ["11"])
+        self.assertEqual(store.get("k"), "Hello Redis")
+        self.assertEqual(store.execute("SETRANGE k 1 a"), ["11"])
+        self.assertEqual(store.get("k"), "Hallo Redis")
+
+    def test_pads_beyond_length_with_nul_bytes(self):
+        store = self.open()
+        store.execute("SET k ab")
+        self.assertEqual(store.execute("SETRANGE k 4 cd"), ["6"])
+        self.assertEqual(store.get("k"), "ab\x00\x00cd")
+        self.assertEqual(store.execute("SETRANGE missing 2 x"), ["3"])
+        self.assertEqual(store.get("missing"), "\x00\x00x")
+
+    def test_empty_patch_leaves_missing_key_missing(self):
+        store = self.open()
+        self.assertEqual(store.execute("SETRANGE k 10 ''"), ["0"])
+        self.assertEqual(store.execute("EXISTS k"), ["0"])
+
+    def test_logs_the_whole_value_and_keeps_ttl(self):
+        clock = db.ManualClock(1_000_000)
+        store = self.open(clock=clock)
+        store.execute("SETEX k 100 ab")
+        store.execute("SETRANGE k 3 c")
+        self.assertEqual(log_entries(self.path)[-1], db._command_line("SET", "k", "ab\x00c", "KEEPTTL"))
+        self.assertEqual(store.execute("TTL k"), ["100"])
+        store = self.reopen(store, clock=clock)
+        self.assertEqual(store.get("k"), "ab\x00c")
+        self.assertEqual(store.execute("TTL k"), ["100"])
+
+    def test_inside_a_transaction(self):
+        store = self.open()
+        store.execute("SET k abc")
+        store.execute("BEGIN")
+        store.execute("SETRANGE k 1 X")
+        self.assertEqual(self.other_client(store, "GET k"), [["abc"]])
+        self.assertEqual(store.execute("GET k"), ["aXc"])
+        store.execute("COMMIT")
+        self.assertEqual(self.other_client(store, "GET k"), [["aXc"]])
+
+    def test_size_cap_and_bad_offsets(self):
+        store = self.open()
+        self.assertEqual(store.execute(f"SETRANGE k {db.MAX_STRING_SIZE} x"),
+                         ["ERR string exceeds maximum allowed size"])
+        self.assertEqual(store.execute("EXISTS k"), ["0"])
+        self.assertError(store.execute("SETRANGE k -1 x"))
+        self.assertError(store.execute("SETRANGE k one x"))
+
+
+class ArityTest(StoreTest):
+    def test_over_supplied_arguments_are_refused(self):
+        store = self.open()
+        store.execute("SET a 1")
+        self.assertEqual(store.execute("GET a b"), ["ERR wrong number of arguments for GET"])
+        self.assertEqual(store.execute("TTL a b"), ["ERR wrong number of arguments for TTL"])
+        self.assertEqual(store.execute("MOVE a 1 extra"), ["ERR wrong number of arguments for MOVE"])
+        self.assertEqual(store.execute("GET a"), ["1"])  # Nothing ran
+
+    def test_under_supplied_arguments_are_refused(self):
+        store = self.open()
+        self.assertEqual(store.execute("GET"), ["ERR wrong number of arguments for GET"])
+        self.assertEqual(store.execute("EXPIRE a"), ["ERR wrong number of arguments for EXPIRE"])
+        self.assertEqual(store.execute("MGET"), ["ERR wrong number of arguments for MGET"])
+
+    def test_variadic_commands_are_exempt(self):
+        store = self.open()
+        self.assertEqual(store.execute("MSET a 1 b 2 c 3"), ["OK"])
+        self.assertEqual(store.execute("MGET a b c d"), ["1", "2", "3", "nil"])
+
+    def test_lenient_mode_drops_extra_arguments(self):
+        store = self.open(strict_arity=False)
+        store.execute("SET a 1")
+        self.assertEqual(store.execute("GET a b"), ["1"])
+        self.assertEqual(store.execute("MOVE a 1 extra"), ["1"])
+        self.assertEqual(store.execute("GET a"), ["nil"])
+        # Too few arguments are still refused
+        self.assertEqual(store.execute("GET"), ["ERR wrong number of arguments for GET"])
+
+
+class CompactCrashTest(StoreTest):
+    def test_crash_before_rename_leaves_original_log(self):
+        store = self.open()
+        store.execute("SET a 1")
+        store.execute("SET a 2")
+        store.execute("RPUSH l x")
+        expected = self.state(store)
+        with open(self.path, "rb") as f:
+            original = f.read()
+
+        # The process dies once the temporary log is written but before it's renamed into place
+        with mock.patch.object(db.os, "replace", side_effect=SystemExit):
+            with self.assertRaises(SystemExit):
+                store.compact()
+        self.assertTrue(os.path.exists(self.path + ".tmp"))
+        with open(self.path, "rb") as f:
+            self.assertEqual(f.read(), original)
+
+        restarted = self.open()
+        self.assertEqual(self.state(restarted), expected)
+        # A later compaction writes over the leftover temporary log
+        self.assertEqual(restarted.compact(), 2)
+        self.assertFalse(os.path.exists(self.path + ".tmp"))
+        self.assertEqual(self.state(self.reopen(restarted)), expected)
+
+    def test_syncs_in_crash_safe_order(self):
+        calls = []
+        store = self.open(sync_directory=lambda path: calls.append(("sync_dir", path)))
+        store.execute("SET a 1")
+        calls.clear()
+        real_fsync, real_replace = os.fsync, os.replace
+
+        def fsync(fd):
+            calls.append(("fsync", os.fstat(fd).st_ino))
+            real_fsync(fd)
+
+        def replace(src, dst):
+            calls.append(("replace", os.path.basename(src), os.path.basename(dst)))
+            real_replace(src, dst)
+
+        with mock.patch.object(db.os, "fsync", fsync), mock.patch.object(db.os, "replace", replace):
+            store.compact()
+        # The file fsynced is the temporary log, which the rename turns into the log
+        self.assertEqual(calls, [("fsync", os.stat(self.path).st_ino), ("replace", "data.db.tmp", "data.db"),
+                                 ("sync_dir", self.dir)])
+        # The append handle is reopened on the new log
+        store.execute("SET b 2")
+        self.assertEqual(log_entries(self.path), ["SET a 1", "SET b 2"])
+
+
+class IdempotentReplayTest(StoreTest):
+    def write_log(self) -> db.KVStore:
+        clock = db.ManualClock(1_000_000)
+        store = self.open(clock=clock)
+        store.execute("RPUSH l a b")
+        store.execute("HINCRBY h f 2")
+        store.execute("HINCRBY h f 3")
+        store.execute("SADD s x")
+        store.execute("SELECT 1")
+        store.execute("SETEX t 100 v")
+        store.execute("DEL gone")
+        return store
+
+    def test_replaying_the_log_twice_changes_nothing(self):
+        store = self.write_log()
+        expected = self.state(store)
+        store.close()
+        with open(self.path, "rb") as f:
+            log = f.read()
+        # The same entries again, as merging a log with a copy of itself would leave it
+        with open(self.path, "wb") as f:
+            f.write(log + log)
+        store = self.open(clock=db.ManualClock(1_000_000))
+        self.assertEqual(self.state(store), expected)
+        self.assertEqual(store.execute("LRANGE l 0 -1"), ["a", "b", "END"])
+        self.assertEqual(store.execute("HGET h f"), ["5"])
+        self.assertEqual(store.replay_errors, [])
+
+    def test_writes_after_a_doubled_replay_continue_the_sequence(self):
+        store = self.write_log()
+        store.close()
+        with open(self.path, "rb") as f:
+            log = f.read()
+        with open(self.path, "wb") as f:
+            f.write(log + log)
+        store = self.open(clock=db.ManualClock(1_000_000))
+        store.execute("HINCRBY h f 1")
+        store = self.reopen(store, clock=db.ManualClock(1_000_000))
+        self.assertEqual(store.execute("HGET h f"), ["6"])
+
+    def test_setex_survives_compaction_and_restart(self):
+        clock = db.ManualClock(1_000_000)
+        store = self.open(clock=clock)
+        store.execute("SETEX k 100 v")
+        store.execute("SET other 1")
+        store.execute("COMPACT")
+        clock.advance(10)
+        store = self.reopen(store, clock=clock)
+        self.assertEqual(store.execute("GET k"), ["v"])
+        self.assertEqual(store.execute("TTL k"), ["90"])
+        clock.advance(100)
+        self.assertEqual(store.execute("GET k"), ["nil"])
+        self.assertEqual(store.execute("GET other"), ["1"])
+
+
+class ExpiryRaceTest(StoreTest):
+    def test_concurrent_reads_during_active_expiration(self):
+        clock = db.ManualClock(1_000_000)
+        store = self.open(clock=clock, fsync_policy="no")
+        for i in range(200):
+            store.execute(f"PSETEX v{i} 1000 x" if i % 2 else f"SET p{i} x")
+        clock.advance(2)
+        errors = []
+        done = threading.Event()
+
+        def read(offset):
+            store.bind_session(db.Session(authenticated=True))
+            while not done.is_set():
+                for i in range(offset, 200, 3):
+                    key = f"v{i}" if i % 2 else f"p{i}"
+                    value = store.execute(f"GET {key}")
+                    # Expired keys are gone to readers whether or not they've been removed yet
+                    if value != (["nil"] if i % 2 else ["x"]):
+                        errors.append((key, value))
+
+        readers = [threading.Thread(target=read, args=(offset,)) for offset in range(3)]
+        for thread in readers:
+            thread.start()
+        try:
+            time.sleep(0.02)
+            removed = store.sweep_expired()
+        finally:
+            done.set()
+            for thread in readers:
+                thread.join()
+
+        self.assertEqual(errors, [])
+        self.assertEqual(store.expired_keys, 100)
+        self.assertLessEqual(removed, 100)
+        self.assertEqual(len(self.state(store)[0]), 100)
+        # Each expired key was removed, and its DEL logged, exactly once
+        deletes = [entry for entry in log_entries(self.path) if entry.startswith("DEL ")]
+        self.assertEqual(sorted(deletes), sorted(f"DEL v{i}" for i in range(1, 200, 2)))
+        self.assertEqual(self.state(self.reopen(store, clock=clock)), self.state(store))
+
+
+class KeepTTLTest(StoreTest):
+    def setUp(self):
+        super().setUp()
+        self.clock = db.ManualClock(1_000_000)
+        self.store = self.open(clock=self.clock)
+        self.store.execute("SETEX k 100 old")
+        self.clock.advance(10)
+
+    def test_keepttl_preserves_expiry(self):
+        self.assertEqual(self.store.execute("SET k new KEEPTTL"), ["OK"])
+        self.assertEqual(self.store.execute("GET k"), ["new"])
+        self.assertEqual(self.store.execute("PEXPIRETIME k"), ["1000100000"])
+
+    def test_keepttl_inside_transaction(self):
+        store = self.store
+        store.execute("BEGIN")
+        store.execute("SET k new keepttl")
+        self.assertEqual(store.execute("TTL k"), ["90"])
+        store.execute("COMMIT")
+        self.assertEqual(store.execute("GET k"), ["new"])
+        self.assertEqual(store.execute("TTL k"), ["90"])
+
+    def test_lone_keepttl_is_the_value(self):
+        self.assertEqual(self.store.execute("SET k KEEPTTL"), ["OK"])
+        self.assertEqual(self.store.execute("GET k"), ["KEEPTTL"])
+
+    def test_kept_expiry_survives_restart(self):
+        self.store.execute("SET k new KEEPTTL")
+        store = self.reopen(self.store, clock=self.clock)
+        self.assertEqual(store.execute("GET k"), ["new"])
+        self.assertEqual(store.execute("TTL k"), ["90"])
+        self.clock.advance(91)
+        self.assertEqual(store.execute("GET k"), ["nil"])
+
+    def test_plain_set_clears_ttl(self):
+        self.assertEqual(self.store.execute("SET k new"), ["OK"])
+        self.assertEqual(self.store.execute("TTL k"), ["-1"])
+        store = self.reopen(self.store, clock=self.clock)
+        self.assertEqual(store.execute("GET k"), ["new"])
+        self.assertEqual(store.execute("TTL k"), ["-1"])
+
+    def test_plain_set_clears_ttl_inside_transaction(self):
+        store = self.store
+        store.execute("BEGIN")
+        store.execute("SET k new")
+        self.assertEqual(store.execute("TTL k"), ["-1"])
+        store.execute("COMMIT")
+        self.assertEqual(store.execute("TTL k"), ["-1"])
+        self.assertEqual(self.reopen(store, clock=self.clock).execute("TTL k"), ["-1"])
+
+    def test_mset_clears_ttl(self):
+        self.store.execute("MSET k new other v")
+        self.assertEqual(self.store.execute("TTL k"), ["-1"])
+        self.assertEqual(self.reopen(self.store, clock=self.clock).execute("TTL k"), ["-1"])
+
+    def test_kept_expiry_of_a_compressed_value_survives_restart(self):
+        value = "x" * 2048
+        store = self.reopen(self.store, clock=self.clock, compress_threshold=1024)
+        store.execute(f"SET k {value} KEEPTTL")
+        self.assertTrue(log_entries(self.path)[-1].startswith("SETZ k "))
+        store = self.reopen(store, clock=self.clock, compress_threshold=1024)
+        self.assertEqual(store.get("k"), value)
+        self.assertEqual(store.execute("TTL k"), ["90"])
+
+
+class ReplayTTLTest(StoreTest):
+    def test_replay_matches_live_ttls(self):
+        clock = db.ManualClock(1_000_000)
+        store = self.open(clock=clock)
+        # SET, EXPIRE, SET KEEPTTL: the expiry carries over the second SET
+        store.execute("SET kept a")
+        store.execute("EXPIRE kept 100")
+        store.execute("SET kept b KEEPTTL")
+        # DEL, SET, EXPIRE: the EXPIRE applies to the new key
+        store.execute("SETEX recreated 5 a")
+        store.execute("DEL recreated")
+        store.execute("SET recreated b")
+        store.execute("EXPIRE recreated 50")
+        # SET over an expired key starts without a TTL
+        store.execute("SETEX lapsed 1 a")
+        clock.advance(2)
+        store.execute("SET lapsed b")
+        # PERSIST, then SET KEEPTTL keeps there being none
+        store.execute("SETEX persisted 100 a")
+        store.execute("PERSIST persisted")
+        store.execute("SET persisted b KEEPTTL")
+        expected = self.state(store)
+
+        store = self.reopen(store, clock=clock)
+        self.assertEqual(self.state(store), expected)
+        self.assertEqual(store.execute("MGET kept recreated lapsed persisted"), ["b", "b", "b", "b"])
+        self.assertEqual([store.execute(f"TTL {key}")[0] for key in ("kept", "recreated", "lapsed", "persisted")],
+                         ["98", "48", "-1", "-1"])
+
+    def test_keepttl_entry_preserves_ttl_on_replay(self):
+        clock = db.ManualClock(1_000_000)
+        with open(self.path, "w") as f:
+            f.write(log_line("SET k a"))
+            f.write(log_line("PEXPIREAT k 1000060000"))
+            f.write(log_line("SET k b KEEPTTL"))
+            f.write(log_line("SET other a"))
+            f.write(log_line("PEXPIREAT other 1000060000"))
+            f.write(log_line("SET other b"))
+        store = self.open(clock=clock)
+        self.assertEqual(store.execute("MGET k other"), ["b", "b"])
+        self.assertEqual(store.execute("TTL k"), ["60"])
+        self.assertEqual(store.execute("TTL other"), ["-1"])
+
+
+class DirectorySyncTest(StoreTest):
+    def open_recording(self, **options) -> Tuple[db.KVStore, List[str]]:
+        synced = []
+        return self.open(sync_directory=synced.append, **options), synced
+
+    def test_synced_when_the_log_is_created(self):
+        store, synced = self.open_recording()
+        self.assertEqual(synced, [])  # The log is created by the first write
+        store.execute("SET a 1")
+        self.assertEqual(synced, [self.dir])
+        store.execute("SET b 2")
+        self.assertEqual(synced, [self.dir])
+
+    def test_not_synced_for_an_existing_log(self):
+        store, _ = self.open_recording()
+        store.execute("SET a 1")
+        store.close()
+        store, synced = self.open_recording()
+        store.execute("SET b 2")
+        self.assertEqual(synced, [])
+
+    def test_synced_after_each_rotation(self):
+        store, synced = self.open_recording(log_rotate_size=200, log_keep=1)
+        for i in range(60):
+            store.execute(f"SET k{i % 5} v{i}")
+        rotations = len([name for name in os.listdir(self.dir) if name.startswith("data.db.")])
+        self.assertGreaterEqual(rotations, 1)
+        # Creating the log, then a rename (and a pruning) per rotation
+        self.assertGreater(len(synced), 2)
+        self.assertEqual(set(synced), {self.dir})
+
+    def test_skipped_under_no_fsync_policy(self):
+        store, synced = self.open_recording(fsync_policy="no")
+        store.execute("SET a 1")
+        store.execute("COMPACT")
+        self.assertEqual(synced, [])
+
+
+class NocaseKeysTest(StoreTest):
+    def test_keys_differing_in_case_are_one_key_when_on(self):
+        store = self.open(nocase_keys=True)
+        store.execute("SET Foo Bar")
+        self.assertEqual(store.execute("GET foo"), ["Bar"])  # Values keep their case
+        self.assertEqual(store.execute("GET FOO"), ["Bar"])
+        self.assertEqual(store.execute("DEL fOO"), ["1"])
+        self.assertEqual(store.execute("GET Foo"), ["nil"])
+
+    def test_keys_are_distinct_when_off(self):
+        store = self.open()
+        store.execute("SET Foo Bar")
+        self.assertEqual(store.execute("GET foo"), ["nil"])
+        store.execute("SET foo baz")
+        self.assertEqual(store.execute("MGET Foo foo"), ["Bar", "baz"])
+
+    def test_every_key_argument_is_folded(self):
+        store = self.open(nocase_keys=True, clock=db.ManualClock(1_000_000))
+        store.execute("MSET A 1 b 2 C 3")
+        self.assertEqual(store.execute("MGET a B c"), ["1", "2", "3"])
+        self.assertEqual(store.execute("RANGE A C"), store.execute("RANGE a c"))
+        self.assertEqual(store.execute("EXPIRE B 100"), ["1"])
+        self.assertEqual(store.execute("TTL b"), ["100"])
+        store.execute("SADD S1 X")
+        store.execute("SADD s2 X")
+        self.assertEqual(store.execute("SINTER s1 S2"), ["X", "END"])
+
+    def test_keys_are_logged_folded(self):
+        store = self.open(nocase_keys=True)
+        store.execute("SET Foo Bar")
+        self.assertEqual(log_entries(self.path), ["SET foo Bar"])
+        # Replay finds the folded key whichever way the flag is set
+        store = self.reopen(store)
+        self.assertEqual(store.execute("GET foo"), ["Bar"])
+        self.assertEqual(store.execute("GET Foo"), ["nil"])
+
+
+class ClockTest(StoreTest):
+    def test_expiry_follows_the_clock_not_real_time(self):
+        clock = db.ManualClock(1_000_000)
+        store = self.open(clock=clock)
+        store.execute("SETEX k 10 v")
+        time.sleep(0.01)
+        self.assertEqual(store.execute("PTTL k"), ["10000"])
+        clock.advance(9.5)
+        self.assertEqual(store.execute("PTTL k"), ["500"])
+
+    def test_ttl_agrees_with_get_at_the_exact_expiry(self):
+        clock = db.ManualClock(1_000_000)
+        store = self.open(clock=clock)
+        store.execute("SETEX k 10 v")
+        clock.advance(10)
+        self.assertEqual(store.execute("PTTL k"), ["0"])
+        self.assertEqual(store.execute("GET k"), ["v"])
+        clock.advance(0.001)
+        self.assertEqual(store.execute("PTTL k"), ["-2"])
+
+    def test_sweeper_uses_the_clock(self):
+        clock = db.ManualClock(1_000_000)
+        store = self.open(clock=clock)
+        store.execute("SETEX k 10 v")
+        self.assertEqual(store.sweep_expired(), 0)
+        clock.advance(11)
+        self.assertEqual(store.sweep_expired(), 1)
+        self.assertEqual(store.expired_keys, 1)
+
+    def test_stepping_the_clock_back_delays_expiry(self):
+        # Expiries are wall-clock times, so a clock stepped back keeps keys alive longer
+        clock = db.ManualClock(1_000_000)
+        store = self.open(clock=clock)
+        store.execute("SETEX k 10 v")
+        clock.advance(-60)
+        self.assertEqual(store.execute("TTL k"), ["70"])
+        clock.advance(65)
+        self.assertEqual(store.execute("GET k"), ["v"])
+
+    def test_expiries_are_absolute_across_restarts(self):
+        clock = db.ManualClock(1_000_000)
+        store = self.open(clock=clock)
+        store.execute("SETEX k 10 v")
+        store.close()
+        clock.advance(11)  # Downtime counts against the TTL
+        store = self.open(clock=clock)
+        self.assertEqual(store.execute("GET k"), ["nil"])
+
+    def test_manual_clock_starts_at_the_current_time(self):
+        before = time.time()
+        clock = db.ManualClock()
+        self.assertGreaterEqual(clock(), before)
+        self.assertLessEqual(clock(), time.time())
+        self.assertEqual(clock(), clock())  # It doesn't move on its own
+
+
+class FakeClockExampleTest(StoreTest):
+    def test_key_expires_when_clock_is_advanced(self):
+        clock = db.ManualClock(1_000_000)
+        store = self.open(clock=clock)
+        store.execute("SET k v")
+        self.assertEqual(store.execute("EXPIRE k 10"), ["1"])
+        clock.advance(9)
+        self.assertEqual(store.execute("TTL k"), ["1"])
+        self.assertEqual(store.execute("GET k"), ["v"])
+        clock.advance(2)
+        self.assertEqual(store.execute("GET k"), ["nil"])
+        self.assertEqual(store.execute("TTL k"), ["-2"])
+
+    def test_docstring_example(self):
+        clock = db.ManualClock()
+        store = self.open(clock=clock)
+        store.setex("k", "10", "v")
+        clock.advance(11)
+        self.assertEqual(store.get("k"), "nil")
+
+
+class ProcessBatchTest(ServerTest):
+    def test_batch_set_and_get(self):
+        store = self.open()
+        self.assertEqual(db.process_batch(store, ["SET k v", "GET k"]), [["OK"], ["v"]])
+
+    def test_exit_ends_the_batch(self):
+        store = self.open()
+        self.assertEqual(db.process_batch(store, ["SET a 1", "EXIT", "SET b 2"]), [["OK"], None])
+        self.assertEqual(store.execute("MGET a b"), ["1", "nil"])
+
+    def test_errors_dont_stop_the_batch(self):
+        store = self.open()
+        results = db.process_batch(store, ["NOPE", "SET k v"])
+        self.assertError(results[0])
+        self.assertEqual(results[1], ["OK"])
+
+    def test_transaction_applies_batch_atomically(self):
+        store = self.open()
+        results = db.process_batch(store, ["BEGIN", "SET a 1", "SET b 2", "COMMIT", "MGET a b"])
+        self.assertEqual(results[-1], ["1", "2"])
+
+    def test_line_server_replies_to_a_pipelined_batch(self):
+        conn = self.connect(self.serve(db.KVServer, self.open()))
+        conn.sendall(b"".join(b"SET k%d v%d\n" % (i, i) for i in range(50)) + b"GET k49\n")
+        self.assertEqual(self.read_lines(conn, 51), ["OK"] * 50 + ["v49"])
+
+
+class EmbeddedTest(StoreTest):
+    def test_docstring_example(self):
+        store = db.open_store(self.path)
+        self.assertEqual(store.execute("SET greeting hello"), ["OK"])
+        self.assertEqual(store.get("greeting"), "hello")
+        store.close()
+        self.assertTrue(os.path.exists(self.path))
+
+    def test_reopened_store_sees_earlier_writes(self):
+        store = db.open_store(self.path, fsync_policy="no")
+        store.execute("RPUSH l a b")
+        store.set("k", "v")
+        store.close()
+        store = db.open_store(self.path)
+        self.addCleanup(store.close)
+        self.assertEqual(store.get("k"), "v")
+        self.assertEqual(store.execute("LRANGE l 0 -1"), ["a", "b", "END"])
+
+    def test_stores_in_one_process_are_independent(self):
+        first = db.open_store(self.path)
+        second = db.open_store(os.path.join(self.dir, "other.db"))
+        self.addCleanup(first.close)
+        self.addCleanup(second.close)
+        first.set("k", "first")
+        second.set("k", "second")
+        self.assertEqual((first.get("k"), second.get("k")), ("first", "second"))
+
+    def test_no_file_until_the_first_write(self):
+        store = db.open_store(self.path)
+        self.addCleanup(store.close)
+        self.assertEqual(store.get("k"), "nil")
+        self.assertFalse(os.path.exists(self.path))
+
+    def test_cli_reads_what_the_library_wrote(self):
+        store = db.open_store(self.path)
+        store.execute("SET k 'from the library'")
+        store.close()
+        result = subprocess.run([sys.executable, db.__file__], cwd=self.dir, input="GET k\n",
+                                capture_output=True, text=True, timeout=30)
+        self.assertEqual(result.stdout, "from the library\n")
+
+
+class TypedStoreTest(StoreTest):
+    def setUp(self):
+        super().setUp()
+        self.clock = db.ManualClock(1_000_000)
+        self.store = self.open(clock=self.clock)
+        self.typed = db.TypedStore(self.store)
+
+    def test_set_get_delete(self):
+        typed = self.typed
+        typed.set("k", "v")
+        self.assertEqual(typed.get("k"), "v")
+        self.assertIsNone(typed.get("missing"))
+        self.assertTrue(typed.delete("k"))
+        self.assertFalse(typed.delete("k"))
+        self.assertIsNone(typed.get("k"))
+
+    def test_expire_and_ttl(self):
+        typed = self.typed
+        typed.set("k", "v", ttl=timedelta(seconds=10))
+        self.assertEqual(typed.ttl("k"), timedelta(seconds=10))
+        self.assertTrue(typed.expire("k", timedelta(milliseconds=1500)))
+        self.assertEqual(typed.ttl("k"), timedelta(milliseconds=1500))
+        self.clock.advance(2)
+        self.assertIsNone(typed.get("k"))
+        with self.assertRaises(KeyError):
+            typed.ttl("k")
+        self.assertFalse(typed.expire("k", timedelta(seconds=1)))
+        typed.set("k", "v", ttl=timedelta(seconds=10))
+        typed.set("k", "w")  # Clears the TTL, like SET
+        self.assertIsNone(typed.ttl("k"))
+
+    def test_persistent_key_has_no_ttl(self):
+        self.typed.set("k", "v")
+        self.assertIsNone(self.typed.ttl("k"))
+
+    def test_non_positive_ttl_is_refused(self):
+        with self.assertRaises(ValueError):
+            self.typed.set("k", "v", ttl=timedelta(0))
+        with self.assertRaises(ValueError):
+            self.typed.expire("k", timedelta(seconds=-1))
+        self.assertIsNone(self.typed.get("k"))
+
+    def test_values_that_look_like_replies(self):
+        typed = self.typed
+        typed.set("boom", "ERR boom")
+        typed.set("nil", "nil")
+        self.assertEqual(typed.get("boom"), "ERR boom")
+        self.assertEqual(typed.get("nil"), "nil")
+
+    def test_error_replies_raise(self):
+        self.store.execute("RPUSH l a")
+        with self.assertRaises(db.CommandError) as caught:
+            self.typed.get("l")
+        self.assertTrue(str(caught.exception).startswith("WRONGTYPE"))
+
+    def test_logs_like_the_commands(self):
+        self.typed.set("a", "1")
+        self.typed.set("b", "2", ttl=timedelta(seconds=5))
+        self.typed.delete("a")
+        store = self.reopen(self.store, clock=self.clock)
+        self.assertEqual(store.execute("MGET a b"), ["nil", "2"])
+        self.assertEqual(store.execute("TTL b"), ["5"])
+
+    def test_nocase_keys(self):
+        store = db.KVStore(path=os.path.join(self.dir, "nocase.db"), nocase_keys=True)
+        self.addCleanup(store.close)
+        typed = db.TypedStore(store)
+        typed.set("Foo", "v")
+        self.assertEqual(typed.get("FOO"), "v")
+        self.assertEqual(store.execute("GET foo"), ["v"])
+        self.assertTrue(typed.expire("fOO", timedelta(seconds=5)))
+        self.assertTrue(typed.delete("foo"))
+
+
+class TrippingEvent(threading.Event):
+    """An Event that sets itself after being checked a number of times, to cancel a scan partway"""
+
+    def __init__(self, checks: int):
+        super().__init__()
+        self.checks = checks
+
+    def is_set(self) -> bool:
+        self.checks -= 1
+        if self.checks < 0:
+            self.set()
+        return super().is_set()
+
+
+class CancellationTest(StoreTest):
+    KEYS = 10 * db.CANCEL_CHECK_INTERVAL
+
+    def setUp(self):
+        super().setUp()
+        self.store = self.open(fsync_policy="no")
+        self.store.execute("MSET " + " ".join(f"k{i:06d} v" for i in range(self.KEYS)))
+
+    def test_cancel_during_large_range_scan(self):
+        cancel = TrippingEvent(3)
+        with self.assertRaises(db.OperationCancelled):
+            self.store.range("", "", cancel=cancel)
+        # It stopped at the fourth check, well short of the whole range
+        self.assertEqual(cancel.checks, -1)
+
+    def test_uncancelled_scan_completes(self):
+        self.assertEqual(len(self.store.range("", "", cancel=threading.Event())), self.KEYS + 1)
+
+    def test_cancel_set_beforehand_returns_at_once(self):
+        cancel = threading.Event()
+        cancel.set()
+        for scan in (lambda: self.store.rangecount("", "", cancel=cancel),
+                     lambda: self.store.prefix("k", cancel=cancel),
+                     lambda: self.store.delpattern("k*", cancel=cancel),
+                     lambda: list(self.store.iter_range(cancel=cancel))):
+            with self.assertRaises(db.OperationCancelled):
+                scan()
+        self.assertEqual(self.store.rangecount("", ""), str(self.KEYS))
+
+    def test_cancel_during_iteration(self):
+        cancel = threading.Event()
+        seen = 0
+        with self.assertRaises(db.OperationCancelled):
+            for _ in self.store.iter_range(cancel=cancel):
+                seen += 1
+                if seen == 10:
+                    cancel.set()
+        self.assertEqual(seen, db.RANGE_ITER_CHUNK)  # The chunk already read, then no more
+
+    def test_cancelled_compaction_writes_nothing(self):
+        with open(self.path, "rb") as f:
+            log = f.read()
+        with self.assertRaises(db.OperationCancelled):
+            self.store.compact(cancel=TrippingEvent(2))
+        self.assertFalse(os.path.exists(self.path + ".tmp"))
+        with open(self.path, "rb") as f:
+            self.assertEqual(f.read(), log)
+
+    def test_close_cancels_scans(self):
+        self.store.close()
+        with self.assertRaises(db.OperationCancelled):
+            self.store.rangecount("", "")
+
+
+class IterRangeTest(StoreTest):
+    KEYS = 2 * db.RANGE_ITER_CHUNK + 5
+
+    def setUp(self):
+        super().setUp()
+        self.store = self.open(fsync_policy="no")
+        self.store.execute("MSET " + " ".join(f"k{i:05d} v" for i in range(self.KEYS)))
+
+    def test_counts_without_building_the_whole_range(self):
+        with mock.patch.object(db.KVStore, "_range_chunk", autospec=True,
+                               side_effect=db.KVStore._range_chunk) as chunk:
+            count = sum(1 for _ in self.store.iter_range())
+        self.assertEqual(count, self.KEYS)
+        # Never more than a chunk of keys in memory at once
+        self.assertEqual(chunk.call_count, 3)
+        self.assertEqual(count, int(self.store.rangecount("", "")))
+
+    def test_matches_range_and_rangerev(self):
+        self.assertEqual(list(self.store.iter_range("k00990", "(k01010")),
+                         self.store.range("k00990", "(k01010")[:-1])
+        self.assertEqual(list(self.store.iter_range("k00990", "k01010", reverse=True)),
+                         self.store.rangerev("k00990", "k01010")[:-1])
+
+    def test_caller_may_write_while_iterating(self):
+        seen = []
+        for key in self.store.iter_range():
+            seen.append(key)
+            if key == "k00000":
+                self.store.execute("DEL k01500")  # In a later chunk: never seen
+                self.store.execute("SET k00500x v")  # In the chunk already read: missed
+        self.assertNotIn("k01500", seen)
+        self.assertNotIn("k00500x", seen)
+        self.assertEqual(seen, sorted(set(seen)))
+        self.assertEqual(len(seen), self.KEYS - 1)
+
+    def test_skips_expired_keys(self):
+        clock = db.ManualClock(1_000_000)
+        store = db.KVStore(path=os.path.join(self.dir, "ttl.db"), clock=clock)
+        self.addCleanup(store.close)
+        store.execute("SET a 1")
+        store.execute("SETEX b 1 2")
+        store.execute("SET c 3")
+        clock.advance(2)
+        self.assertEqual(list(store.iter_range()), ["a", "c"])
+
+
+class CompressionTest(StoreTest):
+    VALUE = "compressible " * 10_000
+
+    def test_large_value_round_trips_and_logs_smaller(self):
+        store = self.open(compress_threshold=1024)
+        store.set("big", self.VALUE)
+        self.assertEqual(store.get("big"), self.VALUE)
+        self.assertIsInstance(store.data[0][1], db.CompressedString)
+        (entry,) = log_entries(self.path)
+        self.assertTrue(entry.startswith("SETZ big "))
+        self.assertLess(os.path.getsize(self.path), len(self.VALUE) // 10)
+        # Replay decompresses whatever the threshold is now
+        store = self.reopen(store)
+        self.assertEqual(store.get("big"), self.VALUE)
+        self.assertEqual(store.execute("GETRANGE big 0 11"), ["compressible"])
+
+    def test_small_and_incompressible_values_stay_plain(self):
+        store = self.open(compress_threshold=1024)
+        noise = os.urandom(2048).decode("utf-8", db.TEXT_ERRORS)  # Random bytes don't compress
+        store.set("small", "x" * 100)
+        store.set("noise", noise)
+        self.assertEqual([type(value) for _, value, _ in store.data], [str, str])
+        self.assertEqual([entry.split(" ", 1)[0] for entry in log_entries(self.path)], ["SET", "SET"])
+
+    def test_disabled_by_default(self):
+        store = self.open()
+        store.set("big", self.VALUE)
+        self.assertEqual(log_entries(self.path), [db._command_line("SET", "big", self.VALUE)])
+
+    def test_ttl_kept_through_compression(self):
+        clock = db.ManualClock(1_000_000)
+        store = self.open(compress_threshold=1024, clock=clock)
+        store.execute(f"SETEX big 100 '{self.VALUE}'")
+        self.assertTrue(log_entries(self.path)[0].startswith("SETEXZ big "))
+        store = self.reopen(store, clock=clock)
+        self.assertEqual(store.execute("TTL big"), ["100"])
+        self.assertEqual(store.get("big"), self.VALUE)
+
+    def test_binary_log_format(self):
+        store = self.open(compress_threshold=1024, log_format="binary")
+        store.set("big", self.VALUE)
+        self.assertLess(os.path.getsize(self.path), len(self.VALUE) // 10)
+        store = self.reopen(store)
+        self.assertEqual(store.get("big"), self.VALUE)
+
+
+class SnapshotChecksumTest(StoreTest):
+    def write_snapshot(self) -> list:
+        store = self.open()
+        for i in range(50):
+            store.execute(f"SET k{i} {i}")
+        store.execute("HSET h f v")
+        store.execute("SNAPSHOT")
+        store.execute("SET after 1")
+        expected = self.state(store)
+        store.close()
+        return expected
+
+    def mangle_snapshot(self, mangle):
+        with open(self.path + ".snap", "rb") as f:
+            data = bytearray(f.read())
+        with open(self.path + ".snap", "wb") as f:
+            f.write(mangle(data))
+
+    def test_flipped_byte_falls_back_to_log_replay(self):
+        expected = self.write_snapshot()
+
+        def flip(data):
+            data[len(data) // 2] ^= 0xFF
+            return bytes(data)
+
+        self.mangle_snapshot(flip)
+        store = self.open()
+        self.assertEqual(store.snapshot_status, "corrupt (snapshot checksum mismatch)")
+        self.assertEqual(self.state(store), expected)
+
+    def test_truncated_snapshot_falls_back(self):
+        expected = self.write_snapshot()
+        self.mangle_snapshot(lambda data: bytes(data[:len(data) // 3]))
+        store = self.open()
+        self.assertTrue(store.snapshot_status.startswith("corrupt"))
+        self.assertEqual(self.state(store), expected)
+
+    def test_foreign_file_falls_back(self):
+        expected = self.write_snapshot()
+        self.mangle_snapshot(lambda data: b"not a snapshot")
+        store = self.open()
+        self.assertEqual(store.snapshot_status, "corrupt (not a snapshot file)")
+        self.assertEqual(self.state(store), expected)
+
+    def test_cli_reports_the_fallback(self):
+        self.write_snapshot()
+        self.mangle_snapshot(lambda data: bytes(data[:-1]) + bytes([data[-1] ^ 1]))
+        result = subprocess.run([sys.executable, db.__file__], cwd=self.dir, input="GET after\n",
+                                capture_output=True, text=True, timeout=30)
+        self.assertEqual(result.stdout, "1\n")
+        self.assertIn("replayed the whole log", result.stderr)
+
+
+class WaitTest(StoreTest):
+    def test_everysec_wait_returns_after_the_background_fsync(self):
+        store = self.open(fsync_policy="everysec")
+        store.execute("SET warm up")
+        store.sync_log()
+        synced_at = []
+        real_fsync = os.fsync
+
+        def fsync(fd):
+            real_fsync(fd)
+            synced_at.append(time.monotonic())
+
+        with mock.patch.object(db.os, "fsync", fsync):
+            store.execute("SET k v")
+            self.assertEqual(synced_at, [])  # everysec leaves it to the background thread
+            self.assertEqual(store.execute("WAIT 1 5000"), ["1"])
+            returned_at = time.monotonic()
+        self.assertEqual(len(synced_at), 1)
+        self.assertLessEqual(synced_at[0], returned_at)
+
+    def test_blocks_until_a_sync(self):
+        store = self.open(fsync_policy="everysec")
+        store.execute("SET k v")
+        results = []
+        thread = threading.Thread(target=lambda: results.append(self.other_client(store, "WAIT 1 0")))
+        thread.start()
+        time.sleep(0.05)
+        self.assertEqual(results, [])
+        store.sync_log()
+        thread.join(5)
+        self.assertEqual(results, [[["1"]]])
+
+    def test_timeout_without_a_sync(self):
+        store = self.open(fsync_policy="everysec")
+        store.execute("SET k v")
+        with mock.patch.object(store, "sync_log"):  # Keep the background thread from syncing
+            self.assertEqual(store.execute("WAIT 1 50"), ["0"])
+        self.assertEqual(store.execute("WAIT 0 0"), ["0"])  # Reports without waiting
+
+    def test_always_policy_returns_at_once(self):
+        store = self.open()
+        store.execute("SET k v")
+        self.assertEqual(store.execute("WAIT 1 0"), ["1"])
+
+    def test_errors(self):
+        store = self.open(fsync_policy="no")
+        store.execute("SET k v")
+        self.assertEqual(store.execute("WAIT 1 0"), ["ERR WAIT cannot be used when appendfsync is no"])
+        self.assertError(store.execute("WAIT 2 0"))
+        self.assertError(store.execute("WAIT 1 -1"))
+        self.assertError(store.execute("WAIT one 0"))
+
+
+class ModifiedTimeTest(StoreTest):
+    def setUp(self):
+        super().setUp()
+        self.clock = db.ManualClock(1_000_000)
+        self.store = self.open(clock=self.clock)
+
+    def mtime(self, key: str) -> int:
+        return int(self.store.execute(f"OBJECT MTIME {key}")[0])
+
+    def test_advances_on_each_write(self):
+        store = self.store
+        store.execute("SET k a")
+        first = self.mtime("k")
+        self.assertEqual(first, 1_000_000_000)
+        self.clock.advance(1.5)
+        store.execute("SET k b")
+        second = self.mtime("k")
+        self.assertEqual(second, first + 1500)
+        self.clock.advance(1)
+        store.execute("EXPIRE k 100")
+        self.assertGreater(self.mtime("k"), second)
+        self.clock.advance(1)
+        store.execute("PERSIST k")
+        self.assertEqual(self.mtime("k"), 1_000_003_500)
+
+    def test_reads_leave_it(self):
+        self.store.execute("RPUSH l a")
+        self.clock.advance(5)
+        self.store.execute("LRANGE l 0 -1")
+        self.store.execute("OBJECT IDLETIME l")
+        self.assertEqual(self.mtime("l"), 1_000_000_000)
+        self.store.execute("RPUSH l b")
+        self.assertEqual(self.mtime("l"), 1_000_005_000)
+
+    def test_missing_key(self):
+        self.assertEqual(self.store.execute("OBJECT MTIME nope"), ["ERR no such key"])
+
+
+class GetIfNewerTest(StoreTest):
+    def setUp(self):
+        super().setUp()
+        self.clock = db.ManualClock(1_000_000)
+        self.store = self.open(clock=self.clock)
+        self.store.execute("SET k v1")
+
+    def test_modified_and_not_modified(self):
+        store = self.store
+        since = int(store.execute("OBJECT MTIME k")[0])
+        self.assertEqual(store.execute(f"GETIFNEWER k {since - 1}"), ["v1"])
+        self.assertEqual(store.execute(f"GETIFNEWER k {since}"), ["NOTMODIFIED"])
+        self.clock.advance(1)
+        store.execute("SET k v2")
+        self.assertEqual(store.execute(f"GETIFNEWER k {since}"), ["v2"])
+
+    def test_missing_and_wrong_type(self):
+        self.store.execute("RPUSH l a")
+        self.assertEqual(self.store.execute("GETIFNEWER missing 0"), ["nil"])
+        self.assertEqual(self.store.execute("GETIFNEWER l 0"), [db.WRONGTYPE_ERROR])
+        self.assertError(self.store.execute("GETIFNEWER k soon"))
+
+    def test_reads_through_the_transaction_buffer(self):
+        store = self.store
+        since = int(store.execute("OBJECT MTIME k")[0])
+        store.execute("BEGIN")
+        self.assertEqual(store.execute(f"GETIFNEWER k {since}"), ["NOTMODIFIED"])
+        store.execute("SET k queued")
+        self.assertEqual(store.execute(f"GETIFNEWER k {since}"), ["queued"])
+        store.execute("DEL k")
+        self.assertEqual(store.execute(f"GETIFNEWER k {since}"), ["nil"])
+        store.execute("ABORT")
+        self.assertEqual(store.execute(f"GETIFNEWER k {since}"), ["NOTMODIFIED"])
+
+
+class ImportTest(StoreTest):
+    DATASET = ("plain\tvalue\n"
+               "spaced key\tline one\\nline two\\ttabbed\n"
+               "\n"
+               "volatile\tv\t1000060000\n"
+               "lapsed\tv\t999999000\n")
+
+    def setUp(self):
+        super().setUp()
+        self.clock = db.ManualClock(1_000_000)
+        self.transfer_dir = os.path.join(self.dir, "transfer")
+        os.mkdir(self.transfer_dir)
+
+    def test_small_dataset_lands(self):
+        store = self.open(clock=self.clock)
+        store.execute("SET warm up")
+        with mock.patch.object(db.os, "fsync", wraps=os.fsync) as fsync:
+            self.assertEqual(store.import_from(io.StringIO(self.DATASET)), 3)
+        self.assertEqual(fsync.call_count, 1)
+        self.assertEqual(store.get("plain"), "value")
+        self.assertEqual(store.get("spaced key"), "line one\nline two\ttabbed")
+        self.assertEqual(store.execute("TTL volatile"), ["60"])
+        self.assertEqual(store.execute("EXISTS lapsed"), ["0"])  # Already expired
+        store = self.reopen(store, clock=self.clock)
+        self.assertEqual(store.execute("MGET plain volatile"), ["value", "v"])
+
+    def test_bad_lines_are_reported_and_nothing_imported(self):
+        store = self.open()
+        with self.assertRaises(db.ImportFormatError) as caught:
+            store.import_from(io.StringIO("good\tv\nno tab\n\tempty key\ngood2\tv\tsoon\n"))
+        self.assertEqual([line_no for line_no, _ in caught.exception.errors], [2, 3, 4])
+        self.assertEqual(store.execute("GET good"), ["nil"])
+
+    def test_import_command_reads_from_the_transfer_dir(self):
+        store = self.open(clock=self.clock, transfer_dir=self.transfer_dir)
+        with open(os.path.join(self.transfer_dir, "seed.tsv"), "w") as f:
+            f.write(self.DATASET)
+        self.assertEqual(store.execute("IMPORT seed.tsv"), ["3"])
+        self.assertEqual(store.get("plain"), "value")
+        with open(os.path.join(self.transfer_dir, "bad.tsv"), "w") as f:
+            f.write("a\tb\nbroken\n")
+        self.assertEqual(store.execute("IMPORT bad.tsv"), ["ERR nothing imported, line 2: expected key<TAB>value"])
+        self.assertError(store.execute("IMPORT missing.tsv"))
+
+    def test_transfer_dir_path_restrictions(self):
+        with open(os.path.join(self.dir, "outside.tsv"), "w") as f:
+            f.write("stolen\tv\n")
+        store = self.open(transfer_dir=self.transfer_dir)
+        for name in ("../outside.tsv", os.path.join(self.dir, "outside.tsv"), "..", ".", "''", '"a\\x00b"'):
+            self.assertError(store.execute(f"IMPORT {name}"))
+        self.assertEqual(store.execute("GET stolen"), ["nil"])
+
+    def test_disabled_without_transfer_dir(self):
+        store = self.open()
+        self.assertEqual(store.execute("IMPORT seed.tsv"),
+                         ["ERR file transfer is disabled, start the server with --transfer-dir"])
+
+    def test_maxkeys_refuses_the_whole_import(self):
+        store = self.open(maxkeys=1)
+        with self.assertRaises(ValueError):
+            store.import_from(io.StringIO("a\t1\nb\t2\nc\t3\n"))
+        self.assertEqual(self.state(store)[0], [])
+
+    def test_refused_inside_a_transaction(self):
+        store = self.open()
+        store.execute("BEGIN")
+        with self.assertRaises(ValueError):
+            store.import_from(io.StringIO("a\t1\n"))
+
+
+class ExportTest(StoreTest):
+    def setUp(self):
+        super().setUp()
+        self.clock = db.ManualClock(1_000_000)
+        self.transfer_dir = os.path.join(self.dir, "transfer")
+        os.mkdir(self.transfer_dir)
+
+    def fill(self, store: db.KVStore):
+        store.execute("SET plain 'with\ttab and\nnewline'")
+        store.execute("SETEX volatile 100 v")
+        store.execute("SETEX short 1 gone")
+        store.execute("RPUSH l a b")
+        store.execute("HSET h f v")
+        store.execute("SADD s x y")
+        store.execute("ZADD z 1 m")
+
+    def test_export_clear_reimport(self):
+        store = self.open(clock=self.clock)
+        self.fill(store)
+        self.clock.advance(2)
+        out = io.StringIO()
+        self.assertEqual(store.export_to(out), 6)
+        expected = [(key, value, ttl) for key, value, ttl in self.state(store)[0] if key != "short"]
+        store.close()
+        os.remove(self.path)
+
+        store = self.open(clock=self.clock)
+        self.assertEqual(self.state(store)[0], [])
+        self.assertEqual(store.import_from(io.StringIO(out.getvalue())), 6)
+        self.assertEqual(self.state(store)[0], expected)
+        self.assertEqual(store.execute("TTL volatile"), ["98"])  # Absolute expiries carry over
+
+    def test_export_command_writes_to_the_transfer_dir(self):
+        store = self.open(clock=self.clock, transfer_dir=self.transfer_dir)
+        self.fill(store)
+        self.assertEqual(store.execute("EXPORT backup.tsv"), ["7"])
+        other = db.KVStore(path=os.path.join(self.dir, "other.db"), clock=self.clock,
+                           transfer_dir=self.transfer_dir)
+        self.addCleanup(other.close)
+        self.assertEqual(other.execute("IMPORT backup.tsv"), ["7"])
+        self.assertEqual(self.state(other), self.state(store))
+        self.assertFalse(os.path.exists(os.path.join(self.transfer_dir, "backup.tsv.tmp")))
+
+    def test_path_restrictions(self):
+        store = self.open(transfer_dir=self.transfer_dir)
+        store.execute("SET k v")
+        for name in ("../escaped.tsv", os.path.join(self.dir, "escaped.tsv"), "..", "''"):
+            self.assertError(store.execute(f"EXPORT {name}"))
+        self.assertFalse(os.path.exists(os.path.join(self.dir, "escaped.tsv")))
+        self.assertError(store.execute("EXPORT backup.tsv CSV"))
+
+    def test_refused_on_a_replica(self):
+        primary = self.open()
+        primary.execute("SET k v")
+        replica = self.open(readonly=True, transfer_dir=self.transfer_dir)
+        self.assertEqual(replica.execute("EXPORT backup.tsv"), [db.READONLY_ERROR])
+        self.assertEqual(os.listdir(self.transfer_dir), [])
+
+    def test_disabled_without_transfer_dir(self):
+        store = self.open()
+        self.assertError(store.execute("EXPORT backup.tsv"))
+
+    def test_failed_export_leaves_no_partial_file(self):
+        store = self.open(transfer_dir=self.transfer_dir)
+        store.execute("SET k v")
+
+        def export_to(out, as_json=False):
+            out.write("partial")
+            raise error
+
+        for error in (OSError(28, "No space left on device"), RuntimeError("interrupted")):
+            with mock.patch.object(store, "export_to", export_to):
+                self.assertError(store.execute("EXPORT backup.tsv"))
+            self.assertEqual(os.listdir(self.transfer_dir), [])
+
+
+class JSONExportTest(StoreTest):
+    def export(self, store: db.KVStore) -> dict:
+        out = io.StringIO()
+        count = store.export_to(out, as_json=True)
+        exported = json.loads(out.getvalue())
+        self.assertEqual(len(exported), count)
+        return exported
+
+    def test_round_trips_through_json(self):
+        clock = db.ManualClock(1_000_000)
+        store = self.open(clock=clock)
+        tricky = 'quote " backslash \\ newline \n tab \t unicode é ☃'
+        store.set('key "quoted"\n', tricky)
+        store.execute("SETEX volatile 100 v")
+        store.execute("SETEX short 1 gone")
+        store.execute("RPUSH l b a")
+        store.execute("HSET h f v")
+        store.execute("SADD s y x")
+        store.execute("ZADD z 2.5 m 1 n")
+        clock.advance(2)
+        self.assertEqual(self.export(store), {
+            'key "quoted"\n': {"type": "string", "value": tricky, "expiresAt": None},
+            "volatile": {"type": "string", "value": "v", "expiresAt": 1_000_100_000},
+            "l": {"type": "list", "value": ["b", "a"], "expiresAt": None},
+            "h": {"type": "hash", "value": {"f": "v"}, "expiresAt": None},
+            "s": {"type": "set", "value": ["x", "y"], "expiresAt": None},
+            "z": {"type": "zset", "value": {"n": 1.0, "m": 2.5}, "expiresAt": None},
+        })
+
+    def test_empty_store(self):
+        self.assertEqual(self.export(self.open()), {})
+
+    def test_export_json_command(self):
+        transfer_dir = os.path.join(self.dir, "transfer")
+        os.mkdir(transfer_dir)
+        store = self.open(transfer_dir=transfer_dir)
+        store.execute("SET k v")
+        self.assertEqual(store.execute("EXPORT dump.json json"), ["1"])
+        with open(os.path.join(transfer_dir, "dump.json")) as f:
+            self.assertEqual(json.load(f), {"k": {"type": "string", "value": "v", "expiresAt": None}})
+
+
+class TxStatusTest(StoreTest):
+    def test_reflects_the_queue_since_begin(self):
+        store = self.open()
+        store.execute("SET before 1")
+        store.execute("BEGIN")
+        self.assertEqual(store.execute("TXSTATUS"), ["0", "END"])
+        store.execute("SET a 1")
+        store.execute("DEL b")
+        store.execute("EXPIRE a 10")
+        store.execute("RPUSH l x")
+        self.assertEqual(store.execute("TXSTATUS"), ["4", "SET a", "DEL b", "EXPIRE a", "SET l", "END"])
+
+    def test_includes_nested_levels_until_aborted(self):
+        store = self.open()
+        store.execute("BEGIN")
+        store.execute("SET a 1")
+        store.execute("BEGIN")
+        store.execute("SET 'spaced key' 2")
+        self.assertEqual(store.execute("TXSTATUS"), ["2", "SET a", 'SET "spaced key"', "END"])
+        store.execute("ABORT")
+        self.assertEqual(store.execute("TXSTATUS"), ["1", "SET a", "END"])
+
+    def test_outside_a_transaction(self):
+        store = self.open()
+        self.assertEqual(store.execute("TXSTATUS"), ["ERR no transaction in progress"])
+        store.execute("BEGIN")
+        store.execute("SET a 1")
+        store.execute("COMMIT")
+        self.assertEqual(store.execute("TXSTATUS"), ["ERR no transaction in progress"])
+
+    def test_per_session(self):
+        store = self.open()
+        store.execute("BEGIN")
+        store.execute("SET a 1")
+        self.assertEqual(self.other_client(store, "TXSTATUS"), [["ERR no transaction in progress"]])
+
+
+class TransactionAliasTest(StoreTest):
+    def run_script(self, begin: str, abort: str) -> Tuple[List[List[str]], list]:
+        store = self.open()
+        replies = [store.execute(line) for line in (
+            abort,
+            begin,
+            "SET a 1",
+            begin,
+            "SET b 2",
+            abort,
+            "TXSTATUS",
+            "COMMIT",
+            begin,
+            "SET c 3",
+            abort,
+            abort,
+        )]
+        return replies, self.state(store)[0]
+
+    def test_multi_and_discard_match_begin_and_abort(self):
+        self.assertEqual(self.run_script("MULTI", "DISCARD"), self.run_script("BEGIN", "ABORT"))
+
+    def test_aliases_share_the_no_transaction_error(self):
+        store = self.open()
+        self.assertEqual(store.execute("DISCARD"), store.execute("ABORT"))
+        self.assertEqual(store.execute("DISCARD"), ["ERR no transaction in progress"])
+
+    def test_aliases_are_case_insensitive(self):
+        store = self.open()
+        store.execute("multi")
+        store.execute("SET a 1")
+        store.execute("discard")
+        self.assertEqual(store.execute("GET a"), ["nil"])
+        self.assertEqual(store.execute("TXSTATUS"), ["ERR no transaction in progress"])
+
+
+if __name__ == "__main__":
+    unittest.main()